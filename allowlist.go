@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// filterEntryKeys is the final pass applied to every serialized entry when
+// LOG_KEY_ALLOWLIST is set: top-level keys not in allow are removed so strict
+// downstream schemas never see an unexpected field, whatever options add.
+// Key order and the values of kept keys are preserved byte for byte. It
+// returns the filtered entry and the number of keys removed. Input that is
+// not a JSON object is returned unchanged.
+func filterEntryKeys(data []byte, allow map[string]bool) ([]byte, int) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return data, 0
+	}
+	var out bytes.Buffer
+	out.Grow(len(data))
+	out.WriteByte('{')
+	dropped := 0
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return data, 0
+		}
+		key, _ := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return data, 0
+		}
+		if !allow[key] {
+			dropped++
+			continue
+		}
+		if out.Len() > 1 {
+			out.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		out.Write(name)
+		out.WriteByte(':')
+		out.Write(value)
+	}
+	out.WriteByte('}')
+	return out.Bytes(), dropped
+}
+
+// keyFilterSink wraps the sink chain and applies filterEntryKeys to every
+// entry written through it, counting removed keys in allowlistDroppedKeys.
+type keyFilterSink struct {
+	logSink
+	allow map[string]bool
+}
+
+func newKeyFilterSink(next logSink, keys []string) *keyFilterSink {
+	allow := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		allow[k] = true
+	}
+	return &keyFilterSink{logSink: next, allow: allow}
+}
+
+// Write filters p and passes it on, reporting len(p) on success so callers
+// see their whole entry as consumed.
+func (s *keyFilterSink) Write(p []byte) (int, error) {
+	entry := bytes.TrimSuffix(p, []byte("\n"))
+	filtered, dropped := filterEntryKeys(entry, s.allow)
+	if dropped > 0 {
+		allowlistDroppedKeys.Add(int64(dropped))
+	}
+	if len(entry) < len(p) {
+		filtered = append(filtered, '\n')
+	}
+	if _, err := s.logSink.Write(filtered); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// batchQueue is the buffering half shared by the network sinks (webhook,
+// Cloud Logging). Write never blocks the log writer goroutine: entries are
+// queued on a bounded channel and a background goroutine hands them to flush
+// in batches of up to batchSize whenever the batch fills or flushInterval
+// elapses. Entries that do not fit in the queue are dropped, counted in
+// dropped, and logged. Close flushes whatever is still queued.
+type batchQueue struct {
+	name          string // sink name used in log messages, e.g. "webhook"
+	batchSize     int
+	flushInterval time.Duration
+	flush         func(batch [][]byte)
+	dropped       *atomic.Int64
+
+	mu     sync.RWMutex // guards closed against concurrent Write/Close
+	closed bool
+	queue  chan []byte
+	done   chan struct{}
+}
+
+// newBatchQueue starts the batching goroutine. batchSize and bufferSize are
+// raised to at least 1 and a non-positive flushInterval defaults to 1s.
+func newBatchQueue(name string, batchSize, bufferSize int, flushInterval time.Duration,
+	dropped *atomic.Int64, flush func(batch [][]byte)) *batchQueue {
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+	q := &batchQueue{
+		name:          name,
+		batchSize:     max(batchSize, 1),
+		flushInterval: flushInterval,
+		flush:         flush,
+		dropped:       dropped,
+		queue:         make(chan []byte, max(bufferSize, 1)),
+		done:          make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Write queues one serialized entry. It always reports success: when the
+// queue is full the entry is dropped and counted rather than blocking. That
+// is why validateConfig refuses FALLBACK_STDERR with the webhook and gcp sinks.
+func (q *batchQueue) Write(p []byte) (int, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return 0, errors.New(q.name + " sink closed")
+	}
+	entry := bytes.Clone(bytes.TrimSuffix(p, []byte("\n")))
+	select {
+	case q.queue <- entry:
+	default:
+		q.dropped.Add(1)
+		slog.Warn(q.name+" sink: buffer full, dropping log entry", "buffer", cap(q.queue))
+	}
+	return len(p), nil
+}
+
+// Close stops accepting entries, flushes everything still queued, and waits
+// for the final flush to finish.
+func (q *batchQueue) Close() error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.queue)
+	}
+	q.mu.Unlock()
+	<-q.done
+	return nil
+}
+
+// run accumulates queued entries into batches and flushes them on size,
+// interval, or shutdown. Empty batches are never passed to flush.
+func (q *batchQueue) run() {
+	defer close(q.done)
+	ticker := time.NewTicker(q.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([][]byte, 0, q.batchSize)
+	send := func() {
+		if len(batch) > 0 {
+			q.flush(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case entry, ok := <-q.queue:
+			if !ok {
+				send()
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) >= q.batchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		}
+	}
+}
@@ -3,12 +3,23 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"mime"
 	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/textproto"
+	"regexp"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -20,19 +31,37 @@ const largeStringThreshold = 512
 
 // decodeChunked decodes a chunked-transfer-encoded body and returns it as a string.
 func decodeChunked(data []byte) string {
+	body, _ := decodeChunkedTrailers(data)
+	return body
+}
+
+// decodeChunkedTrailers decodes a chunked body like decodeChunked and also
+// returns the trailer headers that follow the zero-size chunk
+// ("0\r\nX-Checksum: abc\r\n\r\n"), or nil when there are none. Chunk
+// extensions ("5;ext=val") are ignored.
+func decodeChunkedTrailers(data []byte) (string, http.Header) {
 	var result bytes.Buffer
+	var trailers http.Header
 	reader := bufio.NewReader(bytes.NewReader(data))
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
 			break
 		}
+		line, _, _ = strings.Cut(line, ";")
 		line = strings.TrimSpace(line)
 		if line == "" {
 			continue
 		}
 		size, err := strconv.ParseInt(line, 16, 64)
-		if err != nil || size == 0 {
+		if err != nil {
+			break
+		}
+		if size == 0 {
+			h, _ := textproto.NewReader(reader).ReadMIMEHeader()
+			if len(h) > 0 {
+				trailers = http.Header(h)
+			}
 			break
 		}
 		chunk := make([]byte, size)
@@ -42,7 +71,7 @@ func decodeChunked(data []byte) string {
 		result.Write(chunk)
 		reader.ReadString('\n') // consume trailing \r\n after chunk data
 	}
-	return result.String()
+	return result.String(), trailers
 }
 
 // isChunkedBody returns true if data looks like a chunked-encoded body.
@@ -68,6 +97,9 @@ func isChunkedBody(data []byte) bool {
 //  2. Non-printable ASCII ratio — even for valid UTF-8 content, if more than
 //     10% of the first 512 bytes are ASCII control characters the body is
 //     treated as binary.
+//
+// A body that starts with a known file signature (see detectFileType) is
+// binary regardless, so a 7-bit clean PDF is not logged as text.
 func isBinary(data []byte) bool {
 	sample := data
 	if len(sample) > 512 {
@@ -76,6 +108,9 @@ func isBinary(data []byte) bool {
 	if len(sample) == 0 {
 		return false
 	}
+	if detectFileType(sample) != "" {
+		return true
+	}
 	// Signal 1: invalid UTF-8 → binary.
 	// This catches gzip, deflate, brotli, JPEG, PNG, ZIP, PDF and any other
 	// format whose bytes don't form valid UTF-8 sequences.
@@ -92,6 +127,42 @@ func isBinary(data []byte) bool {
 	return nonPrintable*100/len(sample) > 10
 }
 
+// fileSignatures maps the leading magic bytes of common file formats to their
+// media type. Only formats worth telling apart in a log are listed; anything
+// else stays a plain "[binary: N bytes]".
+var fileSignatures = []struct {
+	magic     string
+	mediaType string
+}{
+	{"%PDF-", "application/pdf"},
+	{"\x89PNG\r\n\x1a\n", "image/png"},
+	{"\xff\xd8\xff", "image/jpeg"},
+	{"PK\x03\x04", "application/zip"},
+	{"PK\x05\x06", "application/zip"}, // empty archive
+	{"PK\x07\x08", "application/zip"}, // spanned archive
+	{"\x1f\x8b", "application/gzip"},
+	{"\x7fELF", "application/x-elf"},
+}
+
+// detectFileType returns the media type of data when it starts with one of
+// fileSignatures, or with a DOS stub whose e_lfanew field (offset 0x3c)
+// points at a "PE\0\0" header, and "" otherwise. A bare "MZ" is not enough:
+// plenty of text starts with those two letters.
+func detectFileType(data []byte) string {
+	for _, sig := range fileSignatures {
+		if bytes.HasPrefix(data, []byte(sig.magic)) {
+			return sig.mediaType
+		}
+	}
+	if len(data) >= 0x40 && data[0] == 'M' && data[1] == 'Z' {
+		off := int(binary.LittleEndian.Uint32(data[0x3c:]))
+		if off >= 0x40 && off <= len(data)-4 && string(data[off:off+4]) == "PE\x00\x00" {
+			return "application/vnd.microsoft.portable-executable"
+		}
+	}
+	return ""
+}
+
 // looksLikeBase64 returns true if s is a large Base64-encoded payload.
 //
 // Three encoding variants are recognised:
@@ -161,6 +232,69 @@ func looksLikeBase64(s string) bool {
 	return err == nil
 }
 
+// bodyBase64Share is the fraction of a body's non-whitespace bytes that must
+// sit in long Base64 runs for bodyLooksBase64 to flag it.
+const bodyBase64Share = 0.8
+
+// bodyLooksBase64 reports whether a whole body is predominantly Base64 — the
+// shape of a payload smuggled out as text (DETECT_BASE64_BODY). Only runs of
+// at least 64 Base64-alphabet bytes count, the runs must add up to at least
+// largeStringThreshold bytes and bodyBase64Share of the non-whitespace bytes,
+// and the longest run must decode, so short tokens, hashes, and ordinary
+// prose or form data are not flagged. When it is, decodedType is the media
+// type sniffed from the decoded start of the longest run (e.g.
+// "application/zip"), a hint at what was encoded without logging it.
+func bodyLooksBase64(body string) (ok bool, decodedType string) {
+	if len(body) < largeStringThreshold {
+		return false, ""
+	}
+	isB64 := func(c byte) bool {
+		return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+			c == '+' || c == '/' || c == '-' || c == '_' || c == '='
+	}
+	var nonSpace, inRuns int
+	var longest string
+	for i := 0; i < len(body); {
+		c := body[i]
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			i++
+			continue
+		}
+		if !isB64(c) {
+			nonSpace++
+			i++
+			continue
+		}
+		j := i
+		for j < len(body) && isB64(body[j]) {
+			j++
+		}
+		nonSpace += j - i
+		if j-i >= 64 {
+			inRuns += j - i
+			if j-i > len(longest) {
+				longest = body[i:j]
+			}
+		}
+		i = j
+	}
+	if inRuns < largeStringThreshold || float64(inRuns) < bodyBase64Share*float64(nonSpace) {
+		return false, ""
+	}
+	// Decode a prefix on a 4-byte boundary; MIME-wrapped bodies are several
+	// runs, and the longest one is representative.
+	sample := longest[:min(len(longest), 512)&^3]
+	enc := base64.StdEncoding
+	if strings.ContainsAny(sample, "-_") {
+		enc = base64.URLEncoding
+	}
+	decoded, err := enc.DecodeString(sample)
+	if err != nil {
+		return false, ""
+	}
+	return true, sniffBodyType(string(decoded))
+}
+
 // redactJSONLargeStrings walks a decoded JSON value tree and replaces any string
 // value that exceeds largeStringThreshold AND looks like Base64 with a safe
 // redaction marker. All other values are returned unchanged.
@@ -208,6 +342,63 @@ func sanitizeJSONBody(body string, redactTokens bool) string {
 	return string(out)
 }
 
+// isJSONContentType reports whether a Content-Type header value declares a
+// JSON media type: application/json or any structured-syntax "+json" suffix.
+func isJSONContentType(contentType string) bool {
+	ct, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return ct == "application/json" || strings.HasSuffix(ct, "+json")
+}
+
+// structuredJSONBody returns body as a json.RawMessage so it can be embedded
+// in the log entry as a nested object rather than an escaped string.
+// body is expected to be the output of sanitizeBody, so Base64 and token
+// redaction have already been applied.
+//
+// ok is false — and the caller keeps the plain-string body — when the declared
+// Content-Type is not JSON, the body is not valid JSON, it is longer than
+// maxBytes, or it nests deeper than maxDepth. The depth check streams tokens
+// so a huge array is never materialised a second time. maxBytes or maxDepth
+// <= 0 disables that limit.
+func structuredJSONBody(body, contentType string, maxBytes, maxDepth int) (json.RawMessage, bool) {
+	if body == "" || !isJSONContentType(contentType) {
+		return nil, false
+	}
+	if maxBytes > 0 && len(body) > maxBytes {
+		return nil, false
+	}
+	if !json.Valid([]byte(body)) {
+		return nil, false
+	}
+	if maxDepth > 0 {
+		dec := json.NewDecoder(strings.NewReader(body))
+		depth := 0
+		for {
+			tok, err := dec.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, false
+			}
+			if d, ok := tok.(json.Delim); ok {
+				switch d {
+				case '{', '[':
+					depth++
+					if depth > maxDepth {
+						return nil, false
+					}
+				default:
+					depth--
+				}
+			}
+		}
+	}
+	return json.RawMessage(body), true
+}
+
 // parseMultipartBody parses a multipart/form-data body and returns a human-readable
 // summary of each part.
 func parseMultipartBody(body, boundary string) string {
@@ -219,6 +410,7 @@ func parseMultipartBody(body, boundary string) string {
 			break
 		}
 		data, _ := io.ReadAll(part)
+		data = decodePartTransferEncoding(data, part.Header.Get("Content-Transfer-Encoding"))
 		filename := part.FileName()
 		fieldName := part.FormName()
 		ct := part.Header.Get("Content-Type")
@@ -226,6 +418,11 @@ func parseMultipartBody(body, boundary string) string {
 			ct = "application/octet-stream"
 		}
 		if filename != "" {
+			// A generic declared type says nothing; name the sniffed one.
+			if detected := detectFileType(data); detected != "" && ct == "application/octet-stream" {
+				parts = append(parts, fmt.Sprintf(`[file: %q, content-type: %q, detected: %q, %d bytes]`, filename, ct, detected, len(data)))
+				continue
+			}
 			parts = append(parts, fmt.Sprintf(`[file: %q, content-type: %q, %d bytes]`, filename, ct, len(data)))
 		} else if isBinary(data) {
 			parts = append(parts, fmt.Sprintf(`[field: %q, binary, %d bytes]`, fieldName, len(data)))
@@ -239,6 +436,37 @@ func parseMultipartBody(body, boundary string) string {
 	return strings.Join(parts, "; ")
 }
 
+// decodePartTransferEncoding undoes a MIME part's Content-Transfer-Encoding
+// (RFC 2045 §6) so its content is classified as text or binary on what it
+// actually carries. multipart.Reader already decodes quoted-printable and
+// drops the header, so in practice this handles base64; quoted-printable is
+// decoded here too in case the header survives. Unknown encodings and decode
+// errors return data unchanged.
+func decodePartTransferEncoding(data []byte, cte string) []byte {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, data)
+		out := make([]byte, base64.StdEncoding.DecodedLen(len(clean)))
+		n, err := base64.StdEncoding.Decode(out, clean)
+		if err != nil {
+			return data
+		}
+		return out[:n]
+	case "quoted-printable":
+		out, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return data
+		}
+		return out
+	}
+	return data
+}
+
 // isCompressedEncoding returns true when the HTTP Content-Encoding header
 // indicates the body has been compressed at the transport layer.
 // Such bodies are always binary after ICAP chunked-decoding and must never
@@ -253,21 +481,119 @@ func isCompressedEncoding(contentEncoding string) bool {
 	return false
 }
 
+// contentDecoders undoes one Content-Encoding coding, keyed by its
+// lowercase token. Each decoder produces at most maxSize bytes and returns
+// errDecompressedTooLarge beyond that. Supporting another coding is one
+// entry here.
+var contentDecoders = map[string]func(data []byte, maxSize int64) ([]byte, error){
+	"gzip":    gunzip,
+	"x-gzip":  gunzip,
+	"deflate": inflate,
+	"br":      decodeBrotli,
+}
+
+// decodeContentEncoding reverses a gzip / deflate / br Content-Encoding so
+// the plain body can be sanitized instead of being summarised as binary.
+// Stacked encodings ("gzip, br") are undone in reverse order.
+//
+// Returns ok=false — and the caller keeps the raw compressed body — when the
+// header names a coding without an entry in contentDecoders (zstd, …), when
+// decompression fails, or when the decompressed output would exceed maxSize
+// (decompression-bomb guard). maxSize <= 0 disables decoding entirely.
+func decodeContentEncoding(body, contentEncoding string, maxSize int64) (string, bool) {
+	if body == "" || contentEncoding == "" || maxSize <= 0 {
+		return "", false
+	}
+	var decoders []func([]byte, int64) ([]byte, error)
+	for _, token := range strings.Split(contentEncoding, ",") {
+		token = strings.TrimSpace(strings.ToLower(token))
+		if token == "" || token == "identity" {
+			continue
+		}
+		decode, ok := contentDecoders[token]
+		if !ok {
+			return "", false
+		}
+		decoders = append(decoders, decode)
+	}
+	if len(decoders) == 0 {
+		return "", false
+	}
+
+	data := []byte(body)
+	for i := len(decoders) - 1; i >= 0; i-- {
+		out, err := decoders[i](data, maxSize)
+		if err != nil {
+			return "", false
+		}
+		data = out
+	}
+	return string(data), true
+}
+
+// errDecompressedTooLarge is returned by decompress when the output would
+// exceed the caller's size limit.
+var errDecompressedTooLarge = errors.New("decompressed body exceeds max size")
+
+// readDecompressed reads the output of a decompressing reader, at most
+// maxSize bytes.
+func readDecompressed(r io.Reader, maxSize int64) ([]byte, error) {
+	out, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > maxSize {
+		return nil, errDecompressedTooLarge
+	}
+	return out, nil
+}
+
+// gunzip undoes a gzip coding.
+func gunzip(data []byte, maxSize int64) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return readDecompressed(zr, maxSize)
+}
+
+// inflate undoes a deflate coding. It is tried as zlib-wrapped (RFC 9110)
+// first and then as raw DEFLATE, which some servers send despite the spec.
+func inflate(data []byte, maxSize int64) ([]byte, error) {
+	if zr, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+		out, err := readDecompressed(zr, maxSize)
+		zr.Close()
+		if err == nil || errors.Is(err, errDecompressedTooLarge) {
+			return out, err
+		}
+	}
+	fr := flate.NewReader(bytes.NewReader(data))
+	defer fr.Close()
+	return readDecompressed(fr, maxSize)
+}
+
 // sanitizeBody inspects a decoded body string and returns a safe log-friendly
 // representation:
 //   - compressed (Content-Encoding: gzip/deflate/br/zstd) → [binary: N bytes, content-encoding: X]
 //   - multipart/form-data                                  → per-part summary
 //   - application/json (or +json)                          → JSON with Base64 + token fields redacted
-//   - binary content (invalid UTF-8 or high control-char density) → [binary: N bytes]
+//   - binary content (invalid UTF-8, high control-char density, or a known
+//     file signature)                                    → [binary: N bytes], or
+//     [binary: application/pdf, N bytes] when the signature is recognised
+//     (plus ", preview: <hexdump>" when previewBytes > 0, see binaryMarker)
 //   - any other non-binary body that parses as JSON        → JSON with Base64 + token fields redacted
 //     (content-sniff fallback — catches application/octet-stream uploads, e.g.
 //     AzCopy / Azure SDK, that carry a JSON body but declare a non-JSON Content-Type)
 //   - plain text                                           → returned as-is
 //
 // redactTokens controls whether JSON token fields are redacted in the same pass.
-func sanitizeBody(body, contentType, contentEncoding string, redactTokens bool) string {
+// With detect (DETECT_SECRETS) it also reports whether the body likely carries
+// a credential, judged before any redaction; a body still compressed is not
+// inspected.
+func sanitizeBody(body, contentType, contentEncoding string, redactTokens bool, previewBytes int, detect bool) (string, bool) {
 	if body == "" {
-		return ""
+		return "", false
 	}
 
 	// ── Content-Encoding fast path ─────────────────────────────────────────────
@@ -275,8 +601,9 @@ func sanitizeBody(body, contentType, contentEncoding string, redactTokens bool)
 	// compressed data — definitively binary, never human-readable.
 	if isCompressedEncoding(contentEncoding) {
 		ce := strings.TrimSpace(strings.ToLower(contentEncoding))
-		return fmt.Sprintf("[binary: %d bytes, content-encoding: %s]", len(body), ce)
+		return fmt.Sprintf("[binary: %d bytes, content-encoding: %s]", len(body), ce), false
 	}
+	suspected := detect && detectSecrets(body)
 
 	ct := ""
 	var params map[string]string
@@ -291,13 +618,13 @@ func sanitizeBody(body, contentType, contentEncoding string, redactTokens bool)
 	// ── multipart ──────────────────────────────────────────────────────────────
 	if strings.HasPrefix(ct, "multipart/") {
 		if boundary, ok := params["boundary"]; ok {
-			return parseMultipartBody(body, boundary)
+			return parseMultipartBody(body, boundary), suspected
 		}
 	}
 
 	// ── binary blob ────────────────────────────────────────────────────────────
 	if isBinary([]byte(body)) {
-		return fmt.Sprintf("[binary: %d bytes]", len(body))
+		return binaryMarker(body, previewBytes), suspected
 	}
 
 	// ── JSON (declared or content-sniffed) ─────────────────────────────────────
@@ -305,11 +632,60 @@ func sanitizeBody(body, contentType, contentEncoding string, redactTokens bool)
 	// actually parses as JSON (content-sniff for AzCopy octet-stream etc.).
 	// Both Base64-field and token redaction happen in a single unmarshal/marshal pass.
 	if sanitized := sanitizeJSONBody(body, redactTokens); sanitized != "" {
-		return sanitized
+		return sanitized, suspected
 	}
 
 	// Plain text — return as-is.
-	return body
+	return body, suspected
+}
+
+// maxBinaryPreviewBytes caps BINARY_PREVIEW_BYTES: enough for any file
+// signature while keeping the marker a handful of lines.
+const maxBinaryPreviewBytes = 256
+
+// binaryMarker summarises a binary body as "[binary: N bytes]", or
+// "[binary: <media type>, N bytes]" when detectFileType recognises its
+// signature. With previewBytes > 0 it appends a hexdump -C style dump of the first
+// previewBytes bytes (at most maxBinaryPreviewBytes), one newline-separated
+// line per 16 bytes, so magic bytes can be read from the log:
+//
+//	[binary: image/png, 2048 bytes, preview: 00000000  89 50 4e 47 0d 0a 1a 0a  00 00 00 0d 49 48 44 52  |.PNG........IHDR|]
+func binaryMarker(body string, previewBytes int) string {
+	size := fmt.Sprintf("%d bytes", len(body))
+	if mt := detectFileType([]byte(body[:min(len(body), 512)])); mt != "" {
+		size = mt + ", " + size
+	}
+	n := min(previewBytes, maxBinaryPreviewBytes, len(body))
+	if n <= 0 {
+		return "[binary: " + size + "]"
+	}
+	dump := strings.TrimSuffix(hex.Dump([]byte(body[:n])), "\n")
+	return fmt.Sprintf("[binary: %s, preview: %s]", size, dump)
+}
+
+// truncateLogBody cuts body to at most limit bytes, backing off to the start
+// of a UTF-8 sequence so the log line stays valid, and appends a marker with
+// the full length. limit <= 0, or a body that already fits, returns body
+// unchanged; binary and multipart summaries are short enough never to hit a
+// practical limit.
+func truncateLogBody(body string, limit int) string {
+	if limit <= 0 || len(body) <= limit {
+		return body
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	return body[:cut] + fmt.Sprintf("…[truncated, %d total bytes]", len(body))
+}
+
+// sniffBodyType returns the media type http.DetectContentType infers from the
+// first 512 bytes of body, without parameters (e.g. "text/html", "image/png").
+// JSON is reported as "text/plain" — DetectContentType has no JSON signature.
+func sniffBodyType(body string) string {
+	n := min(len(body), 512)
+	mt, _, _ := strings.Cut(http.DetectContentType([]byte(body[:n])), ";")
+	return strings.TrimSpace(mt)
 }
 
 // isTokenKey returns true when a JSON key name indicates a security token
@@ -364,6 +740,98 @@ func redactTokenBody(body string) string {
 	return string(out)
 }
 
+// secretPatterns match well-known credential formats that should raise the
+// secret_suspected flag. They are deliberately narrow — a false positive only
+// costs an alert, but a noisy flag quickly gets ignored.
+var secretPatterns = []*regexp.Regexp{
+	// PEM-encoded private keys: RSA, EC, DSA, OPENSSH, ENCRYPTED, PKCS#8.
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`),
+	// JWT: three base64url segments, header always starts with {" → "eyJ".
+	regexp.MustCompile(`eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}`),
+	// AWS access key ID.
+	regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`),
+	// GitHub personal access / OAuth / app tokens.
+	regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`),
+	// Slack tokens.
+	regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}`),
+}
+
+// secretCandidate matches long runs of token-alphabet characters that are
+// checked for high Shannon entropy by detectSecrets.
+var secretCandidate = regexp.MustCompile(`[A-Za-z0-9+/_=-]{32,}`)
+
+// highEntropyThreshold is the Shannon entropy (bits per character) above which
+// a secretCandidate run is treated as a random key rather than an identifier.
+// A random 32-char base64 key scores >= 4.0; UUIDs and hyphenated identifiers
+// such as "application-json-content-type" score below 3.8.
+const highEntropyThreshold = 4.0
+
+// detectSecrets reports whether body likely contains a credential: a PEM
+// private key, a JWT, a well-known vendor key format, or a high-entropy token.
+// It only flags — it never modifies the body. Redaction markers produced by
+// sanitizeBody (e.g. "[redacted: base64 payload ...]") never match.
+func detectSecrets(body string) bool {
+	if body == "" {
+		return false
+	}
+	for _, re := range secretPatterns {
+		if re.MatchString(body) {
+			return true
+		}
+	}
+	for _, candidate := range secretCandidate.FindAllString(body, 64) {
+		// Very long runs are Base64 file payloads, not keys — those are handled
+		// by the Base64 redaction in sanitizeJSONBody.
+		if len(candidate) >= largeStringThreshold {
+			continue
+		}
+		// Keys mix letters and digits; pure-letter runs are usually words.
+		if !strings.ContainsAny(candidate, "0123456789") {
+			continue
+		}
+		if shannonEntropy(candidate) >= highEntropyThreshold {
+			return true
+		}
+	}
+	return false
+}
+
+// shannonEntropy returns the Shannon entropy of s in bits per byte.
+func shannonEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	n := float64(len(s))
+	var h float64
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / n
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+// humanSize formats a byte count with binary (1024) units and one decimal
+// place, e.g. 512 → "512 B", 1536 → "1.5 KB", 1258291 → "1.2 MB".
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTP"[exp])
+}
+
 func minInt(a, b int) int {
 	if a < b {
 		return a
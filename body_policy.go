@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// Body logging policy actions (BODY_LOG_POLICY).
+const (
+	bodyPolicyFull = "full" // inline, through sanitizeBody as without a policy
+	bodyPolicyMeta = "meta" // "[<media type>, N bytes]" only
+	bodyPolicyDrop = "drop" // no body; *_body_bytes is still logged
+)
+
+// parseBodyLogPolicy parses BODY_LOG_POLICY, a comma-separated list of
+// media-range:action pairs such as
+//
+//	text/*:full,application/json:full,image/*:meta,*/*:meta
+//
+// Media ranges are "type/subtype", "type/*", or "*/*" and are matched
+// case-insensitively; actions are full, meta, or drop. The first invalid pair
+// is reported and the valid ones parsed so far are returned. An empty string
+// returns a nil policy, which keeps the built-in handling for every body.
+func parseBodyLogPolicy(raw string) (map[string]string, error) {
+	var policy map[string]string
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		rng, action, ok := strings.Cut(pair, ":")
+		rng = strings.ToLower(strings.TrimSpace(rng))
+		action = strings.ToLower(strings.TrimSpace(action))
+		typ, sub, slash := strings.Cut(rng, "/")
+		if !ok || !slash || typ == "" || sub == "" || (typ == "*" && sub != "*") {
+			return policy, fmt.Errorf("bad media range in %q (want type/subtype, type/*, or */*)", pair)
+		}
+		switch action {
+		case bodyPolicyFull, bodyPolicyMeta, bodyPolicyDrop:
+		default:
+			return policy, fmt.Errorf("bad action in %q (want full, meta, or drop)", pair)
+		}
+		if policy == nil {
+			policy = make(map[string]string)
+		}
+		policy[rng] = action
+	}
+	return policy, nil
+}
+
+// bodyPolicyAction resolves the action for a body of mediaType (a
+// Content-Type value; parameters are ignored). The most specific range wins:
+// the exact type, then "type/*", then "*/*". An empty policy, or a type no
+// range covers, yields "full" — the built-in handling.
+func bodyPolicyAction(mediaType string, policy map[string]string) string {
+	if len(policy) == 0 {
+		return bodyPolicyFull
+	}
+	mt := bodyMediaType(mediaType)
+	typ, _, _ := strings.Cut(mt, "/")
+	for _, rng := range []string{mt, typ + "/*", "*/*"} {
+		if action, ok := policy[rng]; ok {
+			return action
+		}
+	}
+	return bodyPolicyFull
+}
+
+// bodyMediaType returns the lowercase media type of a Content-Type value
+// without parameters, or "" when it is empty or unparseable.
+func bodyMediaType(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+// bodyPolicyMetadata is the body logged under the meta action, e.g.
+// "[image/png, 5120 bytes]". A body without a known type is reported as
+// application/octet-stream.
+func bodyPolicyMetadata(mediaType string, size int64) string {
+	mt := bodyMediaType(mediaType)
+	if mt == "" {
+		mt = "application/octet-stream"
+	}
+	return fmt.Sprintf("[%s, %d bytes]", mt, size)
+}
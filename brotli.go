@@ -0,0 +1,1058 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+)
+
+// decodeBrotli undoes a Content-Encoding: br (RFC 7932) body, producing at
+// most maxSize bytes; larger output fails with errDecompressedTooLarge. Only
+// the standard library is used: the RFC's static dictionary is embedded from
+// brotli_dictionary.bin (Appendix A) and the transforms are listed below
+// (Appendix B).
+//
+// The whole body is already in memory, so the decoder works on a byte slice
+// and appends to a growing output slice, which doubles as the sliding window.
+// It favours clarity over speed: prefix codes are decoded a bit at a time.
+func decodeBrotli(data []byte, maxSize int64) ([]byte, error) {
+	if len(brotliDictionary) != brotliDictionarySize {
+		return nil, errors.New("brotli: static dictionary missing")
+	}
+	d := &brotliDecoder{br: brotliBits{src: data}, maxSize: maxSize,
+		dists: [4]int{4, 11, 15, 16}}
+	if err := d.decode(); err != nil {
+		return nil, err
+	}
+	return d.out, nil
+}
+
+var errBrotliCorrupt = errors.New("brotli: corrupt stream")
+
+//go:embed brotli_dictionary.bin
+var brotliDictionary []byte
+
+const brotliDictionarySize = 122784
+
+// brotliDictBits is NDBITS, the number of word-index bits for each word
+// length (RFC 7932 §8); words of lengths outside 4–24 do not exist.
+var brotliDictBits = [25]uint{0, 0, 0, 0, 10, 10, 11, 11, 10, 10, 10, 10, 10, 9, 9, 8, 7, 7, 8, 7, 7, 6, 6, 5, 5}
+
+// brotliDictOffset is DOFFSET: where the words of each length start.
+var brotliDictOffset = func() (off [25]int) {
+	for l := 4; l < 24; l++ {
+		off[l+1] = off[l] + l<<brotliDictBits[l]
+	}
+	return off
+}()
+
+// brotliBits reads the stream least significant bit first.
+type brotliBits struct {
+	src []byte
+	pos int    // next byte of src to load
+	val uint64 // loaded bits, next bit lowest
+	n   uint   // number of bits in val
+}
+
+func (b *brotliBits) fill() {
+	for b.n <= 56 && b.pos < len(b.src) {
+		b.val |= uint64(b.src[b.pos]) << b.n
+		b.pos++
+		b.n += 8
+	}
+}
+
+// read returns the next n (≤ 32) bits.
+func (b *brotliBits) read(n uint) (int, error) {
+	if b.n < n {
+		b.fill()
+		if b.n < n {
+			return 0, errBrotliCorrupt
+		}
+	}
+	v := int(b.val & (1<<n - 1))
+	b.val >>= n
+	b.n -= n
+	return v, nil
+}
+
+// peek returns up to the next n bits without consuming them; missing bits at
+// the end of the stream read as zero.
+func (b *brotliBits) peek(n uint) int {
+	if b.n < n {
+		b.fill()
+	}
+	return int(b.val & (1<<n - 1))
+}
+
+// align skips to the next byte boundary; the skipped padding must be zero.
+func (b *brotliBits) align() error {
+	if v, _ := b.read(b.n % 8); v != 0 {
+		return errBrotliCorrupt
+	}
+	return nil
+}
+
+// bytes returns the next n whole bytes; the reader must be aligned.
+func (b *brotliBits) bytes(n int) ([]byte, error) {
+	out := make([]byte, 0, n)
+	for ; n > 0 && b.n >= 8; n-- {
+		v, _ := b.read(8)
+		out = append(out, byte(v))
+	}
+	if n > len(b.src)-b.pos {
+		return nil, errBrotliCorrupt
+	}
+	out = append(out, b.src[b.pos:b.pos+n]...)
+	b.pos += n
+	return out, nil
+}
+
+// atEnd reports whether only zero padding of the current byte is left.
+func (b *brotliBits) atEnd() bool {
+	return b.n < 8 && b.val == 0 && b.pos == len(b.src)
+}
+
+// brotliCode is a canonical prefix code. Codes are packed most significant
+// bit first, so decoding walks the code lengths one bit at a time.
+type brotliCode struct {
+	counts  [16]int // number of codes of each length
+	symbols []int   // symbols ordered by code length, then value
+}
+
+func newBrotliCode(lengths []int) *brotliCode {
+	c := &brotliCode{}
+	for _, l := range lengths {
+		c.counts[l]++
+	}
+	c.counts[0] = 0
+	for l := 1; l < 16; l++ {
+		for sym, sl := range lengths {
+			if sl == l {
+				c.symbols = append(c.symbols, sym)
+			}
+		}
+	}
+	return c
+}
+
+func (c *brotliCode) decode(b *brotliBits) (int, error) {
+	if len(c.symbols) == 1 {
+		return c.symbols[0], nil // a lone symbol takes no bits
+	}
+	code, first, index := 0, 0, 0
+	for l := 1; l < 16; l++ {
+		bit, err := b.read(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= bit
+		count := c.counts[l]
+		if code-first < count {
+			return c.symbols[index+code-first], nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errBrotliCorrupt
+}
+
+// brotliCodeLengthOrder is the order in which complex prefix codes list the
+// code lengths of the code length alphabet (RFC 7932 §3.5).
+var brotliCodeLengthOrder = [18]int{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// readCode reads a simple or complex prefix code over alphabetSize symbols
+// (RFC 7932 §3.4–3.5).
+func (b *brotliBits) readCode(alphabetSize int) (*brotliCode, error) {
+	lengths := make([]int, alphabetSize)
+	hskip, err := b.read(2)
+	if err != nil {
+		return nil, err
+	}
+	if hskip == 1 {
+		nsym, err := b.read(2)
+		if err != nil {
+			return nil, err
+		}
+		nsym++
+		width := uint(0)
+		for (alphabetSize-1)>>width != 0 {
+			width++
+		}
+		syms := make([]int, nsym)
+		for i := range syms {
+			if syms[i], err = b.read(width); err != nil {
+				return nil, err
+			}
+			if syms[i] >= alphabetSize {
+				return nil, errBrotliCorrupt
+			}
+			for _, prev := range syms[:i] {
+				if prev == syms[i] {
+					return nil, errBrotliCorrupt
+				}
+			}
+		}
+		shape := [][]int{nil, {0}, {1, 1}, {1, 2, 2}, {2, 2, 2, 2}}[nsym]
+		if nsym == 4 {
+			if sel, err := b.read(1); err != nil {
+				return nil, err
+			} else if sel == 1 {
+				shape = []int{1, 2, 3, 3}
+			}
+		}
+		if nsym == 1 {
+			return &brotliCode{symbols: syms}, nil
+		}
+		for i, sym := range syms {
+			lengths[sym] = shape[i]
+		}
+		return newBrotliCode(lengths), nil
+	}
+
+	// Complex code: first the code lengths of the code length alphabet,
+	// each in a fixed variable-length code.
+	var clLengths [18]int
+	space, nonzero := 32, 0
+	for i := hskip; i < 18 && space > 0; i++ {
+		// Fixed code for the lengths 0–5, indexed by the next 4 bits.
+		v := b.peek(4)
+		size := [16]uint{2, 2, 2, 3, 2, 2, 2, 4, 2, 2, 2, 3, 2, 2, 2, 4}[v]
+		l := [16]int{0, 4, 3, 2, 0, 4, 3, 1, 0, 4, 3, 2, 0, 4, 3, 5}[v]
+		if _, err := b.read(size); err != nil {
+			return nil, err
+		}
+		clLengths[brotliCodeLengthOrder[i]] = l
+		if l != 0 {
+			space -= 32 >> l
+			nonzero++
+		}
+	}
+	if nonzero != 1 && space != 0 {
+		return nil, errBrotliCorrupt
+	}
+	var clCode *brotliCode
+	if nonzero == 1 {
+		for sym, l := range clLengths {
+			if l != 0 {
+				clCode = &brotliCode{symbols: []int{sym}}
+			}
+		}
+	} else {
+		clCode = newBrotliCode(clLengths[:])
+	}
+
+	// Then the symbol code lengths, with 16 repeating the previous non-zero
+	// length and 17 repeating zero; consecutive repeat codes extend the run.
+	prevLen, repeat, repeatLen := 8, 0, 0
+	space = 1 << 15
+	for sym := 0; sym < alphabetSize && space > 0; {
+		c, err := clCode.decode(b)
+		if err != nil {
+			return nil, err
+		}
+		if c < 16 {
+			repeat = 0
+			lengths[sym] = c
+			sym++
+			if c != 0 {
+				prevLen = c
+				space -= 1 << 15 >> c
+			}
+			continue
+		}
+		extra, newLen := uint(2), prevLen
+		if c == 17 {
+			extra, newLen = 3, 0
+		}
+		if repeatLen != newLen {
+			repeat, repeatLen = 0, newLen
+		}
+		old := repeat
+		if repeat > 0 {
+			repeat = (repeat - 2) << extra
+		}
+		v, err := b.read(extra)
+		if err != nil {
+			return nil, err
+		}
+		repeat += v + 3
+		delta := repeat - old
+		if sym+delta > alphabetSize {
+			return nil, errBrotliCorrupt
+		}
+		for ; delta > 0; delta-- {
+			lengths[sym] = repeatLen
+			sym++
+			if repeatLen != 0 {
+				space -= 1 << 15 >> repeatLen
+			}
+		}
+	}
+	if space != 0 {
+		return nil, errBrotliCorrupt
+	}
+	return newBrotliCode(lengths), nil
+}
+
+// readCount reads the 1–256 values of NBLTYPES and NTREES.
+func (b *brotliBits) readCount() (int, error) {
+	if bit, err := b.read(1); err != nil || bit == 0 {
+		return 1, err
+	}
+	n, err := b.read(3)
+	if err != nil {
+		return 0, err
+	}
+	v, err := b.read(uint(n))
+	return 1<<n + v + 1, err
+}
+
+// readContextMap reads a context map of size entries over ntrees trees
+// (RFC 7932 §7.3).
+func (b *brotliBits) readContextMap(size, ntrees int) ([]int, error) {
+	m := make([]int, size)
+	if ntrees < 2 {
+		return m, nil
+	}
+	rleMax := 0
+	if bit, err := b.read(1); err != nil {
+		return nil, err
+	} else if bit == 1 {
+		v, err := b.read(4)
+		if err != nil {
+			return nil, err
+		}
+		rleMax = v + 1
+	}
+	code, err := b.readCode(ntrees + rleMax)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < size; {
+		c, err := code.decode(b)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case c == 0:
+			i++
+		case c <= rleMax:
+			v, err := b.read(uint(c))
+			if err != nil {
+				return nil, err
+			}
+			if i += 1<<c + v; i > size {
+				return nil, errBrotliCorrupt
+			}
+		default:
+			m[i] = c - rleMax
+			i++
+		}
+	}
+	if imtf, err := b.read(1); err != nil {
+		return nil, err
+	} else if imtf == 1 {
+		var mtf [256]int
+		for i := range mtf {
+			mtf[i] = i
+		}
+		for i, idx := range m {
+			v := mtf[idx]
+			m[i] = v
+			copy(mtf[1:idx+1], mtf[:idx])
+			mtf[0] = v
+		}
+	}
+	return m, nil
+}
+
+// brotliBlocks tracks the block switches of one category (literals,
+// insert-and-copy commands, or distances) within a meta-block.
+type brotliBlocks struct {
+	n            int // NBLTYPES
+	types, count *brotliCode
+	typ, prev    int // current and second-to-last block type
+	left         int // symbols left in the current block
+}
+
+// brotliBlockLength holds the base and extra bits of the 26 block count
+// symbols (RFC 7932 §6).
+var brotliBlockLength = [26][2]int{
+	{1, 2}, {5, 2}, {9, 2}, {13, 2}, {17, 3}, {25, 3}, {33, 3}, {41, 3},
+	{49, 4}, {65, 4}, {81, 4}, {97, 4}, {113, 5}, {145, 5}, {177, 5}, {209, 5},
+	{241, 6}, {305, 6}, {369, 7}, {497, 8}, {753, 9}, {1265, 10}, {2289, 11}, {4337, 12},
+	{8433, 13}, {16625, 24},
+}
+
+func (b *brotliBits) readBlocks() (*brotliBlocks, error) {
+	n, err := b.readCount()
+	if err != nil {
+		return nil, err
+	}
+	bl := &brotliBlocks{n: n, prev: 1, left: 1 << 30}
+	if n < 2 {
+		return bl, nil
+	}
+	if bl.types, err = b.readCode(n + 2); err != nil {
+		return nil, err
+	}
+	if bl.count, err = b.readCode(26); err != nil {
+		return nil, err
+	}
+	bl.left, err = bl.readLength(b)
+	return bl, err
+}
+
+func (bl *brotliBlocks) readLength(b *brotliBits) (int, error) {
+	sym, err := bl.count.decode(b)
+	if err != nil {
+		return 0, err
+	}
+	v, err := b.read(uint(brotliBlockLength[sym][1]))
+	return brotliBlockLength[sym][0] + v, err
+}
+
+// next is called before each symbol of the category; it switches to the
+// next block when the current one is used up.
+func (bl *brotliBlocks) next(b *brotliBits) error {
+	if bl.left == 0 {
+		sym, err := bl.types.decode(b)
+		if err != nil {
+			return err
+		}
+		t := sym - 2
+		switch sym {
+		case 0:
+			t = bl.prev
+		case 1:
+			t = bl.typ + 1
+		}
+		if t >= bl.n {
+			t -= bl.n
+		}
+		bl.prev, bl.typ = bl.typ, t
+		if bl.left, err = bl.readLength(b); err != nil {
+			return err
+		}
+	}
+	bl.left--
+	return nil
+}
+
+// Insert and copy length codes: base and extra bits (RFC 7932 §5).
+var (
+	brotliInsertLength = [24][2]int{
+		{0, 0}, {1, 0}, {2, 0}, {3, 0}, {4, 0}, {5, 0}, {6, 1}, {8, 1},
+		{10, 2}, {14, 2}, {18, 3}, {26, 3}, {34, 4}, {50, 4}, {66, 5}, {98, 5},
+		{130, 6}, {194, 7}, {322, 8}, {578, 9}, {1090, 10}, {2114, 12}, {6210, 14}, {22594, 24},
+	}
+	brotliCopyLength = [24][2]int{
+		{2, 0}, {3, 0}, {4, 0}, {5, 0}, {6, 0}, {7, 0}, {8, 0}, {9, 0},
+		{10, 1}, {12, 1}, {14, 2}, {18, 2}, {22, 3}, {30, 3}, {38, 4}, {54, 4},
+		{70, 5}, {102, 5}, {134, 6}, {198, 7}, {326, 8}, {582, 9}, {1094, 10}, {2118, 24},
+	}
+	// brotliCommandCells maps the top bits of an insert-and-copy symbol to
+	// the first insert and copy length codes of its cell.
+	brotliCommandCells = [11][2]int{
+		{0, 0}, {0, 8}, {0, 0}, {0, 8}, {8, 0}, {8, 8}, {0, 16}, {16, 0}, {8, 16}, {16, 8}, {16, 16},
+	}
+)
+
+// Short distance codes 0–15 refer to one of the last four distances
+// (0 = most recent) plus a small offset.
+var (
+	brotliShortIndex  = [16]int{0, 1, 2, 3, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 1, 1}
+	brotliShortOffset = [16]int{0, 0, 0, 0, -1, 1, -2, 2, -3, 3, -1, 1, -2, 2, -3, 3}
+)
+
+type brotliDecoder struct {
+	br      brotliBits
+	out     []byte
+	maxSize int64
+	window  int    // maximum backward distance
+	dists   [4]int // last distances, most recent first
+}
+
+func (d *brotliDecoder) decode() error {
+	if err := d.readWindow(); err != nil {
+		return err
+	}
+	for {
+		last, err := d.metaBlock()
+		if err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+	}
+	if err := d.br.align(); err != nil || !d.br.atEnd() {
+		return errBrotliCorrupt
+	}
+	return nil
+}
+
+// readWindow reads WBITS from the stream header.
+func (d *brotliDecoder) readWindow() error {
+	b := &d.br
+	wbits := 16
+	if bit, err := b.read(1); err != nil {
+		return err
+	} else if bit == 1 {
+		n, err := b.read(3)
+		if err != nil {
+			return err
+		}
+		if n != 0 {
+			wbits = 17 + n
+		} else {
+			m, err := b.read(3)
+			if err != nil {
+				return err
+			}
+			switch m {
+			case 0:
+				wbits = 17
+			case 1:
+				return errors.New("brotli: large window streams are not supported")
+			default:
+				wbits = 8 + m
+			}
+		}
+	}
+	d.window = 1<<wbits - 16
+	return nil
+}
+
+// metaBlock decodes one meta-block and reports whether it was the last.
+func (d *brotliDecoder) metaBlock() (bool, error) {
+	b := &d.br
+	last, err := b.read(1)
+	if err != nil {
+		return false, err
+	}
+	if last == 1 {
+		if empty, err := b.read(1); err != nil || empty == 1 {
+			return true, err
+		}
+	}
+	nibbles, err := b.read(2)
+	if err != nil {
+		return false, err
+	}
+	if nibbles == 3 {
+		// Metadata block: skipped.
+		reserved, err := b.read(1)
+		if err != nil || reserved != 0 {
+			return false, errBrotliCorrupt
+		}
+		skipBytes, err := b.read(2)
+		if err != nil {
+			return false, err
+		}
+		skip := 0
+		if skipBytes > 0 {
+			v, err := b.read(uint(8 * skipBytes))
+			if err != nil {
+				return false, err
+			}
+			skip = v + 1
+		}
+		if err := b.align(); err != nil {
+			return false, err
+		}
+		if _, err := b.bytes(skip); err != nil {
+			return false, err
+		}
+		return last == 1, nil
+	}
+	mlen, err := b.read(uint(4 * (nibbles + 4)))
+	if err != nil {
+		return false, err
+	}
+	mlen++
+	if int64(len(d.out)+mlen) > d.maxSize {
+		return false, errDecompressedTooLarge
+	}
+	if last == 0 {
+		uncompressed, err := b.read(1)
+		if err != nil {
+			return false, err
+		}
+		if uncompressed == 1 {
+			if err := b.align(); err != nil {
+				return false, err
+			}
+			data, err := b.bytes(mlen)
+			if err != nil {
+				return false, err
+			}
+			d.out = append(d.out, data...)
+			return false, nil
+		}
+	}
+	return last == 1, d.compressed(mlen)
+}
+
+// compressed decodes the header and commands of a compressed meta-block
+// producing mlen bytes (RFC 7932 §9.2–9.3).
+func (d *brotliDecoder) compressed(mlen int) error {
+	b := &d.br
+	var blocks [3]*brotliBlocks // literals, commands, distances
+	for i := range blocks {
+		var err error
+		if blocks[i], err = b.readBlocks(); err != nil {
+			return err
+		}
+	}
+	lit, cmd, dist := blocks[0], blocks[1], blocks[2]
+	npostfix, err := b.read(2)
+	if err != nil {
+		return err
+	}
+	ndirect, err := b.read(4)
+	if err != nil {
+		return err
+	}
+	ndirect <<= npostfix
+	modes := make([]int, lit.n)
+	for i := range modes {
+		if modes[i], err = b.read(2); err != nil {
+			return err
+		}
+	}
+	ntreesL, err := b.readCount()
+	if err != nil {
+		return err
+	}
+	cmapL, err := b.readContextMap(64*lit.n, ntreesL)
+	if err != nil {
+		return err
+	}
+	ntreesD, err := b.readCount()
+	if err != nil {
+		return err
+	}
+	cmapD, err := b.readContextMap(4*dist.n, ntreesD)
+	if err != nil {
+		return err
+	}
+	readCodes := func(n, alphabetSize int) ([]*brotliCode, error) {
+		codes := make([]*brotliCode, n)
+		for i := range codes {
+			var err error
+			if codes[i], err = b.readCode(alphabetSize); err != nil {
+				return nil, err
+			}
+		}
+		return codes, nil
+	}
+	litCodes, err := readCodes(ntreesL, 256)
+	if err != nil {
+		return err
+	}
+	cmdCodes, err := readCodes(cmd.n, 704)
+	if err != nil {
+		return err
+	}
+	distCodes, err := readCodes(ntreesD, 16+ndirect+48<<npostfix)
+	if err != nil {
+		return err
+	}
+
+	end := len(d.out) + mlen
+	for len(d.out) < end {
+		if err := cmd.next(b); err != nil {
+			return err
+		}
+		sym, err := cmdCodes[cmd.typ].decode(b)
+		if err != nil {
+			return err
+		}
+		cell := brotliCommandCells[sym>>6]
+		insCode, copyCode := cell[0]+(sym>>3)&7, cell[1]+sym&7
+		insExtra, err := b.read(uint(brotliInsertLength[insCode][1]))
+		if err != nil {
+			return err
+		}
+		copyExtra, err := b.read(uint(brotliCopyLength[copyCode][1]))
+		if err != nil {
+			return err
+		}
+		insertLen := brotliInsertLength[insCode][0] + insExtra
+		copyLen := brotliCopyLength[copyCode][0] + copyExtra
+
+		if len(d.out)+insertLen > end {
+			return errBrotliCorrupt
+		}
+		for ; insertLen > 0; insertLen-- {
+			if err := lit.next(b); err != nil {
+				return err
+			}
+			tree := cmapL[64*lit.typ+d.literalContext(modes[lit.typ])]
+			c, err := litCodes[tree].decode(b)
+			if err != nil {
+				return err
+			}
+			d.out = append(d.out, byte(c))
+		}
+		if len(d.out) == end {
+			break // the last command of a meta-block may have no copy
+		}
+
+		dcode := 0 // symbols below 128 reuse the last distance
+		if sym >= 128 {
+			if err := dist.next(b); err != nil {
+				return err
+			}
+			tree := cmapD[4*dist.typ+min(copyLen-2, 3)]
+			if dcode, err = distCodes[tree].decode(b); err != nil {
+				return err
+			}
+		}
+		distance, err := d.distance(dcode, npostfix, ndirect)
+		if err != nil {
+			return err
+		}
+
+		if maxDist := min(len(d.out), d.window); distance > maxDist {
+			word, err := brotliDictionaryWord(copyLen, distance-maxDist-1)
+			if err != nil {
+				return err
+			}
+			if len(d.out)+len(word) > end {
+				return errBrotliCorrupt
+			}
+			d.out = append(d.out, word...)
+			continue
+		}
+		if dcode != 0 {
+			d.dists = [4]int{distance, d.dists[0], d.dists[1], d.dists[2]}
+		}
+		if len(d.out)+copyLen > end {
+			return errBrotliCorrupt
+		}
+		for ; copyLen > 0; copyLen-- {
+			d.out = append(d.out, d.out[len(d.out)-distance])
+		}
+	}
+	return nil
+}
+
+// literalContext is the context ID of the next literal from the previous
+// two output bytes (RFC 7932 §7.1).
+func (d *brotliDecoder) literalContext(mode int) int {
+	var p1, p2 byte
+	if n := len(d.out); n > 1 {
+		p1, p2 = d.out[n-1], d.out[n-2]
+	} else if n == 1 {
+		p1 = d.out[0]
+	}
+	switch mode {
+	case 0: // LSB6
+		return int(p1 & 0x3f)
+	case 1: // MSB6
+		return int(p1 >> 2)
+	case 2: // UTF8
+		return int(brotliLUT0[p1] | brotliLUT1[p2])
+	default: // Signed
+		return int(brotliLUT2[p1]<<3 | brotliLUT2[p2])
+	}
+}
+
+// distance turns a distance code into a backward distance (RFC 7932 §4).
+func (d *brotliDecoder) distance(dcode, npostfix, ndirect int) (int, error) {
+	if dcode < 16 {
+		distance := d.dists[brotliShortIndex[dcode]] + brotliShortOffset[dcode]
+		if distance <= 0 {
+			return 0, errBrotliCorrupt
+		}
+		return distance, nil
+	}
+	if dcode < 16+ndirect {
+		return dcode - 15, nil
+	}
+	c := dcode - ndirect - 16
+	bits := uint(1 + c>>(npostfix+1))
+	offset := (2+(c>>npostfix)&1)<<bits - 4
+	extra, err := d.br.read(bits)
+	if err != nil {
+		return 0, err
+	}
+	return (offset+extra)<<npostfix + c&(1<<npostfix-1) + ndirect + 1, nil
+}
+
+// brotliDictionaryWord returns static dictionary word id of the given
+// length with its transform applied (RFC 7932 §8).
+func brotliDictionaryWord(length, id int) ([]byte, error) {
+	if length < 4 || length > 24 {
+		return nil, errBrotliCorrupt
+	}
+	bits := brotliDictBits[length]
+	index, transform := id&(1<<bits-1), id>>bits
+	if transform >= len(brotliTransforms) {
+		return nil, errBrotliCorrupt
+	}
+	start := brotliDictOffset[length] + index*length
+	word := brotliDictionary[start : start+length]
+	t := brotliTransforms[transform]
+
+	out := append([]byte(nil), t.prefix...)
+	switch {
+	case t.kind >= brOmitFirst1:
+		word = word[min(int(t.kind-brOmitFirst1)+1, len(word)):]
+	case t.kind >= brOmitLast1 && t.kind <= brOmitLast9:
+		word = word[:len(word)-min(int(t.kind-brOmitLast1)+1, len(word))]
+	}
+	n := len(out)
+	out = append(out, word...)
+	switch t.kind {
+	case brUppercaseFirst:
+		brotliUppercase(out[n:])
+	case brUppercaseAll:
+		for w := out[n:]; len(w) > 0; {
+			w = w[brotliUppercase(w):]
+		}
+	}
+	return append(out, t.suffix...), nil
+}
+
+// brotliUppercase uppercases the first UTF-8 character of p the way the RFC
+// does it and returns its length.
+func brotliUppercase(p []byte) int {
+	switch {
+	case p[0] < 0xc0:
+		if p[0] >= 'a' && p[0] <= 'z' {
+			p[0] ^= 32
+		}
+		return 1
+	case p[0] < 0xe0:
+		if len(p) < 2 {
+			return len(p)
+		}
+		p[1] ^= 32
+		return 2
+	default:
+		if len(p) < 3 {
+			return len(p)
+		}
+		p[2] ^= 5
+		return 3
+	}
+}
+
+type brotliTransformKind uint8
+
+const (
+	brIdentity brotliTransformKind = iota
+	brOmitLast1
+	brOmitLast2
+	brOmitLast3
+	brOmitLast4
+	brOmitLast5
+	brOmitLast6
+	brOmitLast7
+	brOmitLast8
+	brOmitLast9
+	brUppercaseFirst
+	brUppercaseAll
+	brOmitFirst1
+	brOmitFirst2
+	brOmitFirst3
+	brOmitFirst4
+	brOmitFirst5
+	brOmitFirst6
+	brOmitFirst7
+	brOmitFirst8
+	brOmitFirst9
+)
+
+// brotliTransforms is the list of word transforms (RFC 7932 Appendix B).
+var brotliTransforms = [121]struct {
+	prefix string
+	kind   brotliTransformKind
+	suffix string
+}{
+	{"", brIdentity, ""},
+	{"", brIdentity, " "},
+	{" ", brIdentity, " "},
+	{"", brOmitFirst1, ""},
+	{"", brUppercaseFirst, " "},
+	{"", brIdentity, " the "},
+	{" ", brIdentity, ""},
+	{"s ", brIdentity, " "},
+	{"", brIdentity, " of "},
+	{"", brUppercaseFirst, ""},
+	{"", brIdentity, " and "},
+	{"", brOmitFirst2, ""},
+	{"", brOmitLast1, ""},
+	{", ", brIdentity, " "},
+	{"", brIdentity, ", "},
+	{" ", brUppercaseFirst, " "},
+	{"", brIdentity, " in "},
+	{"", brIdentity, " to "},
+	{"e ", brIdentity, " "},
+	{"", brIdentity, "\""},
+	{"", brIdentity, "."},
+	{"", brIdentity, "\">"},
+	{"", brIdentity, "\n"},
+	{"", brOmitLast3, ""},
+	{"", brIdentity, "]"},
+	{"", brIdentity, " for "},
+	{"", brOmitFirst3, ""},
+	{"", brOmitLast2, ""},
+	{"", brIdentity, " a "},
+	{"", brIdentity, " that "},
+	{" ", brUppercaseFirst, ""},
+	{"", brIdentity, ". "},
+	{".", brIdentity, ""},
+	{" ", brIdentity, ", "},
+	{"", brOmitFirst4, ""},
+	{"", brIdentity, " with "},
+	{"", brIdentity, "'"},
+	{"", brIdentity, " from "},
+	{"", brIdentity, " by "},
+	{"", brOmitFirst5, ""},
+	{"", brOmitFirst6, ""},
+	{" the ", brIdentity, ""},
+	{"", brOmitLast4, ""},
+	{"", brIdentity, ". The "},
+	{"", brUppercaseAll, ""},
+	{"", brIdentity, " on "},
+	{"", brIdentity, " as "},
+	{"", brIdentity, " is "},
+	{"", brOmitLast7, ""},
+	{"", brOmitLast1, "ing "},
+	{"", brIdentity, "\n\t"},
+	{"", brIdentity, ":"},
+	{" ", brIdentity, ". "},
+	{"", brIdentity, "ed "},
+	{"", brOmitFirst9, ""},
+	{"", brOmitFirst7, ""},
+	{"", brOmitLast6, ""},
+	{"", brIdentity, "("},
+	{"", brUppercaseFirst, ", "},
+	{"", brOmitLast8, ""},
+	{"", brIdentity, " at "},
+	{"", brIdentity, "ly "},
+	{" the ", brIdentity, " of "},
+	{"", brOmitLast5, ""},
+	{"", brOmitLast9, ""},
+	{" ", brUppercaseFirst, ", "},
+	{"", brUppercaseFirst, "\""},
+	{".", brIdentity, "("},
+	{"", brUppercaseAll, " "},
+	{"", brUppercaseFirst, "\">"},
+	{"", brIdentity, "=\""},
+	{" ", brIdentity, "."},
+	{".com/", brIdentity, ""},
+	{" the ", brIdentity, " of the "},
+	{"", brUppercaseFirst, "'"},
+	{"", brIdentity, ". This "},
+	{"", brIdentity, ","},
+	{".", brIdentity, " "},
+	{"", brUppercaseFirst, "("},
+	{"", brUppercaseFirst, "."},
+	{"", brIdentity, " not "},
+	{" ", brIdentity, "=\""},
+	{"", brIdentity, "er "},
+	{" ", brUppercaseAll, " "},
+	{"", brIdentity, "al "},
+	{" ", brUppercaseAll, ""},
+	{"", brIdentity, "='"},
+	{"", brUppercaseAll, "\""},
+	{"", brUppercaseFirst, ". "},
+	{" ", brIdentity, "("},
+	{"", brIdentity, "ful "},
+	{" ", brUppercaseFirst, ". "},
+	{"", brIdentity, "ive "},
+	{"", brIdentity, "less "},
+	{"", brUppercaseAll, "'"},
+	{"", brIdentity, "est "},
+	{" ", brUppercaseFirst, "."},
+	{"", brUppercaseAll, "\">"},
+	{" ", brIdentity, "='"},
+	{"", brUppercaseFirst, ","},
+	{"", brIdentity, "ize "},
+	{"", brUppercaseAll, "."},
+	{"\u00a0", brIdentity, ""},
+	{" ", brIdentity, ","},
+	{"", brUppercaseFirst, "=\""},
+	{"", brUppercaseAll, "=\""},
+	{"", brIdentity, "ous "},
+	{"", brUppercaseAll, ", "},
+	{"", brUppercaseFirst, "='"},
+	{" ", brUppercaseFirst, ","},
+	{" ", brUppercaseAll, "=\""},
+	{" ", brUppercaseAll, ", "},
+	{"", brUppercaseAll, ","},
+	{"", brUppercaseAll, "("},
+	{"", brUppercaseAll, ". "},
+	{" ", brUppercaseAll, "."},
+	{"", brUppercaseAll, "='"},
+	{" ", brUppercaseAll, ". "},
+	{" ", brUppercaseFirst, "=\""},
+	{" ", brUppercaseAll, "='"},
+	{" ", brUppercaseFirst, "='"},
+}
+
+// Context lookup tables for the UTF8 and Signed literal context modes
+// (RFC 7932 §7.1).
+var brotliLUT0 = [256]byte{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 4, 0, 0, 4, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	8, 12, 16, 12, 12, 20, 12, 16, 24, 28, 12, 12, 32, 12, 36, 12,
+	44, 44, 44, 44, 44, 44, 44, 44, 44, 44, 32, 32, 24, 40, 28, 12,
+	12, 48, 52, 52, 52, 48, 52, 52, 52, 48, 52, 52, 52, 52, 52, 48,
+	52, 52, 52, 52, 52, 48, 52, 52, 52, 52, 52, 24, 12, 28, 12, 12,
+	12, 56, 60, 60, 60, 56, 60, 60, 60, 56, 60, 60, 60, 60, 60, 56,
+	60, 60, 60, 60, 60, 56, 60, 60, 60, 60, 60, 24, 12, 28, 12, 0,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+}
+
+var brotliLUT1 = [256]byte{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1,
+	1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1,
+	1, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 1, 1, 1, 1, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+}
+
+var brotliLUT2 = [256]byte{
+	0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5,
+	5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5,
+	5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5,
+	6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 7,
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"mime"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Charset transcoding for text bodies declared in something other than
+// UTF-8. Only the standard library is used, so the supported set is limited
+// to the single-byte Western encodings and UTF-16; anything else (Shift_JIS,
+// GB18030, …) is left as-is and goes through the usual text/binary logic.
+
+// cp1252High maps windows-1252 bytes 0x80–0x9F to runes. Undefined positions
+// map to the corresponding C1 control, as WHATWG does.
+var cp1252High = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8D, 'Ž', 0x8F,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9D, 'ž', 'Ÿ',
+}
+
+// iso885915 lists the positions where ISO-8859-15 differs from ISO-8859-1.
+var iso885915 = map[byte]rune{
+	0xA4: '€', 0xA6: 'Š', 0xA8: 'š', 0xB4: 'Ž', 0xB8: 'ž', 0xBC: 'Œ', 0xBD: 'œ', 0xBE: 'Ÿ',
+}
+
+// bodyCharset returns the lowercased charset parameter of a Content-Type
+// header, or "" when there is none.
+func bodyCharset(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(strings.TrimSpace(params["charset"]), `"`))
+}
+
+// transcodeToUTF8 converts body from the charset declared in contentType to
+// UTF-8. It returns the converted body and the original charset name, with
+// ok=false — and the caller keeps the raw body — when no charset is declared,
+// the charset is already UTF-8 or ASCII, it is not supported, or the body is
+// not valid in it.
+//
+// ISO-8859-1 and US-ASCII labels are decoded as windows-1252, matching what
+// browsers do (WHATWG Encoding Standard): servers that say latin1 usually mean
+// cp1252.
+func transcodeToUTF8(body, contentType string) (string, string, bool) {
+	charset := bodyCharset(contentType)
+	if body == "" || charset == "" {
+		return "", "", false
+	}
+	var out string
+	switch charset {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return "", "", false
+	case "iso-8859-1", "iso8859-1", "iso_8859-1", "latin1", "l1", "windows-1252", "cp1252", "x-cp1252":
+		out = decodeSingleByte(body, nil)
+	case "iso-8859-15", "iso8859-15", "iso_8859-15", "latin-9", "latin9":
+		out = decodeSingleByte(body, iso885915)
+	case "utf-16", "utf-16le", "utf-16be":
+		var ok bool
+		if out, ok = decodeUTF16(body, charset); !ok {
+			return "", "", false
+		}
+	default:
+		return "", "", false
+	}
+	return out, charset, true
+}
+
+// decodeSingleByte decodes a windows-1252 body, or an ISO-8859-15 body when
+// overrides is iso885915 (the C1 range is then left as control characters).
+func decodeSingleByte(body string, overrides map[byte]rune) string {
+	var b strings.Builder
+	b.Grow(len(body) + len(body)/4)
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch r, ok := overrides[c]; {
+		case ok:
+			b.WriteRune(r)
+		case c < 0x80:
+			b.WriteByte(c)
+		case c < 0xA0 && overrides == nil:
+			b.WriteRune(cp1252High[c-0x80])
+		default:
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String()
+}
+
+// decodeUTF16 decodes a UTF-16 body. A byte-order mark wins over the label;
+// plain "utf-16" without a BOM is big-endian (RFC 2781 §4.3). Odd lengths and
+// unpaired surrogates are rejected.
+func decodeUTF16(body, charset string) (string, bool) {
+	if len(body)%2 != 0 {
+		return "", false
+	}
+	bigEndian := charset != "utf-16le"
+	switch {
+	case strings.HasPrefix(body, "\xfe\xff"):
+		bigEndian, body = true, body[2:]
+	case strings.HasPrefix(body, "\xff\xfe"):
+		bigEndian, body = false, body[2:]
+	}
+	units := make([]uint16, len(body)/2)
+	for i := range units {
+		hi, lo := uint16(body[2*i]), uint16(body[2*i+1])
+		if !bigEndian {
+			hi, lo = lo, hi
+		}
+		units[i] = hi<<8 | lo
+	}
+	runes := utf16.Decode(units)
+	for _, r := range runes {
+		if r == utf8.RuneError {
+			return "", false
+		}
+	}
+	return string(runes), true
+}
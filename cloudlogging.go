@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Google Cloud Logging sink (LOG_SINK=gcp, or GCP_LOG_NAME set without an
+// explicit LOG_SINK). Entries are batched by a batchQueue and written with the
+// entries:write REST method; each entry becomes a LogEntry whose jsonPayload
+// is the entry itself, so the fields stay queryable in Logs Explorer. Only the
+// standard library is used: the access token and, if GCP_PROJECT_ID is unset,
+// the project ID come from the GCE/GKE/Cloud Run metadata server.
+
+const (
+	cloudLoggingWriteURL = "https://logging.googleapis.com/v2/entries:write"
+	gcpMetadataURL       = "http://metadata.google.internal/computeMetadata/v1/"
+)
+
+// cloudWriteRequest is the body of an entries:write call. logName, resource,
+// and labels apply to every entry in the batch.
+type cloudWriteRequest struct {
+	LogName  string            `json:"logName"`
+	Resource cloudResource     `json:"resource"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Entries  []cloudLogEntry   `json:"entries"`
+}
+
+// cloudResource is the MonitoredResource the entries are attributed to.
+type cloudResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// cloudLogEntry is one LogEntry. Timestamp is the entry's own timestamp
+// (RFC 3339 with offset), so Cloud Logging orders by when the request was seen.
+type cloudLogEntry struct {
+	Timestamp   string            `json:"timestamp,omitempty"`
+	Severity    string            `json:"severity"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	JSONPayload json.RawMessage   `json:"jsonPayload"`
+}
+
+// cloudLoggingClient delivers one entries:write request. The sink depends on
+// this interface rather than on HTTP directly so tests can substitute a mock.
+type cloudLoggingClient interface {
+	WriteEntries(req *cloudWriteRequest) error
+}
+
+// cloudLoggingSink is a logSink that ships entries to Cloud Logging.
+// Delivery failures are logged and the batch is counted in gcpDropped; the
+// sink never blocks or retries indefinitely.
+type cloudLoggingSink struct {
+	*batchQueue
+	client   cloudLoggingClient
+	logName  string // full "projects/<id>/logs/<name>"
+	resource cloudResource
+	labels   map[string]string
+}
+
+// newCloudLoggingSink builds a sink that writes through the REST API,
+// resolving the project ID from the metadata server when GCP_PROJECT_ID is
+// not set.
+func newCloudLoggingSink(cfg Config) (*cloudLoggingSink, error) {
+	tokens := &metadataTokenSource{client: &http.Client{Timeout: 5 * time.Second}}
+	project := cfg.GCPProjectID
+	if project == "" {
+		id, err := tokens.get("project/project-id")
+		if err != nil {
+			return nil, fmt.Errorf("GCP_PROJECT_ID not set and metadata lookup failed: %w", err)
+		}
+		project = strings.TrimSpace(id)
+	}
+	client := &restCloudLoggingClient{
+		url:    cloudLoggingWriteURL,
+		client: &http.Client{Timeout: 30 * time.Second},
+		tokens: tokens,
+	}
+	return newCloudLoggingSinkWithClient(cfg, project, client)
+}
+
+// newCloudLoggingSinkWithClient builds a sink for project that delivers
+// through client.
+func newCloudLoggingSinkWithClient(cfg Config, project string, client cloudLoggingClient) (*cloudLoggingSink, error) {
+	if cfg.GCPLogName == "" {
+		return nil, fmt.Errorf("LOG_SINK=gcp requires GCP_LOG_NAME")
+	}
+	if project == "" {
+		return nil, fmt.Errorf("LOG_SINK=gcp requires a project ID")
+	}
+	resourceType := cfg.GCPResourceType
+	if resourceType == "" {
+		resourceType = "global"
+	}
+	s := &cloudLoggingSink{
+		client:  client,
+		logName: "projects/" + project + "/logs/" + strings.ReplaceAll(cfg.GCPLogName, "/", "%2F"),
+		resource: cloudResource{
+			Type:   resourceType,
+			Labels: map[string]string{"project_id": project},
+		},
+		labels: cfg.GCPLabels,
+	}
+	s.batchQueue = newBatchQueue("gcp", cfg.GCPBatchSize, cfg.GCPBufferSize,
+		cfg.GCPFlushInterval, &gcpDropped, s.flush)
+	return s, nil
+}
+
+// flush converts a batch of serialized entries to LogEntries and writes them.
+func (s *cloudLoggingSink) flush(batch [][]byte) {
+	req := &cloudWriteRequest{
+		LogName:  s.logName,
+		Resource: s.resource,
+		Labels:   s.labels,
+		Entries:  make([]cloudLogEntry, 0, len(batch)),
+	}
+	for _, raw := range batch {
+		req.Entries = append(req.Entries, cloudEntry(raw))
+	}
+	if err := s.client.WriteEntries(req); err != nil {
+		gcpDropped.Add(int64(len(batch)))
+		slog.Error("gcp sink: entries:write failed", "entries", len(batch), "err", err)
+	}
+}
+
+// cloudEntry wraps one serialized log entry as a LogEntry, deriving the
+// severity from the entry and labelling it with its ICAP method.
+func cloudEntry(raw []byte) cloudLogEntry {
+	var probe struct {
+		Timestamp  string `json:"timestamp"`
+		ICAPMethod string `json:"icap_method"`
+		RespStatus string `json:"resp_status"`
+		Error      string `json:"error"`
+	}
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		// Not a JSON object — ship it as a message rather than drop it.
+		payload, _ := json.Marshal(map[string]string{"message": string(raw)})
+		return cloudLogEntry{Severity: "ERROR", JSONPayload: payload}
+	}
+	e := cloudLogEntry{
+		Severity:    cloudSeverity(probe.RespStatus, probe.Error),
+		JSONPayload: json.RawMessage(raw),
+	}
+	// With an epoch or custom TIMESTAMP_FORMAT the timestamp is left out and
+	// Cloud Logging uses the time it received the entry.
+	if _, err := time.Parse(time.RFC3339Nano, probe.Timestamp); err == nil {
+		e.Timestamp = probe.Timestamp
+	}
+	if probe.ICAPMethod != "" {
+		e.Labels = map[string]string{"icap_method": probe.ICAPMethod}
+	}
+	return e
+}
+
+// cloudSeverity maps an entry to a Cloud Logging severity: internal error
+// records and 5xx responses are ERROR, 4xx responses WARNING, the rest INFO.
+func cloudSeverity(respStatus, errMsg string) string {
+	if errMsg != "" {
+		return "ERROR"
+	}
+	code, _, _ := strings.Cut(respStatus, " ")
+	n, err := strconv.Atoi(code)
+	switch {
+	case err != nil:
+		return "INFO"
+	case n >= 500:
+		return "ERROR"
+	case n >= 400:
+		return "WARNING"
+	default:
+		return "INFO"
+	}
+}
+
+// restCloudLoggingClient calls entries:write with a bearer token from the
+// metadata server.
+type restCloudLoggingClient struct {
+	url    string
+	client *http.Client
+	tokens *metadataTokenSource
+}
+
+func (c *restCloudLoggingClient) WriteEntries(req *cloudWriteRequest) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	token, err := c.tokens.token()
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// metadataTokenSource fetches and caches the default service account's
+// access token from the metadata server.
+type metadataTokenSource struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	cached  string
+	expires time.Time
+}
+
+// token returns a cached access token, refreshing it a minute before expiry.
+func (m *metadataTokenSource) token() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cached != "" && time.Now().Before(m.expires) {
+		return m.cached, nil
+	}
+	body, err := m.get("instance/service-accounts/default/token")
+	if err != nil {
+		return "", err
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal([]byte(body), &tok); err != nil || tok.AccessToken == "" {
+		return "", fmt.Errorf("metadata token: unexpected response")
+	}
+	m.cached = tok.AccessToken
+	m.expires = time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second - time.Minute)
+	return m.cached, nil
+}
+
+// get reads one metadata path, e.g. "project/project-id".
+func (m *metadataTokenSource) get(path string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, gcpMetadataURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata %s: status %d", path, resp.StatusCode)
+	}
+	return string(body), nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log/slog"
 	"os"
 	"strconv"
 	"strings"
@@ -8,21 +9,140 @@ import (
 )
 
 // loadConfig builds a Config from environment variables with hardcoded defaults.
-// CLI flags --port=, --log=, and --log-rotate-size= take precedence over env vars.
+// CLI flags --port=, --log=, --log-rotate-size=, and --stdout take precedence
+// over env vars.
 func loadConfig() Config {
 	cfg := Config{
-		Port:             getEnv("ICAP_PORT", "11344"),
-		LogFile:          getEnv("LOG_FILE", "/var/log/icap/icap_logger.log"),
-		LogRotateSizeMB:  int64(getEnvInt("LOG_ROTATE_SIZE_MB", 25)),
-		MaxFileRetention: getEnvInt("LOG_FILE_RETENTION", 60),
-		MaxBodySize:      int64(getEnvInt("MAX_BODY_SIZE", 25*1024*1024)),
-		ReadTimeout:      time.Duration(getEnvInt("READ_TIMEOUT_SEC", 30)) * time.Second,
-		WriteTimeout:     time.Duration(getEnvInt("WRITE_TIMEOUT_SEC", 10)) * time.Second,
-		HealthPort:       getEnv("HEALTH_PORT", "8080"),
-		RedactAuthHeader: getEnvBool("REDACT_AUTH_HEADER", true),
-		RedactTokens:     getEnvBool("REDACT_TOKENS", true),
-		LogReqBody:       getEnvBool("LOG_REQ_BODY", false),
-		LogRespBody:      getEnvBool("LOG_RESP_BODY", false),
+		Port:                 getEnv("ICAP_PORT", "11344"),
+		TLSCert:              getEnv("TLS_CERT", ""),
+		TLSKey:               getEnv("TLS_KEY", ""),
+		TLSMinVersion:        getEnv("TLS_MIN_VERSION", "1.2"),
+		TLSClientCA:          getEnv("TLS_CLIENT_CA", ""),
+		LogFile:              getEnv("LOG_FILE", "/var/log/icap/icap_logger.log"),
+		LogSink:              getEnv("LOG_SINK", "file"),
+		LogFormat:            getEnv("LOG_FORMAT", "json"),
+		AccessLogFields:      getEnvList("ACCESS_LOG_FIELDS", strings.Join(defaultAccessLogFields, ",")),
+		LogSinks:             getEnvList("LOG_SINKS", ""),
+		LogSplitBy:           getEnv("LOG_SPLIT_BY", ""),
+		LogSplitMaxOpen:      getEnvInt("LOG_SPLIT_MAX_OPEN", 32),
+		SyslogFacility:       getEnv("SYSLOG_FACILITY", "local0"),
+		SyslogTag:            getEnv("SYSLOG_TAG", "icap-logger"),
+		WebhookURL:           getEnv("WEBHOOK_URL", ""),
+		WebhookBatchSize:     getEnvInt("WEBHOOK_BATCH_SIZE", 100),
+		WebhookFlushInterval: getEnvDuration("WEBHOOK_FLUSH_INTERVAL", 2*time.Second),
+		WebhookBufferSize:    getEnvInt("WEBHOOK_BUFFER_SIZE", 10000),
+		WebhookMaxRetries:    getEnvInt("WEBHOOK_MAX_RETRIES", 3),
+		WebhookTimeout:       getEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		GCPLogName:           getEnv("GCP_LOG_NAME", ""),
+		GCPProjectID:         getEnv("GCP_PROJECT_ID", ""),
+		GCPResourceType:      getEnv("GCP_RESOURCE_TYPE", "global"),
+		GCPLabels:            getEnvMap("GCP_LABELS", "none"),
+		GCPBatchSize:         getEnvInt("GCP_BATCH_SIZE", 100),
+		GCPFlushInterval:     getEnvDuration("GCP_FLUSH_INTERVAL", 5*time.Second),
+		GCPBufferSize:        getEnvInt("GCP_BUFFER_SIZE", 10000),
+		LogRotateSizeMB:      int64(getEnvInt("LOG_ROTATE_SIZE_MB", 25)),
+		LogRotateInterval:    getEnvDuration("LOG_ROTATE_INTERVAL", 0),
+		LogBufferBytes:       getEnvInt("LOG_BUFFER_BYTES", 0),
+		LogFlushInterval:     getEnvDuration("LOG_FLUSH_INTERVAL", time.Second),
+		CompressQueueSize:    getEnvInt("COMPRESS_QUEUE_SIZE", 16),
+		MaxFileRetention:     getEnvInt("LOG_RETENTION_COUNT", getEnvInt("LOG_FILE_RETENTION", 60)),
+		LogMaxAge:            time.Duration(getEnvInt("LOG_MAX_AGE_DAYS", 0)) * 24 * time.Hour,
+		MaxBodySize:          int64(getEnvInt("MAX_BODY_SIZE", 25*1024*1024)),
+		MaxLogBodyBytes:      getEnvInt("MAX_LOG_BODY_BYTES", 0),
+		OversizeMode:         getEnv("OVERSIZE_MODE", "reject"),
+		LogFileMode:          getEnv("LOG_FILE_MODE", "0644"),
+		LogDirMode:           getEnv("LOG_DIR_MODE", "0755"),
+		LogRotateMode:        getEnv("LOG_ROTATE_MODE", "rename"),
+		ICAPBindAddr:         getEnv("ICAP_BIND_ADDR", ""),
+		HealthBindAddr:       getEnv("HEALTH_BIND_ADDR", ""),
+		BodySpillDir:         getEnv("BODY_SPILL_DIR", ""),
+		BodySpillThreshold:   getEnvInt("BODY_SPILL_THRESHOLD", 65536),
+		IdentityHeaders:      getEnvList("ICAP_IDENTITY_HEADERS", "X-Client-IP,X-Authenticated-User,X-Subscriber-ID"),
+		DebugRawCapture:      getEnvBool("DEBUG_RAW_CAPTURE", false),
+		DebugCaptureFile:     getEnv("DEBUG_CAPTURE_FILE", "/var/log/icap/icap_debug.log"),
+		DebugCaptureRate:     getEnvFloat("DEBUG_CAPTURE_SAMPLE_RATE", 0),
+		DebugCaptureMaxBytes: getEnvInt("DEBUG_CAPTURE_MAX_BYTES", 65536),
+		DebugCaptureBase64:   getEnvBool("DEBUG_CAPTURE_BASE64", true),
+		ReadIdleTimeout:      time.Duration(getEnvInt("READ_IDLE_TIMEOUT_SEC", 0)) * time.Second,
+		MessageMaxDuration:   time.Duration(getEnvInt("MESSAGE_MAX_DURATION_SEC", 0)) * time.Second,
+		GeoIPDBs:             getEnvList("GEOIP_DB", ""),
+		GeoIPDNSCacheTTL:     time.Duration(getEnvInt("GEOIP_DNS_CACHE_TTL_SEC", 300)) * time.Second,
+		GeoIPDNSCacheSize:    getEnvInt("GEOIP_DNS_CACHE_SIZE", 10000),
+		LogDedupWindow:       getEnvDuration("LOG_DEDUP_WINDOW", 0),
+		StatsEnabled:         getEnvBool("STATS_ENABLED", true),
+		ExpectContinue:       getEnvBool("EXPECT_CONTINUE", false),
+		LogRawHeaders:        getEnvBool("LOG_RAW_HEADERS", false),
+		ReadTimeoutResponse:  getEnvBool("READ_TIMEOUT_RESPONSE", false),
+		TimestampFormat:      getEnv("TIMESTAMP_FORMAT", "rfc3339"),
+		Timezone:             getEnv("TIMEZONE", "local"),
+		LogReqID:             getEnvBool("LOG_REQ_ID", false),
+		ReqIDHeaders:         getEnvList("REQ_ID_HEADERS", "X-Transaction-ID,X-Request-Id"),
+		BinaryPreviewBytes:   getEnvInt("BINARY_PREVIEW_BYTES", 0),
+		ReadTimeout:          time.Duration(getEnvInt("READ_TIMEOUT_SEC", 30)) * time.Second,
+		BodyReadDeadline:     time.Duration(getEnvInt("BODY_READ_DEADLINE_SEC", 0)) * time.Second,
+		PreviewSize:          getEnvInt("PREVIEW_SIZE", -1),
+		WriteTimeout:         time.Duration(getEnvInt("WRITE_TIMEOUT_SEC", 10)) * time.Second,
+		DrainTimeout:         time.Duration(getEnvInt("DRAIN_TIMEOUT_SEC", 15)) * time.Second,
+		MaxConcurrentConns:   getEnvInt("MAX_CONCURRENT_CONNS", 0),
+		LogWorkers:           getEnvInt("LOG_WORKERS", 0),
+		LogWorkerMode:        getEnv("LOG_WORKER_MODE", "block"),
+		ConnLimitMode:        getEnv("CONN_LIMIT_MODE", "block"),
+		WorkerCount:          getEnvInt("WORKER_COUNT", 0),
+		WorkerQueueSize:      getEnvInt("WORKER_QUEUE_SIZE", 0),
+		WorkerQueueMode:      getEnv("WORKER_QUEUE_MODE", "block"),
+		HealthPort:           getEnv("HEALTH_PORT", "8080"),
+		RedactAuthHeader:     getEnvBool("REDACT_AUTH_HEADER", true),
+		RedactTokens:         getEnvBool("REDACT_TOKENS", true),
+		LogReqBody:           getEnvBool("LOG_REQ_BODY", false),
+		LogRespBody:          getEnvBool("LOG_RESP_BODY", false),
+		LogReqCookies:        getEnvBool("LOG_REQ_COOKIES", false),
+		LogRespCookies:       getEnvBool("LOG_RESP_COOKIES", false),
+		LogCookieValues:      getEnvBool("LOG_COOKIE_VALUES", false),
+		RedactCookies:        getEnvList("REDACT_COOKIES", ""),
+		VerifyContentMD5:     getEnvBool("VERIFY_CONTENT_MD5", false),
+		LogMessageBytes:      getEnvBool("LOG_MESSAGE_BYTES", false),
+		LogRoundTrip:         getEnvBool("LOG_ROUND_TRIP", false),
+		StrictBodySections:   getEnvBool("STRICT_BODY_SECTIONS", false),
+		FallbackStderr:       getEnvBool("FALLBACK_STDERR", false),
+		FallbackStderrRate:   getEnvInt("FALLBACK_STDERR_RATE", 10),
+		LogStdout:            getEnvBool("LOG_STDOUT", false),
+		HeaderKeyCase:        getEnv("HEADER_KEY_CASE", "canonical"),
+		MarkDisabledBodies:   getEnvBool("MARK_DISABLED_BODIES", false),
+		Allow206:             getEnvBool("ALLOW_206", false),
+		LogStartupBanner:     getEnvBool("LOG_STARTUP_BANNER", false),
+		ServiceHeader:        getEnv("SERVICE_SELECTOR_HEADER", ""),
+		ServiceBodyPolicy:    getEnvMap("SERVICE_BODY_POLICY", "none"),
+		OptionsMaxConns:      getEnvInt("OPTIONS_MAX_CONNECTIONS", 0),
+		OptionsTTL:           time.Duration(getEnvInt("OPTIONS_TTL_SEC", 3600)) * time.Second,
+		TransferIgnore:       getEnvList("TRANSFER_IGNORE", ""),
+		ScrubPII:             getEnvBool("SCRUB_PII", false),
+		LogKeyAllowlist:      getEnvList("LOG_KEY_ALLOWLIST", ""),
+		LogIncludeHosts:      getEnvList("LOG_INCLUDE_HOSTS", ""),
+		LogExcludeHosts:      getEnvList("LOG_EXCLUDE_HOSTS", ""),
+		LogSampleRate:        getEnvFloat("LOG_SAMPLE_RATE", 1),
+		LogSampleSeed:        uint64(getEnvInt("LOG_SAMPLE_SEED", 0)),
+		LogConnSummary:       getEnvBool("LOG_CONN_SUMMARY", false),
+		AlertStatusCodes:     getEnvList("ALERT_STATUS_CODES", ""),
+		HostRedaction:        getEnvMap("HOST_REDACTION", "none"),
+		ProtoDescriptorSet:   getEnv("PROTOBUF_DESCRIPTOR_SET", ""),
+		ProtoTypes:           getEnvMap("PROTOBUF_TYPES", "none"),
+		ReqBodyJSON:          getEnvBool("LOG_REQ_BODY_JSON", false),
+		JSONBodyMaxBytes:     getEnvInt("JSON_BODY_MAX_BYTES", 64*1024),
+		JSONBodyMaxDepth:     getEnvInt("JSON_BODY_MAX_DEPTH", 32),
+		BodyOnErrorOnly:      getEnvBool("BODY_ON_ERROR_ONLY", false),
+		ExtractSNI:           getEnvBool("EXTRACT_SNI", false),
+		SplitEntries:         getEnvBool("SPLIT_ENTRIES", false),
+		HumanSizes:           getEnvBool("HUMAN_SIZES", false),
+		KeepAlive:            getEnvBool("KEEP_ALIVE", false),
+		DetectSecrets:        getEnvBool("DETECT_SECRETS", false),
+		DetectBase64Body:     getEnvBool("DETECT_BASE64_BODY", false),
+		MetricsEnabled:       getEnvBool("METRICS_ENABLED", false),
+		RecentBufferSize:     getEnvInt("RECENT_BUFFER_SIZE", 100),
+		SchemeByPort:         getEnvMap("SCHEME_PORT_MAP", "443=https,80=http"),
+	}
+	// GCP_LOG_NAME alone is enough to select the Cloud Logging sink.
+	if os.Getenv("LOG_SINK") == "" && cfg.GCPLogName != "" {
+		cfg.LogSink = "gcp"
 	}
 	for _, arg := range os.Args[1:] {
 		switch {
@@ -30,12 +150,56 @@ func loadConfig() Config {
 			cfg.Port = strings.TrimPrefix(arg, "--port=")
 		case strings.HasPrefix(arg, "--log="):
 			cfg.LogFile = strings.TrimPrefix(arg, "--log=")
+		case arg == "--stdout":
+			cfg.LogStdout = true
 		case strings.HasPrefix(arg, "--log-rotate-size="):
 			if n, err := strconv.ParseInt(strings.TrimPrefix(arg, "--log-rotate-size="), 10, 64); err == nil && n > 0 {
 				cfg.LogRotateSizeMB = n
 			}
 		}
 	}
+	if cfg.ScrubPII {
+		cfg.PIIPatterns = defaultPIIPatterns()
+		custom, err := parsePIIPatterns(os.Getenv("PII_PATTERNS"))
+		if err != nil {
+			slog.Warn("ignoring PII_PATTERNS", "err", err)
+		}
+		cfg.PIIPatterns = append(cfg.PIIPatterns, custom...)
+	}
+	if raw := os.Getenv("ICAP_SERVICES"); raw != "" {
+		services, err := parseICAPServices(raw)
+		if err != nil {
+			slog.Warn("ignoring ICAP_SERVICES", "err", err)
+		}
+		cfg.ICAPServices = services
+	}
+	if raw := os.Getenv("ICAP_LISTENERS"); raw != "" {
+		listeners, err := parseListeners(raw)
+		if err != nil {
+			slog.Warn("ignoring ICAP_LISTENERS", "err", err)
+		}
+		cfg.Listeners = listeners
+	}
+	if raw := os.Getenv("BODY_LOG_POLICY"); raw != "" {
+		policy, err := parseBodyLogPolicy(raw)
+		if err != nil {
+			slog.Warn("ignoring invalid BODY_LOG_POLICY entry", "err", err)
+		}
+		cfg.BodyLogPolicy = policy
+	}
+	if cfg.ProtoDescriptorSet != "" {
+		reg, err := loadProtoDescriptorSet(cfg.ProtoDescriptorSet)
+		if err != nil {
+			slog.Warn("ignoring PROTOBUF_DESCRIPTOR_SET", "file", cfg.ProtoDescriptorSet, "err", err)
+		}
+		cfg.ProtoRegistry = reg
+	}
+	// The derived ISTag hashes the final configuration, CLI flags included.
+	if tag := strings.Trim(strings.TrimSpace(os.Getenv("ICAP_ISTAG")), `"`); tag != "" {
+		cfg.ISTag = tag
+	} else {
+		cfg.ISTag = defaultISTag(cfg)
+	}
 	return cfg
 }
 
@@ -55,6 +219,63 @@ func getEnvInt(key string, fallback int) int {
 	return fallback
 }
 
+// getEnvFloat parses a decimal such as "0.25". Invalid values fall back to
+// the default.
+func getEnvFloat(key string, fallback float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return fallback
+}
+
+// getEnvDuration parses a Go duration string such as "24h" or "90m".
+// Invalid or negative values fall back to the default.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			return d
+		}
+	}
+	return fallback
+}
+
+// getEnvMap parses a comma-separated list of key=value pairs, e.g.
+// "443=https,80=http". Malformed pairs are skipped. An empty env var uses
+// fallback; the literal value "none" yields an empty map.
+func getEnvMap(key, fallback string) map[string]string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		v = fallback
+	}
+	m := make(map[string]string)
+	if strings.EqualFold(v, "none") {
+		return m
+	}
+	for _, pair := range strings.Split(v, ",") {
+		k, val, ok := strings.Cut(pair, "=")
+		k, val = strings.TrimSpace(k), strings.TrimSpace(val)
+		if !ok || k == "" || val == "" {
+			continue
+		}
+		m[k] = val
+	}
+	return m
+}
+
+// getEnvList parses a comma-separated list, trimming blanks and dropping
+// empty items. An empty env var uses fallback.
+func getEnvList(key, fallback string) []string {
+	var out []string
+	for _, item := range strings.Split(getEnv(key, fallback), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
 func getEnvBool(key string, fallback bool) bool {
 	v := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
 	if v == "" {
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// cookieRedacted replaces the value of a cookie whose value is not logged:
+// every cookie unless LOG_COOKIE_VALUES is on, and those named in
+// REDACT_COOKIES regardless.
+const cookieRedacted = "[redacted]"
+
+// responseCookie is one Set-Cookie header in resp_cookies: the value
+// (redacted like req_cookies) and the attributes as sent.
+type responseCookie struct {
+	Value       string `json:"value"`
+	Domain      string `json:"domain,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Expires     string `json:"expires,omitempty"` // the Expires attribute as sent
+	MaxAge      int    `json:"max_age,omitempty"` // as in net/http: -1 for Max-Age<=0, 0 when absent
+	Secure      bool   `json:"secure,omitempty"`
+	HTTPOnly    bool   `json:"http_only,omitempty"`
+	SameSite    string `json:"same_site,omitempty"` // "Lax", "Strict", or "None"
+	Partitioned bool   `json:"partitioned,omitempty"`
+}
+
+// parseRequestCookies parses the request's Cookie header values into a
+// name → value map with the net/http cookie parser. A single header may
+// carry several cookies separated by ";" (RFC 6265 §4.2.1) and Squid may
+// forward more than one Cookie header; all are merged, later duplicates
+// winning. Pairs net/http rejects (no "=", an invalid name) are skipped and
+// double quotes around a value are removed. Values are replaced with
+// "[redacted]" unless logValues is set, and always for cookies named in
+// redact (case-insensitively). Returns nil when no cookie is found.
+func parseRequestCookies(headerValues []string, redact []string, logValues bool) map[string]string {
+	req := http.Request{Header: http.Header{"Cookie": headerValues}}
+	var cookies map[string]string
+	for _, c := range req.Cookies() {
+		if cookies == nil {
+			cookies = make(map[string]string)
+		}
+		cookies[c.Name] = cookieValue(c, redact, logValues)
+	}
+	return cookies
+}
+
+// parseResponseCookies parses the response's Set-Cookie header values into
+// a name → cookie map with the net/http parser, redacting values as
+// parseRequestCookies does. Headers net/http rejects are skipped; a later
+// header for the same name wins. Returns nil when no cookie is found.
+func parseResponseCookies(headerValues []string, redact []string, logValues bool) map[string]responseCookie {
+	resp := http.Response{Header: http.Header{"Set-Cookie": headerValues}}
+	var cookies map[string]responseCookie
+	for _, c := range resp.Cookies() {
+		if cookies == nil {
+			cookies = make(map[string]responseCookie)
+		}
+		rc := responseCookie{
+			Value:       cookieValue(c, redact, logValues),
+			Domain:      c.Domain,
+			Path:        c.Path,
+			Expires:     c.RawExpires,
+			MaxAge:      c.MaxAge,
+			Secure:      c.Secure,
+			HTTPOnly:    c.HttpOnly,
+			Partitioned: c.Partitioned,
+		}
+		switch c.SameSite {
+		case http.SameSiteLaxMode:
+			rc.SameSite = "Lax"
+		case http.SameSiteStrictMode:
+			rc.SameSite = "Strict"
+		case http.SameSiteNoneMode:
+			rc.SameSite = "None"
+		}
+		cookies[c.Name] = rc
+	}
+	return cookies
+}
+
+// cookieValue is the value logged for c: "[redacted]" unless logValues is
+// set and c is not named in redact.
+func cookieValue(c *http.Cookie, redact []string, logValues bool) string {
+	if !logValues || cookieNameIn(c.Name, redact) {
+		return cookieRedacted
+	}
+	return c.Value
+}
+
+// redactCookieHeader rewrites a Cookie header value so that the values of
+// cookies named in redact are replaced with "[redacted]", keeping order and
+// all other cookies intact. It lets req_headers.Cookie carry the same
+// redaction as the structured req_cookies field.
+func redactCookieHeader(value string, redact []string) string {
+	if len(redact) == 0 {
+		return value
+	}
+	pairs := strings.Split(value, ";")
+	for i, pair := range pairs {
+		name, _, ok := strings.Cut(pair, "=")
+		if ok && cookieNameIn(strings.TrimSpace(name), redact) {
+			pairs[i] = name + "=" + cookieRedacted
+		}
+	}
+	return strings.Join(pairs, ";")
+}
+
+// redactSetCookieHeader is redactCookieHeader for a Set-Cookie header value:
+// only the leading name=value pair is a cookie, the rest are attributes.
+func redactSetCookieHeader(value string, redact []string) string {
+	pair, attrs, hasAttrs := strings.Cut(value, ";")
+	name, _, ok := strings.Cut(pair, "=")
+	if !ok || !cookieNameIn(strings.TrimSpace(name), redact) {
+		return value
+	}
+	value = name + "=" + cookieRedacted
+	if hasAttrs {
+		value += ";" + attrs
+	}
+	return value
+}
+
+// cookieNameIn reports whether name matches any entry of names, ignoring case.
+func cookieNameIn(name string, names []string) bool {
+	for _, n := range names {
+		if strings.EqualFold(name, n) {
+			return true
+		}
+	}
+	return false
+}
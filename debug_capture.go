@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// rawCapture writes the exact ICAP bytes of selected transactions to a
+// separate debug file (DEBUG_RAW_CAPTURE), for diagnosing parser problems
+// with what Squid actually sent. A message is captured when it produced a
+// parse_error or parse_warnings, or otherwise with probability
+// DEBUG_CAPTURE_SAMPLE_RATE (default 0: failures only).
+//
+// Messages are captured before LOG_INCLUDE_HOSTS, LOG_EXCLUDE_HOSTS,
+// HOST_REDACTION, and LOG_SAMPLE_RATE decide whether the entry is logged.
+//
+// The raw message is captured before any redaction, so it can hold
+// credentials, cookies, and bodies: capturing is off by default, never goes
+// to the main log (LOG_FILE is refused as the capture file), and each record
+// is cut at DEBUG_CAPTURE_MAX_BYTES. The file rotates and is pruned like the
+// main log.
+type rawCapture struct {
+	w        *rotatingWriter
+	rate     float64
+	maxBytes int
+	base64   bool
+}
+
+// rawCaptures is the process-wide capture file; main sets it when
+// DEBUG_RAW_CAPTURE is enabled. nil captures nothing.
+var rawCaptures *rawCapture
+
+// rawCaptureRecord is one line of the capture file. Exactly one of Raw and
+// RawBase64 is set.
+type rawCaptureRecord struct {
+	Timestamp     string   `json:"timestamp"`
+	Reason        string   `json:"reason"` // parse_error, parse_warning, or sampled
+	ClientAddr    string   `json:"client_addr,omitempty"`
+	ParseError    string   `json:"parse_error,omitempty"`
+	ParseWarnings []string `json:"parse_warnings,omitempty"`
+	Bytes         int      `json:"bytes"`
+	Truncated     bool     `json:"truncated,omitempty"`
+	Raw           string   `json:"raw,omitempty"`
+	RawBase64     string   `json:"raw_base64,omitempty"`
+}
+
+// newRawCapture opens the capture file from cfg. It refuses a capture file
+// that is the main log, so raw messages can never end up there.
+func newRawCapture(cfg Config) (*rawCapture, error) {
+	if cfg.DebugCaptureFile == "" {
+		return nil, errors.New("DEBUG_CAPTURE_FILE is empty")
+	}
+	if filepath.Clean(cfg.DebugCaptureFile) == filepath.Clean(cfg.LogFile) {
+		return nil, errors.New("DEBUG_CAPTURE_FILE must differ from LOG_FILE")
+	}
+	wcfg := cfg
+	wcfg.LogStartupBanner = false
+	w, err := newRotatingWriter(cfg.DebugCaptureFile, wcfg)
+	if err != nil {
+		return nil, err
+	}
+	return &rawCapture{
+		w:        w,
+		rate:     cfg.DebugCaptureRate,
+		maxBytes: cfg.DebugCaptureMaxBytes,
+		base64:   cfg.DebugCaptureBase64,
+	}, nil
+}
+
+// capture records raw when info failed to parse cleanly or the sampler picks
+// it. It is a no-op on a nil rawCapture.
+func (c *rawCapture) capture(raw []byte, info icapInfo, remote net.Addr) {
+	if c == nil {
+		return
+	}
+	reason := ""
+	switch {
+	case info.parseError != "":
+		reason = "parse_error"
+	case len(info.parseWarnings) > 0:
+		reason = "parse_warning"
+	case c.rate > 0 && logSampler.keep(c.rate):
+		reason = "sampled"
+	default:
+		return
+	}
+	rec := rawCaptureRecord{
+		Timestamp:     time.Now().Format(defaultTimestampLayout),
+		Reason:        reason,
+		ParseError:    info.parseError,
+		ParseWarnings: info.parseWarnings,
+		Bytes:         len(raw),
+	}
+	rec.ClientAddr, _ = clientAddr(remote)
+	if c.maxBytes > 0 && len(raw) > c.maxBytes {
+		raw, rec.Truncated = raw[:c.maxBytes], true
+	}
+	if c.base64 {
+		rec.RawBase64 = base64.StdEncoding.EncodeToString(raw)
+	} else {
+		rec.Raw = string(raw)
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	rawCaptured.Add(1)
+	_, _ = c.w.Write(append(data, '\n'))
+}
+
+// Close closes the capture file.
+func (c *rawCapture) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.w.Close()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// entryDeduper collapses identical consecutive log entries (LOG_DEDUP_WINDOW).
+// The first entry of a run is emitted at once. Repeats that arrive within the
+// window after it are held back as one pending entry — the latest repeat,
+// with repeat_count set to the number of repeats it stands for (the first
+// occurrence not included) — which is emitted when the window expires or a
+// different entry arrives. A flood of identical requests
+// therefore costs one line per window instead of one per request.
+//
+// Entries compare equal when they match in everything but timestamp,
+// processing_ms, correlation_id, req_id, and client_port, which differ on
+// every transaction — without keep-alive each request arrives from a new
+// ephemeral port — and are bound for the same log channel (listeners with their own
+// ICAP_LISTENERS log file each have one). emit is called with d.mu held so
+// that a flushed repeat is always written before the entry that displaced it.
+type entryDeduper struct {
+	window time.Duration
+	emit   func(logEntry, chan<- []byte)
+	seed   maphash.Seed
+
+	mu       sync.Mutex
+	lastKey  uint64
+	lastCh   chan<- []byte // log channel of the last emitted entry and of pending
+	hasLast  bool
+	deadline time.Time   // end of the window opened by the last emitted entry
+	pending  *logEntry   // latest held-back repeat, RepeatCount set
+	timer    *time.Timer // flushes pending at deadline
+	timerGen uint64      // lets a stale timer callback recognize itself
+}
+
+// logDeduper is the process-wide deduper; main replaces it when
+// LOG_DEDUP_WINDOW is set. nil (the default) disables deduplication.
+var logDeduper *entryDeduper
+
+// newEntryDeduper returns a deduper that hands entries and their log channel
+// to emit, or nil when window is not positive.
+func newEntryDeduper(window time.Duration, emit func(logEntry, chan<- []byte)) *entryDeduper {
+	if window <= 0 {
+		return nil
+	}
+	return &entryDeduper{window: window, emit: emit, seed: maphash.MakeSeed()}
+}
+
+// offer passes entry, bound for logCh, through the deduper, which emits it
+// now, holds it as a repeat, or emits it after flushing a held repeat. It
+// reports false, having done nothing, when d is nil; the caller then emits
+// the entry itself.
+func (d *entryDeduper) offer(entry logEntry, logCh chan<- []byte) bool {
+	if d == nil {
+		return false
+	}
+	key := d.key(entry)
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.hasLast && key == d.lastKey && logCh == d.lastCh && now.Before(d.deadline) {
+		entry.RepeatCount = 1
+		if d.pending != nil {
+			entry.RepeatCount = d.pending.RepeatCount + 1
+		}
+		d.pending = &entry
+		if d.timer == nil {
+			gen := d.timerGen
+			d.timer = time.AfterFunc(d.deadline.Sub(now), func() { d.expire(gen) })
+		}
+		return true
+	}
+	d.flushLocked()
+	d.emit(entry, logCh)
+	d.lastKey, d.lastCh, d.hasLast = key, logCh, true
+	d.deadline = now.Add(d.window)
+	return true
+}
+
+// expire flushes the pending repeat when its window ends. Identical entries
+// after that open a new window.
+func (d *entryDeduper) expire(gen uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if gen != d.timerGen {
+		return // flushed and re-armed since this timer was set
+	}
+	if d.pending != nil {
+		d.flushLocked()
+		d.deadline = time.Now().Add(d.window)
+	}
+}
+
+// flush emits the pending repeat, if any; main calls it before shutdown.
+func (d *entryDeduper) flush() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.flushLocked()
+}
+
+func (d *entryDeduper) flushLocked() {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.timerGen++
+	if d.pending != nil {
+		d.emit(*d.pending, d.lastCh)
+		d.pending = nil
+	}
+}
+
+// key hashes entry without its per-transaction fields.
+func (d *entryDeduper) key(entry logEntry) uint64 {
+	entry.Timestamp, entry.ProcessingMs, entry.CorrelationID, entry.ReqID = "", 0, "", ""
+	entry.ClientPort, entry.RepeatCount = 0, 0
+	data, _ := json.Marshal(entry) // sorted map keys make this deterministic
+	return maphash.Bytes(d.seed, data)
+}
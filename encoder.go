@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// encodeEntry serializes one log entry in cfg.LogFormat: "json" (the
+// default, also used for unknown values), "cef", "access", or "msgpack"
+// (length-prefixed binary records, see msgpack.go). Everything after this
+// point — sinks, rotation, the stdout mirror — handles the bytes opaquely,
+// except the features that read entries back as JSON (LOG_KEY_ALLOWLIST,
+// LOG_SPLIT_BY=service, the webhook and gcp sinks), which validateConfig
+// only allows with json.
+func encodeEntry(entry logEntry, cfg Config) ([]byte, error) {
+	switch strings.ToLower(cfg.LogFormat) {
+	case "cef":
+		return encodeCEF(entry), nil
+	case "access":
+		return encodeAccess(entry, cfg.AccessLogFields), nil
+	case "msgpack":
+		return encodeMsgpack(entry)
+	default:
+		return json.Marshal(entry)
+	}
+}
+
+// encodeErrorRecord serializes the {"error": msg} record written to the log
+// in place of an entry that could not be produced. It is JSON in every
+// format except msgpack, where it is framed like an entry so the binary
+// stream stays readable.
+func encodeErrorRecord(msg string, cfg Config) []byte {
+	if strings.EqualFold(cfg.LogFormat, "msgpack") {
+		return encodeMsgpackError(msg)
+	}
+	data, _ := json.Marshal(map[string]string{"error": msg})
+	return data
+}
+
+// defaultAccessLogFields is the ACCESS_LOG_FIELDS default, giving lines like
+//
+//	2024-01-01T00:00:00Z 10.0.0.1 REQMOD GET http://example.com/x 204
+var defaultAccessLogFields = []string{"timestamp", "client_addr", "icap_method", "req_method", "destination_url", "resp_status"}
+
+// accessLogFields maps the field names accepted by ACCESS_LOG_FIELDS — the
+// entry's JSON keys — to their value in an access line. resp_status is the
+// bare status code.
+var accessLogFields = map[string]func(e logEntry) string{
+	"timestamp":       func(e logEntry) string { return e.Timestamp },
+	"client_addr":     func(e logEntry) string { return e.ClientAddr },
+	"client_ip":       func(e logEntry) string { return e.ClientIP },
+	"auth_user":       func(e logEntry) string { return e.AuthUser },
+	"service":         func(e logEntry) string { return e.Service },
+	"icap_method":     func(e logEntry) string { return e.ICAPMethod },
+	"icap_url":        func(e logEntry) string { return e.ICAPURL },
+	"req_method":      func(e logEntry) string { return e.ReqMethod },
+	"destination_url": func(e logEntry) string { return e.DestinationURL },
+	"req_path":        func(e logEntry) string { return e.ReqPath },
+	"resp_status": func(e logEntry) string {
+		code, _, _ := strings.Cut(e.RespStatus, " ")
+		return code
+	},
+	"req_body_bytes":  func(e logEntry) string { return formatCount(e.ReqBodyBytes) },
+	"resp_body_bytes": func(e logEntry) string { return formatCount(e.RespBodyBytes) },
+	"processing_ms":   func(e logEntry) string { return formatCount(e.ProcessingMs) },
+	"req_id":          func(e logEntry) string { return e.ReqID },
+	"correlation_id":  func(e logEntry) string { return e.CorrelationID },
+	"tls_server_name": func(e logEntry) string { return e.TLSServerName },
+}
+
+// formatCount renders a non-zero count; zero is treated as absent, matching
+// the omitempty JSON fields it mirrors.
+func formatCount(n int64) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// encodeAccess renders entry as one space-separated access-log line with the
+// given fields in order (defaultAccessLogFields when empty). Missing values
+// are written as "-", and a value containing whitespace, a quote, or a
+// control character is double-quoted with Go escaping so every line splits
+// into the same number of fields. Unknown field names are skipped;
+// validateConfig rejects them at startup.
+func encodeAccess(e logEntry, fields []string) []byte {
+	if len(fields) == 0 {
+		fields = defaultAccessLogFields
+	}
+	var b []byte
+	for _, name := range fields {
+		value, ok := accessLogFields[strings.ToLower(name)]
+		if !ok {
+			continue
+		}
+		if len(b) > 0 {
+			b = append(b, ' ')
+		}
+		switch v := value(e); {
+		case v == "":
+			b = append(b, '-')
+		case strings.IndexFunc(v, needsAccessQuote) >= 0:
+			b = strconv.AppendQuote(b, v)
+		default:
+			b = append(b, v...)
+		}
+	}
+	return b
+}
+
+// needsAccessQuote reports whether r would break an access line into the
+// wrong number of fields.
+func needsAccessQuote(r rune) bool {
+	return r == '"' || unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+// encodeCEF renders entry as an ArcSight Common Event Format line:
+//
+//	CEF:0|loopnest|icap-logger|<version>|<icap_method>|ICAP <icap_method>|<severity>|<extension>
+//
+// The extension maps entry fields to standard CEF keys; bodies and header
+// maps are not included (SIEMs index the extension, and bodies would blow
+// past typical line limits).
+//
+//	rt            timestamp (epoch milliseconds)
+//	src, spt      client_addr, client_port
+//	request       destination_url
+//	requestMethod req_method
+//	dhost         host of destination_url, else tls_server_name
+//	outcome       resp_status
+//	requestClientApplication  req_headers User-Agent
+//	in, out       req_body_bytes, resp_body_bytes
+//	cs1           icap_url        (cs1Label=icapUrl)
+//	cs2           service         (cs2Label=service)
+//	cs3           correlation_id  (cs3Label=correlationId)
+//	cs4           tls_server_name (cs4Label=tlsServerName)
+//	cn1           round_trip_ms   (cn1Label=roundTripMs)
+//	msg           parse_warnings, joined with "; "
+//
+// Severity is 8 for alerted entries, 7 for 5xx responses, 5 for 4xx, and 3
+// otherwise. Empty fields are left out.
+func encodeCEF(e logEntry) []byte {
+	method := e.ICAPMethod
+	if method == "" {
+		method = "UNKNOWN"
+	}
+	var b strings.Builder
+	b.WriteString("CEF:0|loopnest|icap-logger|")
+	b.WriteString(cefHeaderEscaper.Replace(version))
+	b.WriteByte('|')
+	b.WriteString(cefHeaderEscaper.Replace(method))
+	b.WriteString("|ICAP ")
+	b.WriteString(cefHeaderEscaper.Replace(method))
+	b.WriteByte('|')
+	b.WriteString(strconv.Itoa(cefSeverity(e)))
+	b.WriteByte('|')
+
+	first := true
+	add := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if !first {
+			b.WriteByte(' ')
+		}
+		first = false
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(cefValueEscaper.Replace(value))
+	}
+	if !e.at.IsZero() {
+		add("rt", strconv.FormatInt(e.at.UnixMilli(), 10))
+	} else if t, err := time.Parse(defaultTimestampLayout, e.Timestamp); err == nil {
+		add("rt", strconv.FormatInt(t.UnixMilli(), 10))
+	}
+	add("src", e.ClientAddr)
+	if e.ClientPort > 0 {
+		add("spt", strconv.Itoa(e.ClientPort))
+	}
+	add("request", e.DestinationURL)
+	add("requestMethod", e.ReqMethod)
+	host := e.TLSServerName
+	if u, err := url.Parse(e.DestinationURL); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	add("dhost", host)
+	add("outcome", e.RespStatus)
+	for k, v := range e.ReqHeaders {
+		if strings.EqualFold(k, "User-Agent") {
+			add("requestClientApplication", v)
+			break
+		}
+	}
+	if e.ReqBodyBytes > 0 {
+		add("in", strconv.FormatInt(e.ReqBodyBytes, 10))
+	}
+	if e.RespBodyBytes > 0 {
+		add("out", strconv.FormatInt(e.RespBodyBytes, 10))
+	}
+	if e.ICAPURL != "" {
+		add("cs1", e.ICAPURL)
+		add("cs1Label", "icapUrl")
+	}
+	if e.Service != "" {
+		add("cs2", e.Service)
+		add("cs2Label", "service")
+	}
+	if e.CorrelationID != "" {
+		add("cs3", e.CorrelationID)
+		add("cs3Label", "correlationId")
+	}
+	if e.TLSServerName != "" {
+		add("cs4", e.TLSServerName)
+		add("cs4Label", "tlsServerName")
+	}
+	if e.RoundTripMs != nil {
+		add("cn1", strconv.FormatInt(*e.RoundTripMs, 10))
+		add("cn1Label", "roundTripMs")
+	}
+	add("msg", strings.Join(e.ParseWarnings, "; "))
+	return []byte(b.String())
+}
+
+// cefSeverity maps an entry to the 0–10 CEF severity scale.
+func cefSeverity(e logEntry) int {
+	if e.Alert {
+		return 8
+	}
+	code, _, _ := strings.Cut(e.RespStatus, " ")
+	n, _ := strconv.Atoi(code)
+	switch {
+	case n >= 500:
+		return 7
+	case n >= 400:
+		return 5
+	default:
+		return 3
+	}
+}
+
+// cefHeaderEscaper escapes a CEF header field: backslash and pipe are
+// backslash-escaped, and line breaks (not allowed in the header) become
+// spaces.
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+
+// cefValueEscaper escapes a CEF extension value: backslash and equals sign
+// are backslash-escaped and line breaks are written as \r and \n. Pipes need
+// no escaping in the extension.
+var cefValueEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// fallbackSink wraps the primary sink (FALLBACK_STDERR=true). When a Write to
+// the primary fails, the serialized entry is copied to out (stderr in
+// production) so a full disk or unreachable collector does not lose it
+// silently. At most ratePerSec entries are copied per one-second window; the
+// rest are counted in fallbackSuppressed so a sustained outage cannot flood
+// the container log. The primary's error is still returned so the log writer
+// reports it as before.
+type fallbackSink struct {
+	logSink
+	out        io.Writer
+	ratePerSec int
+	now        func() time.Time // replaced in tests
+
+	mu          sync.Mutex
+	windowStart time.Time
+	windowCount int
+}
+
+// newFallbackSink wraps primary. A non-positive ratePerSec defaults to 10.
+func newFallbackSink(primary logSink, out io.Writer, ratePerSec int) *fallbackSink {
+	if ratePerSec <= 0 {
+		ratePerSec = 10
+	}
+	return &fallbackSink{logSink: primary, out: out, ratePerSec: ratePerSec, now: time.Now}
+}
+
+// Write writes p to the primary sink, falling back to out on error.
+func (s *fallbackSink) Write(p []byte) (int, error) {
+	n, err := s.logSink.Write(p)
+	if err == nil {
+		return n, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now := s.now(); now.Sub(s.windowStart) >= time.Second {
+		s.windowStart = now
+		s.windowCount = 0
+	}
+	if s.windowCount >= s.ratePerSec {
+		fallbackSuppressed.Add(1)
+		return n, err
+	}
+	s.windowCount++
+	if _, werr := s.out.Write(p); werr != nil {
+		fallbackSuppressed.Add(1)
+		return n, err
+	}
+	fallbackWritten.Add(1)
+	return n, err
+}
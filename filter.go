@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entryHost returns the destination host of a parsed request, lowercased and
+// without port: the host of destination_url, else the SNI name of a CONNECT
+// tunnel. Returns "" when neither is known.
+func entryHost(info icapInfo) string {
+	host := ""
+	if u, err := url.Parse(info.destinationURL); err == nil {
+		host = u.Hostname()
+	}
+	if host == "" {
+		host = info.tlsServerName
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// hostAllowed applies LOG_INCLUDE_HOSTS and LOG_EXCLUDE_HOSTS to host. With an
+// include list the host must match one of its patterns; a match in the
+// exclude list always wins. Patterns are exact host names or path.Match
+// wildcards ("*.internal" matches "db.internal" and "a.b.internal" but not
+// "internal" itself), compared case-insensitively. A request whose host is
+// unknown passes an exclude-only filter but not an include list.
+func hostAllowed(host string, include, exclude []string) bool {
+	if len(include) > 0 && !hostMatchesAny(host, include) {
+		return false
+	}
+	return !hostMatchesAny(host, exclude)
+}
+
+func hostMatchesAny(host string, patterns []string) bool {
+	if host == "" {
+		return false
+	}
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == host {
+			return true
+		}
+		if ok, err := path.Match(p, host); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// logSampler decides which transactions LOG_SAMPLE_RATE keeps. main replaces
+// it with one seeded from LOG_SAMPLE_SEED; tests seed their own.
+var logSampler = newSampler(0)
+
+// sampler is a mutex-guarded PRNG shared by all log goroutines.
+type sampler struct {
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// newSampler returns a sampler seeded with seed, or from the clock when seed
+// is 0. A fixed seed makes the kept/skipped sequence reproducible.
+func newSampler(seed uint64) *sampler {
+	if seed == 0 {
+		seed = uint64(time.Now().UnixNano())
+	}
+	return &sampler{rng: rand.New(rand.NewPCG(seed, seed))}
+}
+
+// keep reports whether a transaction should be logged at rate. Only rates
+// strictly between 0 and 1 sample; anything else (including the zero value)
+// keeps every transaction without consuming randomness.
+func (s *sampler) keep(rate float64) bool {
+	if rate <= 0 || rate >= 1 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rng.Float64() < rate
+}
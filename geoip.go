@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// geoInfo is the GeoIP enrichment of one address (client_geo, dest_geo).
+type geoInfo struct {
+	Country string `json:"country,omitempty"` // ISO 3166-1 alpha-2 code
+	City    string `json:"city,omitempty"`    // English city name
+	ASN     uint64 `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// geoEnricher is the request hook behind GEOIP_DB. It resolves the end
+// user's address (client_ip, else client_addr) and the destination host to
+// country, city, and ASN. Several databases may be configured — typically a
+// City and an ASN database — and each lookup merges what they return.
+// Destination host names are resolved through a TTL cache so that a busy
+// host costs one DNS query per GEOIP_DNS_CACHE_TTL_SEC, not one per request.
+type geoEnricher struct {
+	dbs []*mmdbReader
+	dns *dnsCache
+}
+
+// newGeoEnricher loads every database in cfg.GeoIPDBs. A database that is
+// missing or corrupt is skipped with a warning; nil is returned when none
+// loaded, which leaves enrichment off rather than failing startup.
+func newGeoEnricher(cfg Config) *geoEnricher {
+	g := &geoEnricher{dns: newDNSCache(cfg.GeoIPDNSCacheTTL, cfg.GeoIPDNSCacheSize)}
+	for _, path := range cfg.GeoIPDBs {
+		db, err := openMMDB(path)
+		if err != nil {
+			slog.Warn("GeoIP database not loaded; skipping it", "path", path, "err", err)
+			continue
+		}
+		g.dbs = append(g.dbs, db)
+	}
+	if len(g.dbs) == 0 {
+		slog.Warn("no GeoIP database loaded; GeoIP enrichment disabled")
+		return nil
+	}
+	return g
+}
+
+// OnRequest sets entry.ClientGeo and entry.DestGeo.
+func (g *geoEnricher) OnRequest(info icapInfo, entry *logEntry) {
+	client := entry.ClientIP
+	if client == "" {
+		client = entry.ClientAddr
+	}
+	if addr, err := netip.ParseAddr(client); err == nil {
+		entry.ClientGeo = g.lookup(addr)
+	}
+	if host := destinationHost(info.destinationURL); host != "" {
+		if addr, ok := g.dns.resolve(host); ok {
+			entry.DestGeo = g.lookup(addr)
+		}
+	}
+}
+
+// lookup merges the records of every database for addr. It returns nil when
+// nothing is known; a lookup error in one database is ignored.
+func (g *geoEnricher) lookup(addr netip.Addr) *geoInfo {
+	var geo geoInfo
+	for _, db := range g.dbs {
+		rec, err := db.lookup(addr)
+		if err != nil || rec == nil {
+			continue
+		}
+		if geo.Country == "" {
+			geo.Country = geoString(rec, "country", "iso_code")
+		}
+		if geo.Country == "" {
+			geo.Country = geoString(rec, "registered_country", "iso_code")
+		}
+		if geo.City == "" {
+			geo.City = geoString(rec, "city", "names", "en")
+		}
+		if geo.ASN == 0 {
+			geo.ASN = mmdbUint(rec["autonomous_system_number"])
+		}
+		if geo.ASOrg == "" {
+			geo.ASOrg, _ = rec["autonomous_system_organization"].(string)
+		}
+	}
+	if geo == (geoInfo{}) {
+		return nil
+	}
+	return &geo
+}
+
+// geoString follows path through nested maps of rec to a string value.
+func geoString(rec map[string]any, path ...string) string {
+	var v any = rec
+	for _, key := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return ""
+		}
+		v = m[key]
+	}
+	s, _ := v.(string)
+	return s
+}
+
+// destinationHost returns the host name or IP literal of a destination URL,
+// or "" when it has none.
+func destinationHost(destinationURL string) string {
+	if destinationURL == "" {
+		return ""
+	}
+	u, err := url.Parse(destinationURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// dnsCache resolves host names to one IP address, caching answers (negative
+// ones included) for ttl. The cache holds at most size names; when full,
+// expired entries are dropped and, if that is not enough, the whole cache is
+// cleared — simple, and bounded.
+type dnsCache struct {
+	ttl     time.Duration
+	size    int
+	timeout time.Duration
+	lookup  func(ctx context.Context, host string) ([]netip.Addr, error)
+
+	mu      sync.Mutex
+	entries map[string]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	addr    netip.Addr // invalid for a cached failure
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration, size int) *dnsCache {
+	return &dnsCache{
+		ttl:     ttl,
+		size:    max(size, 1),
+		timeout: 2 * time.Second,
+		lookup: func(ctx context.Context, host string) ([]netip.Addr, error) {
+			return net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		},
+		entries: make(map[string]dnsCacheEntry),
+	}
+}
+
+// resolve returns an address for host. IP literals are returned as is
+// without touching the cache.
+func (c *dnsCache) resolve(host string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return addr, true
+	}
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.addr, e.addr.IsValid()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	addrs, err := c.lookup(ctx, host)
+	cancel()
+	e = dnsCacheEntry{expires: now.Add(c.ttl)}
+	if err == nil && len(addrs) > 0 {
+		e.addr = addrs[0].Unmap()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[host]; !exists && len(c.entries) >= c.size {
+		for h, old := range c.entries {
+			if !now.Before(old.expires) {
+				delete(c.entries, h)
+			}
+		}
+		if len(c.entries) >= c.size {
+			clear(c.entries)
+		}
+	}
+	c.entries[host] = e
+	return e.addr, e.addr.IsValid()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// requestHook is the extension seam for code built into the binary: OnRequest
+// runs for every transaction that is going to be logged, after parsing and
+// entry assembly and before SPLIT_ENTRIES and encoding. It may modify entry
+// (set fields, add to entry.Extra) or start asynchronous work; it must not
+// keep entry or block for long, since it runs on the transaction's log
+// goroutine. info is the parse result and must be treated as read-only.
+//
+// A hook is added from an init function in its own file:
+//
+//	func init() {
+//		registerRequestHook(requestHookFunc(func(info icapInfo, entry *logEntry) {
+//			entry.Extra["team"] = lookupTeam(entry.ClientIP)
+//		}))
+//	}
+type requestHook interface {
+	OnRequest(info icapInfo, entry *logEntry)
+}
+
+// requestHookFunc adapts a function to requestHook.
+type requestHookFunc func(info icapInfo, entry *logEntry)
+
+func (f requestHookFunc) OnRequest(info icapInfo, entry *logEntry) { f(info, entry) }
+
+// requestHooks holds the registered hooks in registration order. With none
+// registered, runRequestHooks does nothing.
+var (
+	requestHooksMu sync.RWMutex
+	requestHooks   []requestHook
+)
+
+// registerRequestHook adds h; hooks run in the order they were registered.
+func registerRequestHook(h requestHook) {
+	requestHooksMu.Lock()
+	defer requestHooksMu.Unlock()
+	requestHooks = append(requestHooks, h)
+}
+
+// runRequestHooks calls every registered hook on entry. entry.Extra is
+// allocated for them first. A panicking hook is logged and skipped so it
+// cannot take the entry, or the server, down with it.
+func runRequestHooks(info icapInfo, entry *logEntry) {
+	requestHooksMu.RLock()
+	hooks := requestHooks
+	requestHooksMu.RUnlock()
+	if len(hooks) == 0 {
+		return
+	}
+	if entry.Extra == nil {
+		entry.Extra = make(map[string]any)
+	}
+	for _, h := range hooks {
+		runRequestHook(h, info, entry)
+	}
+	if len(entry.Extra) == 0 {
+		entry.Extra = nil
+	}
+}
+
+func runRequestHook(h requestHook, info icapInfo, entry *logEntry) {
+	defer func() {
+		if r := recover(); r != nil {
+			hookPanics.Add(1)
+			slog.Error("request hook panicked", "hook", fmt.Sprintf("%T", h), "panic", r)
+		}
+	}()
+	h.OnRequest(info, entry)
+}
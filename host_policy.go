@@ -0,0 +1,80 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// Host redaction profiles select how much of an entry is redacted from the
+// destination host of the request, so one logger can treat a bank and an
+// internal wiki differently:
+//
+//	HOST_REDACTION=*.bank.example.com=full,*.internal=none,mail.example.com=body
+//
+// Profiles, from least to most redacted:
+//
+//	none     log everything: auth header, token, cookie, and PII redaction off
+//	headers  default redaction, and req/resp headers and cookies are omitted
+//	body     default redaction, and both bodies are dropped (marked when
+//	         MARK_DISABLED_BODIES is set)
+//	full     the transaction is not logged at all
+//
+// Hosts without a matching pattern get the global settings. Patterns use the
+// same syntax as LOG_INCLUDE_HOSTS.
+
+// hostRedactionProfile returns the lowercased profile for host, or "" when no
+// pattern matches. When several patterns match, an exact host name wins over
+// wildcards and a longer wildcard over a shorter one, so
+// "login.bank.example.com=none" can carve an exception out of
+// "*.bank.example.com=full".
+func hostRedactionProfile(host string, rules map[string]string) string {
+	if host == "" || len(rules) == 0 {
+		return ""
+	}
+	best, bestPattern, profile := -1, "", ""
+	for pattern, p := range rules {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		score := -1
+		if pattern == host {
+			score = 1 << 16
+		} else if ok, err := path.Match(pattern, host); err == nil && ok {
+			score = len(pattern)
+		}
+		if score > best || score == best && pattern < bestPattern {
+			best, bestPattern, profile = score, pattern, strings.ToLower(strings.TrimSpace(p))
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	return profile
+}
+
+// applyHostRedaction returns cfg adjusted for a HOST_REDACTION profile. The
+// "headers" and "full" profiles are also enforced on the built entry by
+// redactEntryForHost; an unknown profile leaves cfg unchanged.
+func applyHostRedaction(cfg Config, profile string) Config {
+	switch profile {
+	case "none":
+		cfg.RedactAuthHeader = false
+		cfg.RedactTokens = false
+		cfg.RedactCookies = nil
+		cfg.ScrubPII = false
+	case "body", "full":
+		cfg.LogReqBody, cfg.LogRespBody = false, false
+	}
+	return cfg
+}
+
+// redactEntryForHost strips header fields from entry for the "headers"
+// profile, and for "full" in case such an entry is built anyway.
+func redactEntryForHost(entry *logEntry, profile string) {
+	if profile != "headers" && profile != "full" {
+		return
+	}
+	entry.ReqHeaders = nil
+	entry.ReqHeadersRaw = nil
+	entry.RespHeaders = nil
+	entry.ReqCookies = nil
+	entry.RespCookies = nil
+}
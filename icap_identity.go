@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// icapIdentity holds the Squid identity headers promoted from icap_headers to
+// top-level entry fields (ICAP_IDENTITY_HEADERS).
+type icapIdentity struct {
+	clientIP     string // X-Client-IP → client_ip
+	authUser     string // X-Authenticated-User → auth_user
+	subscriberID string // X-Subscriber-ID → subscriber_id
+}
+
+// extractICAPIdentity reads the identity headers named in enabled (matched
+// case-insensitively; unknown names are ignored) from the ICAP headers.
+// X-Authenticated-User is decoded with decodeAuthenticatedUser.
+func extractICAPIdentity(h http.Header, enabled []string) icapIdentity {
+	var id icapIdentity
+	for _, name := range enabled {
+		v := strings.TrimSpace(h.Get(name))
+		if v == "" {
+			continue
+		}
+		switch http.CanonicalHeaderKey(strings.TrimSpace(name)) {
+		case "X-Client-Ip":
+			id.clientIP = v
+		case "X-Authenticated-User":
+			id.authUser = decodeAuthenticatedUser(v)
+		case "X-Subscriber-Id":
+			id.subscriberID = v
+		}
+	}
+	return id
+}
+
+// decodeAuthenticatedUser returns the user name carried in an
+// X-Authenticated-User value. Squid sends it either as is or, with
+// icap_client_username_encode on, base64-encoded — optionally after a scheme
+// token ("Basic d2luVDovL2FsaWNl"). The encoded form usually decodes to a
+// "Scheme://user" URI (e.g. "WinNT://CORP/alice", "Local://alice"), whose
+// scheme is dropped. A value that does not decode to printable UTF-8 is
+// returned unchanged, so plain names are never mangled.
+func decodeAuthenticatedUser(v string) string {
+	encoded := v
+	if _, rest, ok := strings.Cut(v, " "); ok {
+		encoded = strings.TrimSpace(rest)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) == 0 || !printableUTF8(raw) {
+		return v
+	}
+	user := string(raw)
+	if _, rest, ok := strings.Cut(user, "://"); ok && rest != "" {
+		user = rest
+	}
+	return user
+}
+
+// printableUTF8 reports whether b is valid UTF-8 without control characters.
+func printableUTF8(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
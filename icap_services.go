@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ICAP service registry (ICAP_SERVICES). Without it every service path is
+// accepted and OPTIONS advertises RESPMOD when the path contains "respmod"
+// and REQMOD otherwise. With it, only the listed paths exist, each with its
+// own OPTIONS capabilities:
+//
+//	ICAP_SERVICES=reqmod=REQMOD; respmod=RESPMOD preview=0 transfer-ignore=jpg,png ttl=600
+//
+// Services are separated by ";". Each is "<path>=<methods>" (methods
+// comma-separated) followed by optional space-separated attributes that
+// override the global setting for that service: preview (PREVIEW_SIZE, -1
+// omits Preview), transfer-ignore (TRANSFER_IGNORE), and ttl
+// (OPTIONS_TTL_SEC). Requests for an unlisted path are answered with ICAP 404
+// and requests using a method the service does not offer with ICAP 405;
+// neither is logged.
+
+// icapService is one ICAP_SERVICES entry.
+type icapService struct {
+	Methods        []string
+	Preview        int      // used when SetPreview; otherwise PREVIEW_SIZE
+	SetPreview     bool     // no pointers: the config is hashed into the ISTag
+	TransferIgnore []string // nil = TRANSFER_IGNORE
+	TTL            time.Duration
+}
+
+// parseICAPServices parses an ICAP_SERVICES value into a map keyed by the
+// sanitized service path (see sanitizeServiceKey). An empty value yields nil.
+func parseICAPServices(raw string) (map[string]icapService, error) {
+	services := map[string]icapService{}
+	for _, def := range strings.Split(raw, ";") {
+		fields := strings.Fields(def)
+		if len(fields) == 0 {
+			continue
+		}
+		name, methods, ok := strings.Cut(fields[0], "=")
+		key := sanitizeServiceKey(name)
+		if !ok || key == "" || methods == "" {
+			return nil, fmt.Errorf("service %q: want <path>=<methods>", fields[0])
+		}
+		var svc icapService
+		for _, m := range strings.Split(methods, ",") {
+			m = strings.ToUpper(strings.TrimSpace(m))
+			if m != "REQMOD" && m != "RESPMOD" {
+				return nil, fmt.Errorf("service %q: unknown method %q", key, m)
+			}
+			svc.Methods = append(svc.Methods, m)
+		}
+		for _, attr := range fields[1:] {
+			k, v, _ := strings.Cut(attr, "=")
+			switch strings.ToLower(k) {
+			case "preview":
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return nil, fmt.Errorf("service %q: bad preview %q", key, v)
+				}
+				svc.Preview, svc.SetPreview = n, true
+			case "transfer-ignore":
+				svc.TransferIgnore = []string{}
+				for _, ext := range strings.Split(v, ",") {
+					if ext = strings.TrimSpace(ext); ext != "" {
+						svc.TransferIgnore = append(svc.TransferIgnore, ext)
+					}
+				}
+			case "ttl":
+				n, err := strconv.Atoi(v)
+				if err != nil || n <= 0 {
+					return nil, fmt.Errorf("service %q: bad ttl %q", key, v)
+				}
+				svc.TTL = time.Duration(n) * time.Second
+			default:
+				return nil, fmt.Errorf("service %q: unknown attribute %q", key, k)
+			}
+		}
+		services[key] = svc
+	}
+	if len(services) == 0 {
+		return nil, nil
+	}
+	return services, nil
+}
+
+// lookupICAPService returns the registry entry for serviceURL. ok is false
+// when a registry is configured and the path is not in it; with no registry
+// it reports the default service for the path, per the "respmod" heuristic.
+func lookupICAPService(serviceURL string, cfg Config) (icapService, bool) {
+	if len(cfg.ICAPServices) == 0 {
+		method := "REQMOD"
+		if strings.Contains(strings.ToLower(serviceURL), "respmod") {
+			method = "RESPMOD"
+		}
+		return icapService{Methods: []string{method}}, true
+	}
+	svc, ok := cfg.ICAPServices[serviceKey(serviceURL)]
+	return svc, ok
+}
+
+// methodURLMismatch reports whether the ICAP method contradicts the service
+// URL it was sent to: a REQMOD for a service path containing "respmod", or a
+// RESPMOD for one containing "reqmod" (case-insensitive). Squid sends each
+// icap_service's method to its URL without checking the two agree, so a
+// swapped configuration is otherwise only noticed through odd adaptation
+// results. Paths naming neither method, and OPTIONS, never mismatch.
+func methodURLMismatch(method, icapURL string) bool {
+	path := strings.ToLower(serviceKey(icapURL))
+	switch strings.ToUpper(method) {
+	case "REQMOD":
+		return strings.Contains(path, "respmod")
+	case "RESPMOD":
+		return strings.Contains(path, "reqmod")
+	}
+	return false
+}
+
+// serviceCfg returns cfg with the service's OPTIONS overrides applied.
+func (svc icapService) serviceCfg(cfg Config) Config {
+	if svc.SetPreview {
+		cfg.PreviewSize = svc.Preview
+	}
+	if svc.TransferIgnore != nil {
+		cfg.TransferIgnore = svc.TransferIgnore
+	}
+	if svc.TTL > 0 {
+		cfg.OptionsTTL = svc.TTL
+	}
+	return cfg
+}
+
+// offers reports whether the service accepts the ICAP method.
+func (svc icapService) offers(method string) bool {
+	for _, m := range svc.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceRejection returns the ICAP status with which the registry turns away
+// the request whose request line is firstLine, or "" when it is accepted.
+func serviceRejection(firstLine string, cfg Config) string {
+	parts := strings.Fields(firstLine)
+	if len(parts) < 2 {
+		return ""
+	}
+	svc, ok := lookupICAPService(parts[1], cfg)
+	switch {
+	case !ok:
+		return icapStatusNotFound
+	case !svc.offers(parts[0]):
+		return icapStatusMethodNotAllowed
+	}
+	return ""
+}
+
+// icapServiceError builds the 404 / 405 response for a request the registry
+// turns away.
+func icapServiceError(status string, keepAlive bool, cfg Config) string {
+	return strings.Join([]string{
+		"ICAP/1.0 " + status,
+		"Service: icap-logger/1.0",
+		istagHeader(cfg.ISTag),
+		"Encapsulated: null-body=0",
+		connectionHeader(keepAlive),
+		"\r\n",
+	}, "\r\n")
+}
+
+const (
+	icapStatusNotFound         = "404 ICAP Service Not Found"
+	icapStatusMethodNotAllowed = "405 Method Not Allowed For Service"
+)
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// idleConn applies READ_IDLE_TIMEOUT_SEC while an ICAP message is being read:
+// every Read pushes the read deadline to now+idle, so a client that keeps
+// sending may take as long as it needs, while one that stalls — or trickles
+// slower than one read per idle period, as in slowloris — is cut off. The
+// deadline never passes the hard limit: the most recent SetReadDeadline value
+// (BODY_READ_DEADLINE_SEC) or the MESSAGE_MAX_DURATION_SEC cap given to begin.
+//
+// Between messages (begin … end) it behaves like the wrapped conn, so
+// READ_TIMEOUT_SEC still bounds an idle keep-alive connection. All calls come
+// from the connection's handler goroutine.
+type idleConn struct {
+	net.Conn
+	idle   time.Duration
+	active bool
+	hard   time.Time // zero = no hard limit
+}
+
+// begin switches to per-read idle deadlines for one message, capped at hard
+// (zero for none).
+func (c *idleConn) begin(hard time.Time) {
+	c.active, c.hard = true, hard
+}
+
+// end switches back to plain deadlines once the message has been read.
+func (c *idleConn) end() {
+	c.active, c.hard = false, time.Time{}
+}
+
+// SetReadDeadline records t as the hard limit while a message is read, and
+// sets it directly otherwise.
+func (c *idleConn) SetReadDeadline(t time.Time) error {
+	if !c.active {
+		return c.Conn.SetReadDeadline(t)
+	}
+	if c.hard.IsZero() || t.Before(c.hard) {
+		c.hard = t
+	}
+	return nil
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	if c.active {
+		d := time.Now().Add(c.idle)
+		if !c.hard.IsZero() && c.hard.Before(d) {
+			d = c.hard
+		}
+		if err := c.Conn.SetReadDeadline(d); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(p)
+}
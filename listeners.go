@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ICAP listeners (ICAP_LISTENERS). By default one listener on ICAP_PORT
+// serves every ICAP service and logs to the configured sink. ICAP_LISTENERS
+// replaces it with several listeners in one process, e.g. REQMOD and RESPMOD
+// on their own ports with their own log files:
+//
+//	ICAP_LISTENERS=1344 service=reqmod log=/var/log/icap/reqmod.log; 1345 service=respmod log=/var/log/icap/respmod.log
+//
+// Listeners are separated by ";". Each starts with its port, followed by
+// optional space-separated attributes: service (the only ICAP service path
+// served on the port — others are answered with ICAP 404 as an unlisted
+// ICAP_SERVICES path would be) and log (a file of its own, rotated like
+// LOG_FILE, instead of the shared sink). All listeners share ICAP_BIND_ADDR,
+// TLS, and the rest of the configuration; MAX_CONCURRENT_CONNS and
+// WORKER_COUNT apply to each listener separately.
+
+// ListenerConfig is one ICAP_LISTENERS entry.
+type ListenerConfig struct {
+	Port    string
+	Service string // sanitized service key; "" serves every service
+	LogFile string // "" logs to the shared sink
+}
+
+// parseListeners parses an ICAP_LISTENERS value. An empty value yields nil.
+func parseListeners(raw string) ([]ListenerConfig, error) {
+	var listeners []ListenerConfig
+	for _, def := range strings.Split(raw, ";") {
+		fields := strings.Fields(def)
+		if len(fields) == 0 {
+			continue
+		}
+		l := ListenerConfig{Port: fields[0]}
+		for _, attr := range fields[1:] {
+			k, v, _ := strings.Cut(attr, "=")
+			switch strings.ToLower(k) {
+			case "service":
+				if l.Service = sanitizeServiceKey(v); l.Service == "" {
+					return nil, fmt.Errorf("listener %s: bad service %q", l.Port, v)
+				}
+			case "log":
+				if v == "" {
+					return nil, fmt.Errorf("listener %s: empty log file", l.Port)
+				}
+				l.LogFile = v
+			default:
+				return nil, fmt.Errorf("listener %s: unknown attribute %q", l.Port, k)
+			}
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenerConfigs returns the listeners to start: ICAP_LISTENERS, or a single
+// listener on ICAP_PORT serving every service.
+func listenerConfigs(cfg Config) []ListenerConfig {
+	if len(cfg.Listeners) > 0 {
+		return cfg.Listeners
+	}
+	return []ListenerConfig{{Port: cfg.Port}}
+}
+
+// serverCfg returns the configuration the listener serves with: cfg with its
+// port and, for a single-service listener, a registry holding only that
+// service — the ICAP_SERVICES entry when there is one, else the default
+// service for the path.
+func (l ListenerConfig) serverCfg(cfg Config) Config {
+	cfg.Port = l.Port
+	if l.Service != "" {
+		svc, _ := lookupICAPService("/"+l.Service, cfg)
+		cfg.ICAPServices = map[string]icapService{l.Service: svc}
+	}
+	return cfg
+}
+
+// icapListener is a started listener and where its entries go.
+type icapListener struct {
+	ListenerConfig
+	ln    net.Listener
+	cfg   Config
+	logCh chan<- []byte
+	sink  logSink         // the listener's own sink; nil when it uses the shared one
+	done  <-chan struct{} // closed when the own sink's writer has drained
+}
+
+// openListeners listens on every configured port, wrapping each in TLS when
+// tlsCfg is set, and opens the log files of listeners that have their own.
+// Listeners without one log to shared. On error everything opened so far is
+// closed again.
+func openListeners(cfg Config, tlsCfg *tls.Config, shared chan<- []byte) ([]*icapListener, error) {
+	var opened []*icapListener
+	fail := func(err error) ([]*icapListener, error) {
+		for _, l := range opened {
+			l.ln.Close()
+			l.closeSink()
+		}
+		return nil, err
+	}
+	for _, lc := range listenerConfigs(cfg) {
+		l := &icapListener{ListenerConfig: lc, cfg: lc.serverCfg(cfg), logCh: shared}
+		addr := listenAddr(cfg.ICAPBindAddr, lc.Port)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fail(fmt.Errorf("listen on %s: %w", addr, err))
+		}
+		if tlsCfg != nil {
+			ln = tls.NewListener(ln, tlsCfg)
+		}
+		l.ln = ln
+		opened = append(opened, l)
+		if lc.LogFile != "" {
+			sinkCfg := cfg
+			sinkCfg.LogSink, sinkCfg.LogSinks, sinkCfg.LogSplitBy = "file", nil, ""
+			sinkCfg.LogFile = lc.LogFile
+			sink, err := openLogSink(sinkCfg)
+			if err != nil {
+				return fail(fmt.Errorf("open log file %s for port %s: %w", lc.LogFile, lc.Port, err))
+			}
+			l.sink = sink
+			l.logCh, l.done = startLogWriter(sink)
+		}
+	}
+	return opened, nil
+}
+
+// closeSink drains and closes the listener's own sink, if it has one. Its
+// channel must no longer be written to.
+func (l *icapListener) closeSink() {
+	if l.sink == nil {
+		return
+	}
+	close(l.logCh)
+	<-l.done
+	_ = l.sink.Close()
+}
+
+// reopenListenerSinks reopens the listeners' own log files (SIGHUP).
+func reopenListenerSinks(listeners []*icapListener) error {
+	var errs []error
+	for _, l := range listeners {
+		if l.sink != nil {
+			errs = append(errs, reopenSink(l.sink))
+		}
+	}
+	return errors.Join(errs...)
+}
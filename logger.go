@@ -1,137 +1,517 @@
 package main
 
 import (
+	"bufio"
 	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 // rotatingWriter is an io.WriteCloser that rotates the active log file when it
-// exceeds maxSize bytes. On rotation it:
+// exceeds maxSize bytes or has been open longer than rotateInterval, whichever
+// comes first. On rotation it:
 //  1. Renames the active file with a timestamp suffix
-//     (e.g. icap_logger.log.20260311-165838)
-//  2. Compresses the renamed file to <name>.gz asynchronously
-//  3. Deletes the oldest rotated .gz files when the count exceeds fileRetention
+//     (e.g. icap_logger.log.20260311-165838), or with LOG_ROTATE_MODE=copytruncate
+//     copies it there and truncates the active file in place
+//  2. Queues the renamed file for gzip compression to <name>.gz
+//  3. Deletes the oldest rotated files when the count exceeds fileRetention
 //
-// All I/O that could block (compression, deletion) runs in a background
-// goroutine so the Write() hot-path is never delayed.
+// All I/O that could block (compression, deletion) runs on a single background
+// compression worker fed by a bounded queue, so the Write() hot-path is never
+// delayed and a burst of rotations never runs several gzip jobs at once.
+// Close() waits for queued compressions to finish.
+//
+// With LOG_BUFFER_BYTES > 0 entries are collected in a bufio.Writer in front
+// of the file instead of costing one write syscall each. A full buffer is
+// written out by the Write that overflows it (so a slow disk still pushes
+// back on the log writer goroutine), a background flusher writes it every
+// LOG_FLUSH_INTERVAL, and it is always flushed into the current file before
+// that file is rotated, reopened, or closed, so no line is lost or lands in
+// the wrong file. A write error then surfaces on a later Write or flush
+// rather than on the entry that caused it.
 type rotatingWriter struct {
 	mu             sync.Mutex
-	filename        string
-	maxSize         int64
-	fileRetention   int
-	file            *os.File
-	size            int64
+	filename       string
+	maxSize        int64
+	rotateInterval time.Duration
+	fileRetention  int
+	maxAge         time.Duration
+	file           *os.File
+	size           int64
+	bannerSize     int64 // bytes of the startup banner at the top of the active file
+	openedAt       time.Time
+	compressCh     chan string   // rotated file paths awaiting compression
+	compressDone   chan struct{} // closed when the compression worker exits
+	closeOnce      sync.Once
+	banner         func() []byte // LOG_STARTUP_BANNER line for fresh files; nil = none
+	fileMode       os.FileMode   // LOG_FILE_MODE for the active, rotated, and compressed files
+	copyTruncate   bool          // LOG_ROTATE_MODE=copytruncate: copy then truncate in place
+	lastRotated    time.Time     // zero until the first successful rotation
+	buf            *bufio.Writer // LOG_BUFFER_BYTES buffer in front of file; nil = unbuffered
+	flushStop      chan struct{} // closed by Close to stop the flusher; nil without one
+	flushDone      chan struct{} // closed when the flusher exits
 }
 
-// newRotatingWriter creates a rotatingWriter. maxSizeMB is the per-file
-// rotation threshold; fileRetention caps the number of retained .gz archives
-// (0 means unlimited).
-func newRotatingWriter(filename string, maxSizeMB int64, fileRetention int) (*rotatingWriter, error) {
+// newRotatingWriter creates a rotatingWriter for filename using the rotation
+// and retention settings from cfg:
+//   - LogRotateSizeMB   — per-file size threshold
+//   - LogRotateInterval — per-file age threshold (0 = size-only rotation)
+//   - MaxFileRetention  — max retained .gz archives (0 = unlimited)
+//   - LogMaxAge         — max age of rotated files (0 = no age limit)
+//   - CompressQueueSize — rotated files that may wait for compression
+//   - LogFileMode       — permissions of the log files (octal, default 0644)
+//   - LogDirMode        — permissions of a missing log directory, which is
+//     created along with its parents (octal, default 0755)
+//   - LogRotateMode     — "rename" (default) or "copytruncate"
+//   - LogBufferBytes    — write buffer size (0 = one write per entry)
+//   - LogFlushInterval  — how often a buffered writer flushes (0 = only
+//     when the buffer fills, on rotation, and on Close)
+//
+// An invalid mode string is returned as an error so startup fails.
+func newRotatingWriter(filename string, cfg Config) (*rotatingWriter, error) {
+	queue := cfg.CompressQueueSize
+	if queue <= 0 {
+		queue = 1
+	}
+	fileMode, err := parseFileMode("LOG_FILE_MODE", cfg.LogFileMode, 0644)
+	if err != nil {
+		return nil, err
+	}
+	dirMode, err := parseFileMode("LOG_DIR_MODE", cfg.LogDirMode, 0755)
+	if err != nil {
+		return nil, err
+	}
+	copyTruncate, err := parseRotateMode(cfg.LogRotateMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), dirMode); err != nil {
+		return nil, fmt.Errorf("create log directory: %w", err)
+	}
 	w := &rotatingWriter{
-		filename:      filename,
-		maxSize:       maxSizeMB * 1024 * 1024,
-		fileRetention: fileRetention,
+		filename:       filename,
+		maxSize:        cfg.LogRotateSizeMB * 1024 * 1024,
+		rotateInterval: cfg.LogRotateInterval,
+		fileRetention:  cfg.MaxFileRetention,
+		maxAge:         cfg.LogMaxAge,
+		compressCh:     make(chan string, queue),
+		compressDone:   make(chan struct{}),
+		fileMode:       fileMode,
+		copyTruncate:   copyTruncate,
+	}
+	if cfg.LogStartupBanner {
+		w.banner = func() []byte { return startupBanner(cfg) }
+	}
+	if cfg.LogBufferBytes > 0 {
+		w.buf = bufio.NewWriterSize(nil, cfg.LogBufferBytes)
 	}
 	if err := w.openFile(); err != nil {
 		return nil, err
 	}
+	go w.compressWorker()
+	if w.buf != nil && cfg.LogFlushInterval > 0 {
+		w.flushStop = make(chan struct{})
+		w.flushDone = make(chan struct{})
+		go w.flusher(cfg.LogFlushInterval)
+	}
 	return w, nil
 }
 
+// flusher writes buffered entries to the file every interval until Close.
+func (w *rotatingWriter) flusher(interval time.Duration) {
+	defer close(w.flushDone)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			w.mu.Lock()
+			if w.file != nil {
+				if err := w.flushLocked(); err != nil {
+					slog.Error("log flush error", "file", w.filename, "err", err)
+				}
+			}
+			w.mu.Unlock()
+		case <-w.flushStop:
+			return
+		}
+	}
+}
+
+// flushLocked writes any buffered entries to the active file. bufio.Writer
+// errors are sticky, so on failure the unwritten bytes are dropped and the
+// buffer is reset, letting later entries through once the file recovers.
+// w.mu must be held.
+func (w *rotatingWriter) flushLocked() error {
+	if w.buf == nil || w.buf.Buffered() == 0 {
+		return nil
+	}
+	err := w.buf.Flush()
+	if err != nil {
+		w.buf.Reset(w.file)
+	}
+	return err
+}
+
+// out is where entries are written: the buffer when there is one, else the
+// file. w.mu must be held.
+func (w *rotatingWriter) out() io.Writer {
+	if w.buf != nil {
+		return w.buf
+	}
+	return w.file
+}
+
+// compressWorker compresses queued rotated files one at a time and enforces
+// retention after each. It exits once compressCh is closed and drained.
+func (w *rotatingWriter) compressWorker() {
+	defer close(w.compressDone)
+	for rotated := range w.compressCh {
+		compressAndPrune(rotated, w.filename, w.fileMode, w.fileRetention, w.maxAge)
+	}
+}
+
 // openFile opens (or creates) the active log file in append mode and records
 // its current size so the rotation threshold is accurate even across restarts.
+// A fresh (empty) file starts with the startup banner when one is configured.
+// A file created here is chmod-ed to fileMode so the umask cannot narrow or
+// widen it; an existing file keeps its permissions. The write buffer, which
+// the caller must have flushed, is pointed at the new file.
 func (w *rotatingWriter) openFile() error {
-	f, err := os.OpenFile(w.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	_, statErr := os.Stat(w.filename)
+	f, err := os.OpenFile(w.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, w.fileMode)
 	if err != nil {
 		return err
 	}
+	if errors.Is(statErr, fs.ErrNotExist) {
+		if err := f.Chmod(w.fileMode); err != nil {
+			slog.Warn("log file: chmod failed", "file", w.filename, "err", err)
+		}
+	}
 	fi, err := f.Stat()
 	if err != nil {
 		f.Close()
 		return err
 	}
 	w.file = f
+	if w.buf != nil {
+		w.buf.Reset(f)
+	}
 	w.size = fi.Size()
+	w.bannerSize = 0
+	w.openedAt = time.Now()
+	if w.size == 0 && w.banner != nil {
+		n, err := f.Write(w.banner())
+		w.size += int64(n)
+		w.bannerSize = int64(n)
+		if err != nil {
+			slog.Warn("log file: writing startup banner failed", "file", w.filename, "err", err)
+		}
+	}
 	return nil
 }
 
-// rotate closes the active file, renames it, then hands the renamed path to
-// a background goroutine for compression and retention enforcement.
-func (w *rotatingWriter) rotate() error {
-	if w.file != nil {
-		w.file.Close()
-		w.file = nil
+// copyTruncateTo copies the active file to rotated and truncates it in place
+// (LOG_ROTATE_MODE=copytruncate), for shippers that follow the log by path and
+// lose their place when the inode changes. The open handle is kept, and since
+// w.mu is held no entry can land between the copy and the truncate. The copy
+// runs on the Write path, so large LOG_ROTATE_SIZE_MB values make rotation
+// correspondingly slower than a rename.
+func (w *rotatingWriter) copyTruncateTo(rotated string) error {
+	if err := copyFile(w.filename, rotated, w.fileMode); err != nil {
+		os.Remove(rotated)
+		return fmt.Errorf("copy: %w", err)
+	}
+	if err := w.file.Truncate(0); err != nil {
+		// The copy holds everything so far; drop it rather than duplicate it.
+		os.Remove(rotated)
+		return fmt.Errorf("truncate: %w", err)
+	}
+	w.size = 0
+	w.bannerSize = 0
+	w.openedAt = time.Now()
+	if w.banner != nil {
+		n, err := w.file.Write(w.banner())
+		w.size += int64(n)
+		w.bannerSize = int64(n)
+		if err != nil {
+			slog.Warn("log file: writing startup banner failed", "file", w.filename, "err", err)
+		}
+	}
+	return nil
+}
+
+// rotatedNameTaken reports whether rotated exists, raw or compressed.
+func rotatedNameTaken(rotated string) bool {
+	for _, name := range []string{rotated, rotated + ".gz"} {
+		if _, err := os.Lstat(name); err == nil {
+			return true
+		}
 	}
+	return false
+}
 
-	// Build the rotated filename: base + timestamp suffix (no extension yet).
-	rotated := w.filename + "." + time.Now().Format("20060102-150405")
-	if err := os.Rename(w.filename, rotated); err != nil {
-		// If rename fails (e.g. cross-device), still open a new file so logging
-		// continues; the old data is not lost — just not archived.
-		slog.Warn("log rotate: rename failed", "err", err)
-		return w.openFile()
+// copyFile copies src to a new file dst created with mode and synced to disk.
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if err := out.Chmod(mode); err != nil {
+		slog.Warn("log rotate: chmod copy failed", "file", dst, "err", err)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
 	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
 
-	// Open the fresh active log file immediately so the Write() caller is never
-	// blocked waiting for compression to finish.
+// parseRotateMode maps LOG_ROTATE_MODE to whether copytruncate is used.
+// Empty means "rename".
+func parseRotateMode(raw string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "", "rename":
+		return false, nil
+	case "copytruncate":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid LOG_ROTATE_MODE %q (want rename or copytruncate)", raw)
+	}
+}
+
+// parseFileMode parses an octal permission string such as "0640", "640", or
+// "0o640" for the env var name. Empty means def. Values with bits outside
+// 0777 are rejected.
+func parseFileMode(name, raw string, def os.FileMode) (os.FileMode, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(raw), "0o"), 8, 32)
+	if err != nil || n > 0o777 {
+		return 0, fmt.Errorf("invalid %s %q (want an octal mode such as 0640)", name, raw)
+	}
+	return os.FileMode(n), nil
+}
+
+// Reopen closes the active file and opens filename afresh, for use after an
+// external logrotate has renamed it (SIGHUP). The new handle is opened before
+// the old one is closed, so a failed reopen leaves the old file in use.
+func (w *rotatingWriter) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return os.ErrClosed
+	}
+	if err := w.flushLocked(); err != nil {
+		slog.Error("log flush before reopen failed", "file", w.filename, "err", err)
+	}
+	old := w.file
 	if err := w.openFile(); err != nil {
 		return err
 	}
+	old.Close()
+	slog.Info("log file reopened", "file", w.filename, "size", w.size)
+	return nil
+}
+
+// processStart is when the process started; it is reported in the startup
+// banner so a banner written after rotation still says when the server began.
+var processStart = time.Now()
 
-	// Compress and enforce retention asynchronously.
-	filename := w.filename
-	maxOld := w.fileRetention
-	go compressAndPrune(rotated, filename, maxOld)
+// startupBanner returns the LOG_STARTUP_BANNER line written at the top of
+// every fresh log file: an "event":"startup" record with the version, PID,
+// ISTag, and a snapshot of the settings that shape the entries that follow.
+// Transaction entries never carry "event", so consumers can filter on it.
+// Both timestamps follow TIMESTAMP_FORMAT and TIMEZONE, like entry timestamps.
+// Destinations and credentials (webhook URL, TLS paths) are left out.
+func startupBanner(cfg Config) []byte {
+	banner := map[string]any{
+		"event":      "startup",
+		"timestamp":  formatTimestamp(time.Now(), cfg.TimestampFormat, cfg.Timezone),
+		"started_at": formatTimestamp(processStart, cfg.TimestampFormat, cfg.Timezone),
+		"version":    version,
+		"commit":     commit,
+		"build_date": buildDate,
+		"pid":        os.Getpid(),
+		"istag":      cfg.ISTag,
+		"config": map[string]any{
+			"icap_port":       cfg.Port,
+			"log_sink":        cfg.LogSink,
+			"log_split_by":    cfg.LogSplitBy,
+			"log_req_body":    cfg.LogReqBody,
+			"log_resp_body":   cfg.LogRespBody,
+			"max_body_size":   cfg.MaxBodySize,
+			"redact_tokens":   cfg.RedactTokens,
+			"redact_auth":     cfg.RedactAuthHeader,
+			"split_entries":   cfg.SplitEntries,
+			"keep_alive":      cfg.KeepAlive,
+			"preview_size":    cfg.PreviewSize,
+			"header_key_case": cfg.HeaderKeyCase,
+		},
+	}
+	data, _ := json.Marshal(banner)
+	return append(data, '\n')
+}
+
+// rotate moves the active file's contents to a timestamped file, then hands
+// that path to the compression worker for compression and retention
+// enforcement. w.mu must be held.
+//
+// w.file is never nil while rotating: in rename mode the new file is opened
+// before the old handle is closed, and in copytruncate mode the handle is kept.
+// On failure the current file stays active and the error is returned, so
+// writes continue and the rotation is retried on the next Write.
+func (w *rotatingWriter) rotate() error {
+	// Build the rotated filename: base + timestamp suffix (no extension yet).
+	rotated := w.filename + "." + time.Now().Format(rotatedTimeFormat)
+	if rotatedNameTaken(rotated) {
+		// Already rotated within this second; renaming now would overwrite
+		// that file, so keep writing and rotate on a later Write.
+		return nil
+	}
+	// Buffered entries belong to the file being rotated out.
+	if err := w.flushLocked(); err != nil {
+		return fmt.Errorf("flush: %w", err)
+	}
+	if w.copyTruncate {
+		if err := w.copyTruncateTo(rotated); err != nil {
+			return err
+		}
+	} else {
+		old := w.file
+		if err := os.Rename(w.filename, rotated); err != nil {
+			// e.g. cross-device: keep appending to the current file.
+			return fmt.Errorf("rename: %w", err)
+		}
+		// Open the fresh active log file immediately so the Write() caller is
+		// never blocked waiting for compression to finish.
+		if err := w.openFile(); err != nil {
+			// Put the file back so the active path and handle agree again.
+			if rerr := os.Rename(rotated, w.filename); rerr != nil {
+				slog.Error("log rotate: restoring active file failed", "file", rotated, "err", rerr)
+			}
+			return fmt.Errorf("open new file: %w", err)
+		}
+		old.Close()
+	}
+
+	w.lastRotated = time.Now()
+
+	// Compress and enforce retention asynchronously. The send never blocks:
+	// when the queue is full the rotated file is left uncompressed (it still
+	// counts towards both retention limits) rather than stalling the writer.
+	select {
+	case w.compressCh <- rotated:
+	default:
+		slog.Warn("log rotate: compression queue full, leaving file uncompressed",
+			"file", rotated, "queue_size", cap(w.compressCh))
+		// Retention still applies, or skipped rotations would pile up.
+		pruneRotated(w.filename, w.fileRetention, w.maxAge)
+	}
 
 	return nil
 }
 
-// Write implements io.Writer. It rotates the file when the size threshold is
-// reached, then writes p to the active file.
+// Write implements io.Writer. It rotates the file when the size threshold or
+// the rotation interval is reached, then writes p to the active file.
+// Interval rotation is checked lazily here rather than on a ticker, so an idle
+// server rotates on its next write; a file holding no entries (empty, or
+// just the startup banner) is never rotated.
 // A newline is appended if p does not already end with one so each log entry
 // occupies exactly one line (matching the behaviour of log.Logger.Println).
 func (w *rotatingWriter) Write(p []byte) (n int, err error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	if w.size+int64(len(p)) > w.maxSize && w.size > 0 {
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	if w.size > w.bannerSize && (w.size+int64(len(p)) > w.maxSize || w.intervalElapsed()) {
 		if err := w.rotate(); err != nil {
-			return 0, err
+			// Logging must not stop over a failed rotation: the entry goes to
+			// the current file and rotation is retried on the next Write.
+			slog.Warn("log rotate failed, continuing in the active file", "file", w.filename, "err", err)
 		}
 	}
-	n, err = w.file.Write(p)
+	out := w.out()
+	n, err = out.Write(p)
 	w.size += int64(n)
 	if err == nil && (len(p) == 0 || p[len(p)-1] != '\n') {
 		nl := []byte{'\n'}
-		nn, nerr := w.file.Write(nl)
+		nn, nerr := out.Write(nl)
 		w.size += int64(nn)
-		if nerr != nil {
-			return n, nerr
-		}
+		err = nerr
+	}
+	if err != nil && w.buf != nil {
+		w.buf.Reset(w.file) // bufio errors are sticky; see flushLocked
 	}
 	return n, err
 }
 
-// Close flushes and closes the active log file.
-func (w *rotatingWriter) Close() error {
+// status returns the active file's size and when it was last rotated (zero
+// if never) for /stats.
+func (w *rotatingWriter) status() (size int64, lastRotated time.Time) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if w.file != nil {
-		return w.file.Close()
-	}
-	return nil
+	return w.size, w.lastRotated
+}
+
+// intervalElapsed reports whether the active file has been open for at least
+// rotateInterval. Always false when interval rotation is disabled.
+func (w *rotatingWriter) intervalElapsed() bool {
+	return w.rotateInterval > 0 && time.Since(w.openedAt) >= w.rotateInterval
+}
+
+// Close flushes buffered entries and closes the active log file, then waits
+// for the compression worker to finish every queued rotation so shutdown
+// never leaves a half-written .gz. It is safe to call more than once.
+func (w *rotatingWriter) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		if w.flushStop != nil {
+			close(w.flushStop)
+			<-w.flushDone
+		}
+		w.mu.Lock()
+		if w.file != nil {
+			err = w.flushLocked()
+			if cerr := w.file.Close(); err == nil {
+				err = cerr
+			}
+			w.file = nil
+		}
+		close(w.compressCh)
+		w.mu.Unlock()
+		<-w.compressDone
+	})
+	return err
 }
 
 // startLogWriter starts a single dedicated goroutine that drains logCh and
-// writes each pre-serialised JSON line to w.  This eliminates the double-mutex
-// acquisition that occurred when log.Logger (internal mutex) wrapped
+// writes each pre-serialised JSON line to the sink w.  This eliminates the
+// double-mutex acquisition that occurred when log.Logger (internal mutex) wrapped
 // rotatingWriter (its own mutex), and removes the log.Logger fmt.Appendf
 // allocation from every goroutine's hot path.
 //
@@ -139,48 +519,63 @@ func (w *rotatingWriter) Close() error {
 // should send on it inside their own goroutine (which they already do for
 // async logging).  The channel is closed by the caller (main) on shutdown,
 // which causes the writer goroutine to drain and exit cleanly.
-func startLogWriter(w *rotatingWriter) chan<- []byte {
+//
+// The returned done channel is closed once ch has been closed and every queued
+// entry written, so shutdown can wait for the backlog before closing w.
+func startLogWriter(w logSink) (chan<- []byte, <-chan struct{}) {
 	ch := make(chan []byte, 512) // 512-entry buffer absorbs bursts without blocking goroutines
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		for data := range ch {
 			if _, err := w.Write(data); err != nil {
 				slog.Error("log write error", "err", err)
+			} else {
+				bytesLogged.Add(int64(len(data)))
 			}
 		}
 	}()
-	return ch
+	return ch, done
 }
 
 // ── background helpers ────────────────────────────────────────────────────────
 
 // compressAndPrune compresses src to src+".gz", deletes src, then enforces
-// the fileRetention limit by removing the oldest .gz archives.
+// the fileRetention limit by removing the oldest rotated files and the maxAge
+// limit by removing rotated files older than maxAge. Retention is enforced
+// even when compression fails, so raw files cannot pile up.
 //
 // Parameters:
 //   - src           — the just-rotated raw log file (e.g. /var/log/icap/icap_logger.log.20260311-165838)
 //   - baseName      — the active log file path, used to derive the archive glob
+//   - mode          — permissions given to the archive (LOG_FILE_MODE)
 //   - fileRetention — max number of .gz files to keep (0 = unlimited)
-func compressAndPrune(src, baseName string, fileRetention int) {
+//   - maxAge        — max age of rotated files by timestamp suffix (0 = unlimited)
+func compressAndPrune(src, baseName string, mode os.FileMode, fileRetention int, maxAge time.Duration) {
 	gz := src + ".gz"
 
 	if err := compressFile(src, gz); err != nil {
-		slog.Error("log rotate: compression failed", "src", src, "err", err)
 		// Keep the uncompressed file — do not delete it.
-		return
-	}
-
-	// Remove the uncompressed original only after successful compression.
-	if err := os.Remove(src); err != nil {
-		slog.Warn("log rotate: could not remove uncompressed file after compression",
-			"file", src, "err", err)
+		slog.Error("log rotate: compression failed", "src", src, "err", err)
+	} else {
+		if err := os.Chmod(gz, mode); err != nil {
+			slog.Warn("log rotate: chmod archive failed", "archive", gz, "err", err)
+		}
+		// Remove the uncompressed original only after successful compression.
+		if err := os.Remove(src); err != nil {
+			slog.Warn("log rotate: could not remove uncompressed file after compression",
+				"file", src, "err", err)
+		}
+		slog.Info("log rotate: compressed", "archive", gz)
 	}
+	pruneRotated(baseName, fileRetention, maxAge)
+}
 
-	slog.Info("log rotate: compressed", "archive", gz)
-
-	if fileRetention <= 0 {
-		return
-	}
+// pruneRotated enforces both retention limits on the rotated files of
+// baseName.
+func pruneRotated(baseName string, fileRetention int, maxAge time.Duration) {
 	pruneOldArchives(baseName, fileRetention)
+	pruneExpiredArchives(baseName, maxAge, time.Now())
 }
 
 // compressFile reads src, writes a gzip-compressed copy to dst, and syncs
@@ -219,36 +614,20 @@ func compressFile(src, dst string) error {
 	return out.Close()
 }
 
-// pruneOldArchives lists all .gz archives whose names start with the base log
-// filename, sorts them oldest-first by name (the timestamp suffix makes
-// lexicographic order == chronological order), and removes files beyond
-// the fileRetention limit.
+// pruneOldArchives lists the rotated files of the base log filename, .gz
+// archives and raw files left uncompressed alike, sorts them oldest-first by
+// name (the timestamp suffix makes lexicographic order == chronological
+// order), and removes files beyond the fileRetention limit.
 func pruneOldArchives(baseName string, fileRetention int) {
 	// 0 means unlimited — never prune.
 	if fileRetention <= 0 {
 		return
 	}
-	dir := filepath.Dir(baseName)
-	base := filepath.Base(baseName)
-
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		slog.Warn("log rotate: could not read log directory for pruning",
-			"dir", dir, "err", err)
-		return
-	}
-
-	// Collect all compressed archive files that belong to this log.
-	// Pattern: <base>.<timestamp>.gz  e.g. icap_logger.log.20260311-165838.gz
+	// Collect all rotated files that belong to this log.
+	// Pattern: <base>.<timestamp>[.gz]  e.g. icap_logger.log.20260311-165838.gz
 	var archives []string
-	for _, e := range entries {
-		name := e.Name()
-		if e.IsDir() {
-			continue
-		}
-		if strings.HasPrefix(name, base+".") && strings.HasSuffix(name, ".gz") {
-			archives = append(archives, filepath.Join(dir, name))
-		}
+	for _, rf := range listRotatedFiles(baseName) {
+		archives = append(archives, rf.path)
 	}
 
 	if len(archives) <= fileRetention {
@@ -269,3 +648,76 @@ func pruneOldArchives(baseName string, fileRetention int) {
 		}
 	}
 }
+
+// rotatedTimeFormat is the timestamp suffix rotate() appends to the log name.
+const rotatedTimeFormat = "20060102-150405"
+
+// rotatedFile describes one rotated log file found next to the active log.
+type rotatedFile struct {
+	path       string
+	rotatedAt  time.Time // parsed from the timestamp suffix, local time
+	compressed bool      // true for <base>.<timestamp>.gz
+}
+
+// listRotatedFiles returns the rotated files belonging to baseName, i.e. names
+// of the exact form <base>.<YYYYMMDD-HHMMSS> or <base>.<YYYYMMDD-HHMMSS>.gz.
+// Anything else in the directory — the active log itself, other logs sharing
+// the prefix, editor backups, operator notes — is ignored so retention can
+// never delete a file it did not create.
+func listRotatedFiles(baseName string) []rotatedFile {
+	dir := filepath.Dir(baseName)
+	base := filepath.Base(baseName)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Warn("log rotate: could not read log directory for pruning",
+			"dir", dir, "err", err)
+		return nil
+	}
+
+	var files []rotatedFile
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		suffix, ok := strings.CutPrefix(name, base+".")
+		if !ok {
+			continue
+		}
+		suffix, compressed := strings.CutSuffix(suffix, ".gz")
+		ts, err := time.ParseInLocation(rotatedTimeFormat, suffix, time.Local)
+		if err != nil {
+			continue
+		}
+		files = append(files, rotatedFile{
+			path:       filepath.Join(dir, name),
+			rotatedAt:  ts,
+			compressed: compressed,
+		})
+	}
+	return files
+}
+
+// pruneExpiredArchives removes rotated files (compressed or not) whose
+// timestamp suffix is older than maxAge relative to now. maxAge <= 0 disables
+// age-based retention. Uncompressed files are included so that raw files left
+// behind by a failed compression do not accumulate forever.
+func pruneExpiredArchives(baseName string, maxAge time.Duration, now time.Time) {
+	if maxAge <= 0 {
+		return
+	}
+	cutoff := now.Add(-maxAge)
+	for _, rf := range listRotatedFiles(baseName) {
+		if !rf.rotatedAt.Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(rf.path); err != nil {
+			slog.Warn("log rotate: could not remove expired archive",
+				"file", rf.path, "err", err)
+		} else {
+			slog.Info("log rotate: removed expired archive",
+				"file", rf.path, "rotated_at", rf.rotatedAt.Format(time.RFC3339))
+		}
+	}
+}
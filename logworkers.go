@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+)
+
+// logWorkerLimit caps the asynchronous log goroutines that serveICAPMessage
+// starts after answering each message (LOG_WORKERS). Parsing and encoding an
+// entry holds the whole ICAP message in memory, so without a cap a burst of
+// large messages can pile up goroutines faster than the sink drains them.
+//
+// At the cap, LOG_WORKER_MODE=block (the default) makes the connection wait
+// for a free worker before it reads its next message — back-pressure on the
+// ICAP client — while drop skips logging the transaction. Every time the cap
+// is hit icap_log_workers_saturated_total is incremented; dropped
+// transactions are also counted in icap_log_workers_dropped_total.
+type logWorkerLimit struct {
+	sem  chan struct{} // nil when unlimited
+	drop bool
+}
+
+// logWorkers is the process-wide limit; main replaces it from the config.
+var logWorkers = newLogWorkerLimit(0, "")
+
+// newLogWorkerLimit returns a limit of size workers; size <= 0 is unlimited.
+// mode is "block" or "drop" (case-insensitive); anything else blocks.
+func newLogWorkerLimit(size int, mode string) *logWorkerLimit {
+	l := &logWorkerLimit{drop: strings.EqualFold(mode, "drop")}
+	if size > 0 {
+		l.sem = make(chan struct{}, size)
+	}
+	return l
+}
+
+// acquire reserves a worker slot. It returns false only in drop mode when
+// every slot is taken; the caller must then not start a worker.
+func (l *logWorkerLimit) acquire() bool {
+	if l.sem == nil {
+		return true
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+	}
+	logWorkersSaturated.Add(1)
+	if l.drop {
+		logWorkersDropped.Add(1)
+		slog.Warn("log worker limit reached, dropping entry", "limit", cap(l.sem))
+		return false
+	}
+	l.sem <- struct{}{}
+	return true
+}
+
+// release frees a slot reserved by acquire.
+func (l *logWorkerLimit) release() {
+	if l.sem != nil {
+		<-l.sem
+	}
+}
@@ -3,34 +3,92 @@
 //
 // Usage:
 //
-//	./icap-logger [--port=PORT] [--log=PATH] [--log-rotate-size=MB]
+//	./icap-logger [--port=PORT] [--log=PATH] [--log-rotate-size=MB] [--stdout]
+//	./icap-logger --version
+//	./icap-logger --selftest
 package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// Build metadata. Release builds set these with
+//
+//	-ldflags "-X main.version=<version> -X main.commit=<git sha> -X main.buildDate=<RFC 3339>"
+//
+// They are printed by --version, logged at startup, and feed the default ISTag.
+var (
+	version   = "1.0"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
 func main() {
+	// --version is handled before anything else so that it works without
+	// the configuration being valid or the log file being writable.
+	if versionRequested(os.Args[1:]) {
+		fmt.Println(versionString())
+		return
+	}
 	cfg := loadConfig()
+	// --selftest is a client of an already running server: it only dials
+	// the configured port and prints the result.
+	if selftestRequested(os.Args[1:]) {
+		os.Exit(selftestCommand(cfg))
+	}
+	// "replay" runs captured messages through the parser offline; it opens
+	// no listener or log file and keeps stdout for the entries.
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, nil)))
+		os.Exit(replayCommand(os.Args[2:], cfg))
+	}
 
-	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+	slog.SetDefault(slog.New(slog.NewJSONHandler(stdout, &slog.HandlerOptions{
 		Level: slog.LevelInfo,
 	})))
+	if err := validateConfig(cfg); err != nil {
+		slog.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+	slog.Info("effective configuration", "config", effectiveConfig(cfg))
 
-	logWriter, err := newRotatingWriter(cfg.LogFile, cfg.LogRotateSizeMB, cfg.MaxFileRetention)
+	logWriter, err := openLogSink(cfg)
 	if err != nil {
-		slog.Error("failed to open log file", "path", cfg.LogFile, "err", err)
+		slog.Error("failed to open log sink", "sink", cfg.LogSink, "path", cfg.LogFile, "err", err)
 		os.Exit(1)
 	}
 
-	icapLogger := startLogWriter(logWriter)
+	icapLogger, logWriterDone := startLogWriter(logWriter)
+	logSampler = newSampler(cfg.LogSampleSeed)
+	logWorkers = newLogWorkerLimit(cfg.LogWorkers, cfg.LogWorkerMode)
+	logDeduper = newEntryDeduper(cfg.LogDedupWindow, func(entry logEntry, logCh chan<- []byte) {
+		emitLogEntry(entry, cfg, logCh)
+	})
+	if cfg.DebugRawCapture {
+		rawCaptures, err = newRawCapture(cfg)
+		if err != nil {
+			slog.Error("failed to open raw capture file", "path", cfg.DebugCaptureFile, "err", err)
+			os.Exit(1)
+		}
+		slog.Warn("DEBUG_RAW_CAPTURE is on: unredacted ICAP messages are written to the capture file",
+			"path", cfg.DebugCaptureFile, "sample_rate", cfg.DebugCaptureRate)
+	}
+	if len(cfg.GeoIPDBs) > 0 {
+		if geo := newGeoEnricher(cfg); geo != nil {
+			registerRequestHook(geo)
+			slog.Info("GeoIP enrichment enabled", "databases", len(geo.dbs))
+		}
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
@@ -42,55 +100,145 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte(`{"status":"ok"}`))
 	})
-	healthSrv := &http.Server{Addr: ":" + cfg.HealthPort, Handler: healthMux}
+	if cfg.MetricsEnabled {
+		healthMux.HandleFunc("/metrics", metricsHandler)
+	}
+	if cfg.StatsEnabled {
+		healthMux.HandleFunc("/stats", statsHandler(logWriter))
+	}
+	if cfg.RecentBufferSize > 0 {
+		recentEntries = newRecentBuffer(cfg.RecentBufferSize)
+		healthMux.HandleFunc("/recent", recentHandler(recentEntries, cfg.LogKeyAllowlist))
+	}
+	healthSrv := &http.Server{Addr: listenAddr(cfg.HealthBindAddr, cfg.HealthPort), Handler: healthMux}
 	go func() {
-		slog.Info("health check listening", "port", cfg.HealthPort)
+		slog.Info("health check listening", "addr", healthSrv.Addr)
 		if err := healthSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			slog.Error("health server error", "err", err)
 		}
 	}()
 
-	ln, err := net.Listen("tcp", ":"+cfg.Port)
+	// Validate TLS before opening the port so a half-configured keypair fails
+	// fast instead of silently serving plaintext.
+	tlsCfg, err := icapTLSConfig(cfg)
 	if err != nil {
-		slog.Error("failed to listen", "port", cfg.Port, "err", err)
+		slog.Error("invalid ICAP TLS configuration", "cert", cfg.TLSCert, "key", cfg.TLSKey, "err", err)
 		os.Exit(1)
 	}
 
+	listeners, err := openListeners(cfg, tlsCfg, icapLogger)
+	if err != nil {
+		slog.Error("failed to start ICAP listeners", "err", err)
+		os.Exit(1)
+	}
+
+	// SIGHUP reopens the log file(s), so an external logrotate can rename
+	// them and signal us instead of relying on the built-in rotation.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			slog.Info("SIGHUP received, reopening log files")
+			if err := errors.Join(reopenSink(logWriter), reopenListenerSinks(listeners)); err != nil {
+				slog.Error("log reopen failed", "err", err)
+			}
+		}
+	}()
+
 	slog.Info("ICAP logger started",
-		"icap_port", cfg.Port,
+		"version", version,
+		"commit", commit,
+		"build_date", buildDate,
+		"icap_port", listeners[0].Port,
+		"icap_addr", listeners[0].ln.Addr().String(),
+		"icap_tls", tlsCfg != nil,
+		"icap_mtls", tlsCfg != nil && tlsCfg.ClientCAs != nil,
 		"health_port", cfg.HealthPort,
+		"log_sink", cfg.LogSink,
 		"log_file", cfg.LogFile,
 		"log_rotate_size_mb", cfg.LogRotateSizeMB,
 		"max_body_size", cfg.MaxBodySize,
 		"read_timeout", cfg.ReadTimeout.String(),
 	)
 
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					slog.Warn("accept error", "err", err)
-					continue
-				}
-			}
-			go handleConn(conn, icapLogger, cfg)
+	for _, l := range listeners {
+		if len(listeners) > 1 {
+			slog.Info("ICAP listener started", "addr", l.ln.Addr().String(),
+				"service", l.Service, "log_file", l.LogFile)
 		}
-	}()
+		go serveListener(ctx, l.ln, l.logCh, l.cfg)
+	}
 
 	<-ctx.Done()
 	slog.Info("shutdown signal received, draining...")
-	_ = ln.Close()
+	for _, l := range listeners {
+		_ = l.ln.Close()
+	}
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
 	defer cancel()
 	_ = healthSrv.Shutdown(shutdownCtx)
 
-	// Close the log channel — the writer goroutine will drain it then exit.
-	close(icapLogger)
+	// Wait for in-flight handlers (and their log goroutines) on every
+	// listener so clients get their responses and the last entries are
+	// queued. Idle keep-alive connections count too and end at
+	// READ_TIMEOUT_SEC at the latest.
+	drained := make(chan struct{})
+	go func() {
+		activeHandlers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		logDeduper.flush()
+		// Close the log channels — the writer goroutines drain them then exit.
+		close(icapLogger)
+		<-logWriterDone
+		for _, l := range listeners {
+			l.closeSink()
+		}
+	case <-time.After(cfg.DrainTimeout):
+		// Stragglers may still send, so the channel stays open; entries they
+		// produce after the sink is closed are reported as write errors.
+		slog.Warn("drain timeout reached, abandoning in-flight connections",
+			"timeout", cfg.DrainTimeout.String(), "active_connections", activeConns.Load())
+		logDeduper.flush()
+		for _, l := range listeners {
+			if l.sink != nil {
+				_ = l.sink.Close()
+			}
+		}
+	}
 	_ = logWriter.Close()
+	_ = rawCaptures.Close()
 	slog.Info("shutdown complete")
 }
+
+// versionRequested reports whether args ask for the version (--version or
+// -version).
+func versionRequested(args []string) bool {
+	for _, arg := range args {
+		if arg == "--version" || arg == "-version" {
+			return true
+		}
+	}
+	return false
+}
+
+// versionString is the --version output, e.g.
+// "icap-logger 1.2.0 (commit 3f2a9c1, built 2026-05-01T10:00:00Z)".
+func versionString() string {
+	return fmt.Sprintf("icap-logger %s (commit %s, built %s)", version, commit, buildDate)
+}
+
+// listenAddr joins a bind address (ICAP_BIND_ADDR, HEALTH_BIND_ADDR) and a
+// port into a listen address. An empty bind address listens on all
+// interfaces; IPv6 literals may be given with or without brackets
+// ("::1" or "[::1]").
+func listenAddr(bind, port string) string {
+	bind = strings.TrimSpace(bind)
+	if strings.HasPrefix(bind, "[") && strings.HasSuffix(bind, "]") {
+		bind = bind[1 : len(bind)-1]
+	}
+	return net.JoinHostPort(bind, port)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Process-wide metrics exported on /metrics. The connection gauges are updated
+// with atomic adds in handleConn (increment on entry, deferred decrement on
+// exit) so they stay accurate on early returns and recovered panics alike.
+var (
+	// activeConns is the number of ICAP connections currently inside handleConn.
+	activeConns atomic.Int64
+	// inflightBytes is the number of ICAP message bytes currently held: from
+	// readICAPMessage returning until the handler and the asynchronous log
+	// goroutine parsing the message have both finished with it.
+	inflightBytes atomic.Int64
+	// webhookDropped counts log entries the webhook sink dropped because its
+	// buffer was full or delivery failed after all retries.
+	webhookDropped atomic.Int64
+	// gcpDropped counts log entries the Cloud Logging sink dropped because its
+	// buffer was full or entries:write failed.
+	gcpDropped atomic.Int64
+	// connLimitHits counts accepted connections that found all
+	// MAX_CONCURRENT_CONNS slots taken (and were delayed or rejected).
+	connLimitHits atomic.Int64
+	// workerQueueFull counts accepted connections that found the
+	// WORKER_QUEUE_SIZE queue full (and were delayed or rejected).
+	workerQueueFull atomic.Int64
+	// fallbackWritten counts entries copied to stderr by FALLBACK_STDERR after
+	// the primary sink failed; fallbackSuppressed counts those the rate limit
+	// (or a failing stderr) kept from being copied.
+	fallbackWritten    atomic.Int64
+	fallbackSuppressed atomic.Int64
+	// allowlistDroppedKeys counts top-level entry keys removed because they
+	// are not in LOG_KEY_ALLOWLIST.
+	allowlistDroppedKeys atomic.Int64
+	// hostFiltered counts transactions not logged because their destination
+	// host failed LOG_INCLUDE_HOSTS / LOG_EXCLUDE_HOSTS.
+	hostFiltered atomic.Int64
+	// hostRedactionDropped counts transactions not logged because their
+	// destination host has the HOST_REDACTION "full" profile.
+	hostRedactionDropped atomic.Int64
+	// sampledOut counts transactions skipped by LOG_SAMPLE_RATE.
+	sampledOut atomic.Int64
+	// connsClosed, connMessages, and connDurationMs describe keep-alive reuse:
+	// connections finished, ICAP messages they served, and their summed
+	// lifetime. messages/closed is the mean reuse per connection.
+	connsClosed    atomic.Int64
+	connMessages   atomic.Int64
+	connDurationMs atomic.Int64
+	// logWorkersSaturated counts log goroutines that found LOG_WORKERS
+	// exhausted; logWorkersDropped those skipped under LOG_WORKER_MODE=drop.
+	logWorkersSaturated atomic.Int64
+	logWorkersDropped   atomic.Int64
+	// oversizeRejected counts messages answered with 413 for exceeding
+	// MAX_BODY_SIZE.
+	oversizeRejected atomic.Int64
+	// bodiesSpilled counts bodies written to BODY_SPILL_DIR; bodySpillErrors
+	// those that could not be and were logged inline instead.
+	bodiesSpilled   atomic.Int64
+	bodySpillErrors atomic.Int64
+	// rawCaptured counts messages written to the DEBUG_RAW_CAPTURE file.
+	rawCaptured atomic.Int64
+	// hookPanics counts request hook calls that panicked and were skipped.
+	hookPanics atomic.Int64
+	// invalidRequests counts messages rejected with 400 because their first
+	// line is not an ICAP request line.
+	invalidRequests atomic.Int64
+	// readTimeouts counts messages abandoned because the read deadline
+	// expired after some of the message had arrived.
+	readTimeouts atomic.Int64
+
+	// sinkErrors counts, per LOG_SINKS member, entries that member failed to
+	// write or had to drop because its queue was full.
+	sinkErrorsMu sync.Mutex
+	sinkErrors   = map[string]*atomic.Int64{}
+)
+
+// sinkErrorCounter returns the error counter for the named sink, creating it
+// on first use.
+func sinkErrorCounter(name string) *atomic.Int64 {
+	sinkErrorsMu.Lock()
+	defer sinkErrorsMu.Unlock()
+	c := sinkErrors[name]
+	if c == nil {
+		c = new(atomic.Int64)
+		sinkErrors[name] = c
+	}
+	return c
+}
+
+// writeMetrics writes the gauges to w in the Prometheus text exposition format.
+func writeMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP icap_active_connections ICAP connections currently being handled.\n")
+	fmt.Fprintf(w, "# TYPE icap_active_connections gauge\n")
+	fmt.Fprintf(w, "icap_active_connections %d\n", activeConns.Load())
+	fmt.Fprintf(w, "# HELP icap_inflight_bytes ICAP message bytes currently held in memory by handlers and log goroutines.\n")
+	fmt.Fprintf(w, "# TYPE icap_inflight_bytes gauge\n")
+	fmt.Fprintf(w, "icap_inflight_bytes %d\n", inflightBytes.Load())
+	fmt.Fprintf(w, "# HELP icap_webhook_dropped_entries_total Log entries dropped by the webhook sink.\n")
+	fmt.Fprintf(w, "# TYPE icap_webhook_dropped_entries_total counter\n")
+	fmt.Fprintf(w, "icap_webhook_dropped_entries_total %d\n", webhookDropped.Load())
+	fmt.Fprintf(w, "# HELP icap_gcp_dropped_entries_total Log entries dropped by the Cloud Logging sink.\n")
+	fmt.Fprintf(w, "# TYPE icap_gcp_dropped_entries_total counter\n")
+	fmt.Fprintf(w, "icap_gcp_dropped_entries_total %d\n", gcpDropped.Load())
+	fmt.Fprintf(w, "# HELP icap_conn_limit_hits_total Connections that arrived while MAX_CONCURRENT_CONNS was reached.\n")
+	fmt.Fprintf(w, "# TYPE icap_conn_limit_hits_total counter\n")
+	fmt.Fprintf(w, "icap_conn_limit_hits_total %d\n", connLimitHits.Load())
+	fmt.Fprintf(w, "# HELP icap_worker_queue_full_total Connections that arrived while the WORKER_COUNT queue was full.\n")
+	fmt.Fprintf(w, "# TYPE icap_worker_queue_full_total counter\n")
+	fmt.Fprintf(w, "icap_worker_queue_full_total %d\n", workerQueueFull.Load())
+	fmt.Fprintf(w, "# HELP icap_fallback_stderr_entries_total Log entries written to stderr after the primary sink failed.\n")
+	fmt.Fprintf(w, "# TYPE icap_fallback_stderr_entries_total counter\n")
+	fmt.Fprintf(w, "icap_fallback_stderr_entries_total %d\n", fallbackWritten.Load())
+	fmt.Fprintf(w, "# HELP icap_fallback_stderr_suppressed_total Failed log entries not written to stderr because of the rate limit.\n")
+	fmt.Fprintf(w, "# TYPE icap_fallback_stderr_suppressed_total counter\n")
+	fmt.Fprintf(w, "icap_fallback_stderr_suppressed_total %d\n", fallbackSuppressed.Load())
+	fmt.Fprintf(w, "# HELP icap_allowlist_dropped_keys_total Entry keys removed because they are not in LOG_KEY_ALLOWLIST.\n")
+	fmt.Fprintf(w, "# TYPE icap_allowlist_dropped_keys_total counter\n")
+	fmt.Fprintf(w, "icap_allowlist_dropped_keys_total %d\n", allowlistDroppedKeys.Load())
+	fmt.Fprintf(w, "# HELP icap_host_filtered_total Transactions not logged because of LOG_INCLUDE_HOSTS / LOG_EXCLUDE_HOSTS.\n")
+	fmt.Fprintf(w, "# TYPE icap_host_filtered_total counter\n")
+	fmt.Fprintf(w, "icap_host_filtered_total %d\n", hostFiltered.Load())
+	fmt.Fprintf(w, "# HELP icap_host_redaction_dropped_total Transactions not logged because of the HOST_REDACTION full profile.\n")
+	fmt.Fprintf(w, "# TYPE icap_host_redaction_dropped_total counter\n")
+	fmt.Fprintf(w, "icap_host_redaction_dropped_total %d\n", hostRedactionDropped.Load())
+	fmt.Fprintf(w, "# HELP icap_sampled_out_total Transactions not logged because of LOG_SAMPLE_RATE.\n")
+	fmt.Fprintf(w, "# TYPE icap_sampled_out_total counter\n")
+	fmt.Fprintf(w, "icap_sampled_out_total %d\n", sampledOut.Load())
+	fmt.Fprintf(w, "# HELP icap_connections_closed_total ICAP connections that have finished.\n")
+	fmt.Fprintf(w, "# TYPE icap_connections_closed_total counter\n")
+	fmt.Fprintf(w, "icap_connections_closed_total %d\n", connsClosed.Load())
+	fmt.Fprintf(w, "# HELP icap_connection_messages_total ICAP messages served by finished connections.\n")
+	fmt.Fprintf(w, "# TYPE icap_connection_messages_total counter\n")
+	fmt.Fprintf(w, "icap_connection_messages_total %d\n", connMessages.Load())
+	fmt.Fprintf(w, "# HELP icap_connection_duration_seconds_total Summed lifetime of finished connections.\n")
+	fmt.Fprintf(w, "# TYPE icap_connection_duration_seconds_total counter\n")
+	fmt.Fprintf(w, "icap_connection_duration_seconds_total %.3f\n", float64(connDurationMs.Load())/1000)
+	fmt.Fprintf(w, "# HELP icap_log_workers_saturated_total Transactions that found every LOG_WORKERS slot busy.\n")
+	fmt.Fprintf(w, "# TYPE icap_log_workers_saturated_total counter\n")
+	fmt.Fprintf(w, "icap_log_workers_saturated_total %d\n", logWorkersSaturated.Load())
+	fmt.Fprintf(w, "# HELP icap_log_workers_dropped_total Transactions not logged because LOG_WORKERS was saturated in drop mode.\n")
+	fmt.Fprintf(w, "# TYPE icap_log_workers_dropped_total counter\n")
+	fmt.Fprintf(w, "icap_log_workers_dropped_total %d\n", logWorkersDropped.Load())
+	fmt.Fprintf(w, "# HELP icap_oversize_rejected_total ICAP messages rejected with 413 for exceeding MAX_BODY_SIZE.\n")
+	fmt.Fprintf(w, "# TYPE icap_oversize_rejected_total counter\n")
+	fmt.Fprintf(w, "icap_oversize_rejected_total %d\n", oversizeRejected.Load())
+	fmt.Fprintf(w, "# HELP icap_bodies_spilled_total Bodies written to BODY_SPILL_DIR instead of inline.\n")
+	fmt.Fprintf(w, "# TYPE icap_bodies_spilled_total counter\n")
+	fmt.Fprintf(w, "icap_bodies_spilled_total %d\n", bodiesSpilled.Load())
+	fmt.Fprintf(w, "# HELP icap_body_spill_errors_total Bodies that could not be spilled and were logged inline.\n")
+	fmt.Fprintf(w, "# TYPE icap_body_spill_errors_total counter\n")
+	fmt.Fprintf(w, "icap_body_spill_errors_total %d\n", bodySpillErrors.Load())
+	fmt.Fprintf(w, "# HELP icap_raw_captured_total ICAP messages written to the DEBUG_RAW_CAPTURE file.\n")
+	fmt.Fprintf(w, "# TYPE icap_raw_captured_total counter\n")
+	fmt.Fprintf(w, "icap_raw_captured_total %d\n", rawCaptured.Load())
+	fmt.Fprintf(w, "# HELP icap_hook_panics_total Request hook calls that panicked and were skipped.\n")
+	fmt.Fprintf(w, "# TYPE icap_hook_panics_total counter\n")
+	fmt.Fprintf(w, "icap_hook_panics_total %d\n", hookPanics.Load())
+	fmt.Fprintf(w, "# HELP icap_invalid_requests_total Messages rejected with 400 because they are not ICAP requests.\n")
+	fmt.Fprintf(w, "# TYPE icap_invalid_requests_total counter\n")
+	fmt.Fprintf(w, "icap_invalid_requests_total %d\n", invalidRequests.Load())
+	fmt.Fprintf(w, "# HELP icap_read_timeouts_total Messages abandoned because the read deadline expired mid-message.\n")
+	fmt.Fprintf(w, "# TYPE icap_read_timeouts_total counter\n")
+	fmt.Fprintf(w, "icap_read_timeouts_total %d\n", readTimeouts.Load())
+	fmt.Fprintf(w, "# HELP icap_sink_errors_total Log entries a LOG_SINKS member failed to write or dropped.\n")
+	fmt.Fprintf(w, "# TYPE icap_sink_errors_total counter\n")
+	sinkErrorsMu.Lock()
+	names := make([]string, 0, len(sinkErrors))
+	for name := range sinkErrors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "icap_sink_errors_total{sink=%q} %d\n", name, sinkErrors[name].Load())
+	}
+	sinkErrorsMu.Unlock()
+}
+
+// metricsHandler serves writeMetrics on the health-check HTTP server.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// mmdbReader looks up IP addresses in a MaxMind DB file (.mmdb, format
+// version 2 — GeoLite2/GeoIP2 City, Country, and ASN databases). The whole
+// file is read into memory once; lookups only read it, so one reader is safe
+// for concurrent use. Only the standard library is used.
+type mmdbReader struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint // bits per record: 24, 28, or 32
+	ipVersion  uint
+	treeSize   uint
+	ipv4Start  uint // node reached after the 96 zero bits of ::/96 (IPv6 DBs)
+}
+
+// mmdbMetadataMarker precedes the metadata map at the end of the file.
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// mmdbMaxDepth bounds nesting and pointer chains so a corrupt file cannot
+// recurse without limit.
+const mmdbMaxDepth = 32
+
+// openMMDB reads and validates the database at path.
+func openMMDB(path string) (*mmdbReader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return newMMDBReader(buf)
+}
+
+// newMMDBReader parses the metadata of an in-memory database.
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("mmdb: metadata marker not found")
+	}
+	metaStart := i + len(mmdbMetadataMarker)
+	d := mmdbDecoder{buf: buf[metaStart:]}
+	v, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("mmdb: metadata: %w", err)
+	}
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("mmdb: metadata is not a map")
+	}
+	r := &mmdbReader{
+		buf:        buf,
+		nodeCount:  uint(mmdbUint(meta["node_count"])),
+		recordSize: uint(mmdbUint(meta["record_size"])),
+		ipVersion:  uint(mmdbUint(meta["ip_version"])),
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("mmdb: unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("mmdb: unsupported ip_version %d", r.ipVersion)
+	}
+	r.treeSize = r.nodeCount * r.recordSize / 4
+	if r.nodeCount == 0 || r.treeSize+16 > uint(i) {
+		return nil, errors.New("mmdb: search tree larger than file")
+	}
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for n := 0; n < 96 && node < r.nodeCount; n++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// lookup returns the data record for addr, or nil when the database has no
+// entry covering it.
+func (r *mmdbReader) lookup(addr netip.Addr) (map[string]any, error) {
+	node, bits, nbits := uint(0), addr.As16(), 128
+	if addr.Unmap().Is4() {
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+		b4 := addr.Unmap().As4()
+		copy(bits[:4], b4[:])
+		nbits = 32
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < nbits && node < r.nodeCount; i++ {
+		bit := (bits[i/8] >> (7 - uint(i%8))) & 1
+		node = r.record(node, uint(bit))
+	}
+	if node <= r.nodeCount {
+		return nil, nil // nodeCount itself means "no data"
+	}
+	offset := node - r.nodeCount - 16
+	d := mmdbDecoder{buf: r.buf[r.treeSize+16:]}
+	v, _, err := d.decode(offset, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := v.(map[string]any)
+	return m, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (r *mmdbReader) record(node, bit uint) uint {
+	b := r.buf[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		off := bit * 3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// mmdbDecoder decodes the MaxMind DB data section format. Offsets, including
+// pointer targets, are relative to the start of buf.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// MaxMind DB data types.
+const (
+	mmdbExtended  = 0
+	mmdbPointer   = 1
+	mmdbString    = 2
+	mmdbDouble    = 3
+	mmdbBytes     = 4
+	mmdbUint16    = 5
+	mmdbUint32    = 6
+	mmdbMap       = 7
+	mmdbInt32     = 8
+	mmdbUint64    = 9
+	mmdbUint128   = 10
+	mmdbArray     = 11
+	mmdbContainer = 12
+	mmdbEndMarker = 13
+	mmdbBool      = 14
+	mmdbFloat     = 15
+)
+
+var errMMDBCorrupt = errors.New("mmdb: corrupt data section")
+
+// decode decodes the value at offset and returns it with the offset just
+// past it. Maps become map[string]any, arrays []any, integers uint64 (int32
+// as int64), floats float64.
+func (d *mmdbDecoder) decode(offset uint, depth int) (any, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errMMDBCorrupt
+	}
+	typ, size, offset, err := d.controlByte(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == mmdbPointer {
+		target, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		v, _, err := d.decode(target, depth+1)
+		return v, next, err
+	}
+	end := offset + size
+	if typ != mmdbMap && typ != mmdbArray && typ != mmdbBool && end > uint(len(d.buf)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	switch typ {
+	case mmdbString:
+		return string(d.buf[offset:end]), end, nil
+	case mmdbBytes:
+		return append([]byte(nil), d.buf[offset:end]...), end, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(d.buf[offset:end])), end, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(d.buf[offset:end]))), end, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64, mmdbUint128:
+		if size > 16 {
+			return nil, 0, errMMDBCorrupt
+		}
+		var n uint64
+		for _, c := range d.buf[offset:end] {
+			n = n<<8 | uint64(c) // uint128 keeps the low 64 bits
+		}
+		return n, end, nil
+	case mmdbInt32:
+		if size > 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		var n uint32
+		for _, c := range d.buf[offset:end] {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), end, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	case mmdbMap:
+		m := make(map[string]any, min(size, 64))
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			v, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[key], offset = v, next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]any, 0, min(size, 64))
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, offset = append(a, v), next
+		}
+		return a, offset, nil
+	default: // extended types without a value (container, end marker) or unknown
+		return nil, 0, errMMDBCorrupt
+	}
+}
+
+// controlByte reads a field's control byte(s): its type and payload size.
+// For pointers size carries the raw 5 low bits of the control byte.
+func (d *mmdbDecoder) controlByte(offset uint) (typ, size, next uint, err error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, errMMDBCorrupt
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typ = uint(ctrl >> 5)
+	if typ == mmdbPointer {
+		return typ, uint(ctrl & 0x1f), offset, nil
+	}
+	if typ == mmdbExtended {
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, errMMDBCorrupt
+		}
+		typ = 7 + uint(d.buf[offset])
+		offset++
+	}
+	size = uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28 // 1, 2, or 3 extra size bytes
+		if offset+n > uint(len(d.buf)) {
+			return 0, 0, 0, errMMDBCorrupt
+		}
+		var v uint
+		for _, c := range d.buf[offset : offset+n] {
+			v = v<<8 | uint(c)
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + v
+		case 2:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+	return typ, size, offset, nil
+}
+
+// pointer decodes a pointer whose control byte carried bits (ss and vvv) and
+// returns its target offset and the offset past the pointer.
+func (d *mmdbDecoder) pointer(bits, offset uint) (target, next uint, err error) {
+	n := bits>>3&3 + 1
+	if offset+n > uint(len(d.buf)) {
+		return 0, 0, errMMDBCorrupt
+	}
+	var v uint
+	for _, c := range d.buf[offset : offset+n] {
+		v = v<<8 | uint(c)
+	}
+	vvv := bits & 7
+	switch n {
+	case 1:
+		target = vvv<<8 | v
+	case 2:
+		target = (vvv<<16 | v) + 2048
+	case 3:
+		target = (vvv<<24 | v) + 526336
+	default:
+		target = v
+	}
+	return target, offset + n, nil
+}
+
+// mmdbUint returns v as a uint64 when it is a decoded unsigned integer.
+func mmdbUint(v any) uint64 {
+	n, _ := v.(uint64)
+	return n
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MessagePack entries (LOG_FORMAT=msgpack). Each entry is written as one
+// record:
+//
+//	<4-byte big-endian payload length> <MessagePack map> "\n"
+//
+// The map has the same keys as the JSON entry, with the same omitempty
+// rules, so a consumer that knows the JSON schema knows this one. Nested
+// objects (headers, req_body_json, extra, geo) are nested maps rather than
+// JSON text. The trailing newline keeps the rotating writer, which ends every
+// entry with one, from adding a byte outside the frame; readers check it.
+// The {"error": ...} records written in place of a lost entry are framed the
+// same way (encodeMsgpackError), so nothing else enters the stream.
+//
+// The encoder walks the entry with reflect following encoding/json's tag
+// rules for the types logEntry uses; the decoder (readMsgpackEntry) turns a
+// record back into a logEntry through JSON, so both sides stay in step with
+// the struct tags without a hand-written field list.
+
+// maxMsgpackRecord bounds the payload length accepted by readMsgpackEntry so
+// a corrupt length cannot allocate gigabytes.
+const maxMsgpackRecord = 256 << 20
+
+// errMsgpackFrame is returned by readMsgpackEntry for a record whose framing
+// is broken: an oversized length or a missing trailing newline.
+var errMsgpackFrame = errors.New("malformed msgpack record frame")
+
+// encodeMsgpack serializes entry as one framed MessagePack record.
+func encodeMsgpack(entry logEntry) ([]byte, error) {
+	b, err := appendMsgpack(make([]byte, 4, 1024), reflect.ValueOf(entry))
+	if err != nil {
+		return nil, err
+	}
+	return frameMsgpack(b), nil
+}
+
+// encodeMsgpackError serializes the {"error": msg} record (see
+// encodeErrorRecord) as one framed MessagePack record.
+func encodeMsgpackError(msg string) []byte {
+	b := appendMsgpackLen(make([]byte, 4, 64+len(msg)), 1, 0x80, 16, 0, 0xde, 0xdf)
+	return frameMsgpack(appendMsgpackString(appendMsgpackString(b, "error"), msg))
+}
+
+// frameMsgpack completes a record: b holds 4 reserved bytes and the payload;
+// the length goes in the reserved bytes and the newline after the payload.
+func frameMsgpack(b []byte) []byte {
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return append(b, '\n')
+}
+
+// readMsgpackEntry reads the next record written by encodeMsgpack from r.
+// It returns io.EOF at a clean end of input and io.ErrUnexpectedEOF when the
+// input ends inside a record. An {"error": ...} record decodes to an empty
+// entry; use readMsgpackRecord to see it.
+func readMsgpackEntry(r *bufio.Reader) (logEntry, error) {
+	rec, err := readMsgpackRecord(r)
+	if err != nil {
+		return logEntry{}, err
+	}
+	return msgpackRecordEntry(rec)
+}
+
+// msgpackRecordEntry converts a record read by readMsgpackRecord into a
+// logEntry by way of its JSON encoding.
+func msgpackRecordEntry(rec map[string]any) (logEntry, error) {
+	var entry logEntry
+	data, err := json.Marshal(rec)
+	if err == nil {
+		err = json.Unmarshal(data, &entry)
+	}
+	return entry, err
+}
+
+// readMsgpackRecord reads the next record from r as a generic map, with the
+// errors of readMsgpackEntry.
+func readMsgpackRecord(r *bufio.Reader) (map[string]any, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxMsgpackRecord {
+		return nil, fmt.Errorf("%w: length %d", errMsgpackFrame, n)
+	}
+	payload := make([]byte, n+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if payload[n] != '\n' {
+		return nil, fmt.Errorf("%w: no newline after %d-byte payload", errMsgpackFrame, n)
+	}
+	v, rest, err := decodeMsgpack(payload[:n], 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("msgpack: %d trailing bytes", len(rest))
+	}
+	rec, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("msgpack: record is %T, not a map", v)
+	}
+	return rec, nil
+}
+
+// msgpackField is one struct field as encoding/json would name it.
+type msgpackField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// msgpackFieldCache maps a struct type to its []msgpackField.
+var msgpackFieldCache sync.Map
+
+// msgpackFields returns the exported fields of struct type t that
+// encoding/json would encode, with their JSON names.
+func msgpackFields(t reflect.Type) []msgpackField {
+	if f, ok := msgpackFieldCache.Load(t); ok {
+		return f.([]msgpackField)
+	}
+	var fields []msgpackField
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if !sf.IsExported() || tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, msgpackField{
+			name:      name,
+			index:     i,
+			omitEmpty: slices.Contains(strings.Split(opts, ","), "omitempty"),
+		})
+	}
+	msgpackFieldCache.Store(t, fields)
+	return fields
+}
+
+var (
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+	jsonNumberType    = reflect.TypeFor[json.Number]()
+)
+
+// appendMsgpack appends the MessagePack encoding of v to b. A value with its
+// own JSON or text encoding — req_body_json's json.RawMessage, a time.Time a
+// request hook put in extra — is encoded as the JSON value it marshals to.
+func appendMsgpack(b []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return append(b, 0xc0), nil
+	}
+	if t := v.Type(); t.Kind() != reflect.Pointer && t.Kind() != reflect.Interface &&
+		(t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType)) {
+		data, err := json.Marshal(v.Interface())
+		if err != nil {
+			return nil, fmt.Errorf("msgpack: %w", err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var x any
+		if err := dec.Decode(&x); err != nil {
+			return nil, fmt.Errorf("msgpack: %s: %w", t, err)
+		}
+		return appendMsgpack(b, reflect.ValueOf(x))
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		return appendMsgpack(b, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendMsgpackInt(b, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendMsgpackUint(b, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		if v.Type() == jsonNumberType {
+			return appendMsgpackNumber(b, json.Number(v.String()))
+		}
+		return appendMsgpackString(b, v.String()), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append(appendMsgpackLen(b, v.Len(), 0, 0, 0xc4, 0xc5, 0xc6), v.Bytes()...), nil
+		}
+		fallthrough
+	case reflect.Array:
+		b = appendMsgpackLen(b, v.Len(), 0x90, 16, 0, 0xdc, 0xdd)
+		for i := range v.Len() {
+			var err error
+			if b, err = appendMsgpack(b, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(b, 0xc0), nil
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("msgpack: unsupported map key type %s", v.Type().Key())
+		}
+		keys := v.MapKeys()
+		slices.SortFunc(keys, func(a, b reflect.Value) int { return strings.Compare(a.String(), b.String()) })
+		b = appendMsgpackLen(b, len(keys), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			b = appendMsgpackString(b, k.String())
+			var err error
+			if b, err = appendMsgpack(b, v.MapIndex(k)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Struct:
+		var fields []msgpackField
+		for _, f := range msgpackFields(v.Type()) {
+			if !f.omitEmpty || !emptyValue(v.Field(f.index)) {
+				fields = append(fields, f)
+			}
+		}
+		b = appendMsgpackLen(b, len(fields), 0x80, 16, 0, 0xde, 0xdf)
+		for _, f := range fields {
+			b = appendMsgpackString(b, f.name)
+			var err error
+			if b, err = appendMsgpack(b, v.Field(f.index)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type %s", v.Type())
+}
+
+// emptyValue reports whether omitempty drops v, as in encoding/json.
+func emptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// appendMsgpackLen appends the header of a string, binary, array, or map of
+// n elements: the fix form (fix | n) when n < fixMax, else the 8-, 16-, or
+// 32-bit length form. Binary has no fix form and arrays and maps no 8-bit
+// form; pass 0 for those.
+func appendMsgpackLen(b []byte, n int, fix byte, fixMax int, c8, c16, c32 byte) []byte {
+	switch {
+	case n < fixMax:
+		return append(b, fix|byte(n))
+	case c8 != 0 && n <= math.MaxUint8:
+		return append(b, c8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, c16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, c32), uint32(n))
+}
+
+// appendMsgpackString appends s as a MessagePack str.
+func appendMsgpackString(b []byte, s string) []byte {
+	return append(appendMsgpackLen(b, len(s), 0xa0, 32, 0xd9, 0xda, 0xdb), s...)
+}
+
+// appendMsgpackInt appends n in its shortest MessagePack integer form.
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0:
+		return appendMsgpackUint(b, uint64(n))
+	case n >= -32:
+		return append(b, byte(n))
+	case n >= math.MinInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+}
+
+// appendMsgpackUint appends n in its shortest MessagePack integer form.
+func appendMsgpackUint(b []byte, n uint64) []byte {
+	switch {
+	case n <= 0x7f:
+		return append(b, byte(n))
+	case n <= math.MaxUint8:
+		return append(b, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xcf), n)
+}
+
+// appendMsgpackNumber appends a JSON number from req_body_json or extra as
+// an integer when it is one, else as a float.
+func appendMsgpackNumber(b []byte, n json.Number) ([]byte, error) {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		return appendMsgpackInt(b, i), nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return appendMsgpackUint(b, u), nil
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return nil, fmt.Errorf("msgpack: bad number %q", n)
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f)), nil
+}
+
+// msgpackMaxDepth bounds nesting in decodeMsgpack.
+const msgpackMaxDepth = 64
+
+// decodeMsgpack decodes one MessagePack value from the front of data into
+// nil, bool, int64, uint64, float64, string, []byte, []any, or
+// map[string]any, returning the remaining bytes. Extension types and
+// non-string map keys are rejected.
+func decodeMsgpack(data []byte, depth int) (any, []byte, error) {
+	if depth > msgpackMaxDepth {
+		return nil, nil, errors.New("msgpack: nested too deeply")
+	}
+	if len(data) == 0 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	c, data := data[0], data[1:]
+	switch {
+	case c <= 0x7f:
+		return int64(c), data, nil
+	case c >= 0xe0:
+		return int64(int8(c)), data, nil
+	case c&0xe0 == 0xa0:
+		return msgpackTake(data, uint64(c&0x1f), func(p []byte) any { return string(p) })
+	case c&0xf0 == 0x90:
+		return decodeMsgpackArray(data, uint64(c&0x0f), depth)
+	case c&0xf0 == 0x80:
+		return decodeMsgpackMap(data, uint64(c&0x0f), depth)
+	}
+	switch c {
+	case 0xc0:
+		return nil, data, nil
+	case 0xc2:
+		return false, data, nil
+	case 0xc3:
+		return true, data, nil
+	case 0xd9, 0xda, 0xdb: // str 8/16/32
+		n, rest, err := msgpackUint(data, 1<<(c-0xd9))
+		if err != nil {
+			return nil, nil, err
+		}
+		return msgpackTake(rest, n, func(p []byte) any { return string(p) })
+	case 0xc4, 0xc5, 0xc6: // bin 8/16/32
+		n, rest, err := msgpackUint(data, 1<<(c-0xc4))
+		if err != nil {
+			return nil, nil, err
+		}
+		return msgpackTake(rest, n, func(p []byte) any { return bytes.Clone(p) })
+	case 0xdc, 0xdd: // array 16/32
+		n, rest, err := msgpackUint(data, 2<<(c-0xdc))
+		if err != nil {
+			return nil, nil, err
+		}
+		return decodeMsgpackArray(rest, n, depth)
+	case 0xde, 0xdf: // map 16/32
+		n, rest, err := msgpackUint(data, 2<<(c-0xde))
+		if err != nil {
+			return nil, nil, err
+		}
+		return decodeMsgpackMap(rest, n, depth)
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, rest, err := msgpackUint(data, 1<<(c-0xcc))
+		return n, rest, err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		n, rest, err := msgpackUint(data, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		shift := 64 - 8*size // sign-extend
+		return int64(n<<shift) >> shift, rest, nil
+	case 0xca:
+		n, rest, err := msgpackUint(data, 4)
+		return float64(math.Float32frombits(uint32(n))), rest, err
+	case 0xcb:
+		n, rest, err := msgpackUint(data, 8)
+		return math.Float64frombits(n), rest, err
+	}
+	return nil, nil, fmt.Errorf("msgpack: unsupported type byte 0x%02x", c)
+}
+
+// msgpackUint reads a size-byte big-endian unsigned integer.
+func msgpackUint(data []byte, size int) (uint64, []byte, error) {
+	if len(data) < size {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	var n uint64
+	for _, c := range data[:size] {
+		n = n<<8 | uint64(c)
+	}
+	return n, data[size:], nil
+}
+
+// msgpackTake splits n bytes off data and converts them with conv.
+func msgpackTake(data []byte, n uint64, conv func([]byte) any) (any, []byte, error) {
+	if uint64(len(data)) < n {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return conv(data[:n]), data[n:], nil
+}
+
+// decodeMsgpackArray decodes n array elements.
+func decodeMsgpackArray(data []byte, n uint64, depth int) (any, []byte, error) {
+	if n > uint64(len(data)) { // every element takes at least one byte
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	arr := make([]any, 0, n)
+	for range n {
+		v, rest, err := decodeMsgpack(data, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		arr, data = append(arr, v), rest
+	}
+	return arr, data, nil
+}
+
+// decodeMsgpackMap decodes n map entries with string keys.
+func decodeMsgpackMap(data []byte, n uint64, depth int) (any, []byte, error) {
+	if 2*n > uint64(len(data)) {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	m := make(map[string]any, n)
+	for range n {
+		k, rest, err := decodeMsgpack(data, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("msgpack: map key is %T, not a string", k)
+		}
+		v, rest, err := decodeMsgpack(rest, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		m[key], data = v, rest
+	}
+	return m, data, nil
+}
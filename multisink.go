@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// multiSinkQueue is how many entries each LOG_SINKS member may have waiting
+// before new entries for it are dropped.
+const multiSinkQueue = 1024
+
+// multiSink fans every entry out to several sinks (LOG_SINKS=file,webhook).
+// Each member has its own queue and writer goroutine, so a slow or failing
+// sink never delays or loses entries for the others. A member's write
+// failures and queue overflows are logged and counted in
+// icap_sink_errors_total{sink="<name>"}; Write itself always succeeds, so
+// validateConfig refuses FALLBACK_STDERR with LOG_SINKS.
+type multiSink struct {
+	members []*multiMember
+}
+
+type multiMember struct {
+	name  string
+	sink  logSink
+	queue chan []byte
+	done  chan struct{}
+}
+
+// newMultiSink starts a writer goroutine per named sink. names and sinks
+// must have the same length.
+func newMultiSink(names []string, sinks []logSink) *multiSink {
+	m := &multiSink{}
+	for i, s := range sinks {
+		mm := &multiMember{
+			name:  names[i],
+			sink:  s,
+			queue: make(chan []byte, multiSinkQueue),
+			done:  make(chan struct{}),
+		}
+		go mm.run()
+		m.members = append(m.members, mm)
+	}
+	return m
+}
+
+// Write queues p for every member. The entry is copied once and shared
+// read-only between the queues.
+func (m *multiSink) Write(p []byte) (int, error) {
+	entry := bytes.Clone(p)
+	for _, mm := range m.members {
+		select {
+		case mm.queue <- entry:
+		default:
+			sinkErrorCounter(mm.name).Add(1)
+			slog.Warn("sink queue full, dropping log entry", "sink", mm.name, "queue", cap(mm.queue))
+		}
+	}
+	return len(p), nil
+}
+
+// Close drains every member's queue and closes the member sinks.
+func (m *multiSink) Close() error {
+	var errs []error
+	for _, mm := range m.members {
+		close(mm.queue)
+	}
+	for _, mm := range m.members {
+		<-mm.done
+		if err := mm.sink.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s sink: %w", mm.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// run writes queued entries to the member sink until the queue is closed.
+func (mm *multiMember) run() {
+	defer close(mm.done)
+	for entry := range mm.queue {
+		if _, err := mm.sink.Write(entry); err != nil {
+			sinkErrorCounter(mm.name).Add(1)
+			slog.Error("sink write failed", "sink", mm.name, "err", err)
+		}
+	}
+}
+
+// openMultiSink opens every sink named in cfg.LogSinks and combines them. A
+// single name opens that sink directly. If any sink fails to open, the ones
+// already opened are closed and the error returned.
+func openMultiSink(cfg Config) (logSink, error) {
+	var names []string
+	var sinks []logSink
+	for _, name := range cfg.LogSinks {
+		name = strings.ToLower(strings.TrimSpace(name))
+		c := cfg
+		c.LogSink = name
+		s, err := openPrimarySink(c)
+		if err != nil {
+			for _, opened := range sinks {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("LOG_SINKS %s: %w", name, err)
+		}
+		names = append(names, name)
+		sinks = append(sinks, s)
+	}
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return newMultiSink(names, sinks), nil
+}
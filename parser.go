@@ -3,16 +3,23 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 )
 
 // parseICAP parses a raw ICAP request byte slice and extracts relevant fields.
-func parseICAP(raw []byte) icapInfo {
-	info := icapInfo{}
+// cfg supplies the limits applied while decoding bodies (e.g. MaxBodySize caps
+// decompressed output).
+func parseICAP(raw []byte, cfg Config) icapInfo {
+	info := icapInfo{messageBytes: len(raw)}
 	reader := bufio.NewReader(bytes.NewReader(raw))
 
 	// Parse ICAP request line: e.g. "REQMOD icap://host/service ICAP/1.0"
@@ -40,8 +47,10 @@ func parseICAP(raw []byte) icapInfo {
 			key := strings.TrimSpace(line[:idx])
 			val := strings.TrimSpace(line[idx+1:])
 			info.icapHeaders.Add(key, val)
-			// Capture the Encapsulated header for offset-based splitting
-			if strings.EqualFold(key, "Encapsulated") {
+			// Capture the Encapsulated header for offset-based splitting.
+			// Only the first one counts — readICAPMessage rejects duplicates,
+			// and first-wins keeps parsing deterministic if one slips through.
+			if strings.EqualFold(key, "Encapsulated") && encapsulatedHeader == "" {
 				encapsulatedHeader = val
 			}
 		}
@@ -51,14 +60,26 @@ func parseICAP(raw []byte) icapInfo {
 	remaining, _ := io.ReadAll(reader)
 
 	// Use RFC 3507 offset-based splitting
-	sections := splitEncapsulated(remaining, encapsulatedHeader)
+	sections, warnings := splitEncapsulated(remaining, encapsulatedHeader)
+	info.parseWarnings = warnings
+	if cfg.StrictBodySections {
+		if w := dropUnexpectedBody(sections, info.icapMethod); w != "" {
+			slog.Warn("dropping unexpected ICAP body section", "icap_method", info.icapMethod, "detail", w)
+			info.parseWarnings = append(info.parseWarnings, w)
+		}
+	}
 
 	// --- req-hdr ---
 	if reqBytes, ok := sections["req-hdr"]; ok && len(reqBytes) > 0 {
 		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(reqBytes)))
-		if err == nil {
+		if err != nil {
+			info.parseError = appendParseError(info.parseError, "req-hdr", err)
+		} else {
 			info.reqMethod = req.Method
 			info.reqHeaders = req.Header
+			if cfg.LogRawHeaders {
+				info.reqHeadersRaw = rawHeaderFields(reqBytes)
+			}
 			if req.URL != nil {
 				info.reqPath = req.URL.RequestURI()
 			}
@@ -83,7 +104,9 @@ func parseICAP(raw []byte) icapInfo {
 	// --- res-hdr ---
 	if respBytes, ok := sections["res-hdr"]; ok && len(respBytes) > 0 {
 		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respBytes)), nil)
-		if err == nil {
+		if err != nil {
+			info.parseError = appendParseError(info.parseError, "res-hdr", err)
+		} else {
 			info.respStatus = resp.Status
 			info.respHeaders = resp.Header
 			if resp.Body != nil {
@@ -95,31 +118,206 @@ func parseICAP(raw []byte) icapInfo {
 
 	// --- req-body ---
 	if bodyBytes, ok := sections["req-body"]; ok && len(bodyBytes) > 0 {
-		decoded := decodeChunked(bodyBytes)
+		decoded, trailers := decodeChunkedTrailers(bodyBytes)
+		info.reqHeaders = mergeTrailers(info.reqHeaders, trailers)
+		info.reqBodySize = int64(len(decoded))
+		if cfg.VerifyContentMD5 && info.reqHeaders != nil {
+			info.contentMD5Valid = checkContentMD5(info.contentMD5Valid, info.reqHeaders, decoded)
+		}
+		if cfg.ExtractSNI && info.reqMethod == "CONNECT" {
+			if name, ok := extractSNI([]byte(decoded)); ok {
+				info.tlsServerName = name
+			}
+		}
 		ct := ""
 		ce := ""
 		if info.reqHeaders != nil {
 			ct = info.reqHeaders.Get("Content-Type")
 			ce = info.reqHeaders.Get("Content-Encoding")
 		}
-		info.reqBody = sanitizeBody(decoded, ct, ce, false)
+		policyType := ct // the declared type, before protobuf decoding rewrites ct
+		if plain, ok := decodeContentEncoding(decoded, ce, cfg.MaxBodySize); ok {
+			decoded, ce = plain, ""
+		}
+		if js, ok := decodeProtobufBody(decoded, ct, cfg); ok {
+			decoded, ct = js, "application/json"
+		}
+		if ce == "" {
+			if text, charset, ok := transcodeToUTF8(decoded, ct); ok {
+				decoded, info.reqCharset = text, charset
+			}
+		}
+		// As for res-body, an undeclared type is sniffed from the decoded
+		// body, not from compressed bytes.
+		if policyType == "" && len(cfg.BodyLogPolicy) > 0 {
+			policyType = sniffBodyType(decoded)
+		}
+		switch bodyPolicyAction(policyType, cfg.BodyLogPolicy) {
+		case bodyPolicyMeta:
+			info.reqBody = bodyPolicyMetadata(policyType, info.reqBodySize)
+		case bodyPolicyDrop:
+			info.reqBody = ""
+		default:
+			info.reqBody, info.reqSecret = sanitizeBody(decoded, ct, ce, false, cfg.BinaryPreviewBytes, cfg.DetectSecrets)
+		}
 	}
 
 	// --- res-body ---
 	if bodyBytes, ok := sections["res-body"]; ok && len(bodyBytes) > 0 {
-		decoded := decodeChunked(bodyBytes)
+		decoded, trailers := decodeChunkedTrailers(bodyBytes)
+		info.respHeaders = mergeTrailers(info.respHeaders, trailers)
+		info.respBodySize = int64(len(decoded))
+		if cfg.VerifyContentMD5 && info.respHeaders != nil {
+			info.contentMD5Valid = checkContentMD5(info.contentMD5Valid, info.respHeaders, decoded)
+		}
 		ct := ""
 		ce := ""
 		if info.respHeaders != nil {
 			ct = info.respHeaders.Get("Content-Type")
 			ce = info.respHeaders.Get("Content-Encoding")
 		}
-		info.respBody = sanitizeBody(decoded, ct, ce, false)
+		policyType := ct // the declared type, before protobuf decoding rewrites ct
+		if plain, ok := decodeContentEncoding(decoded, ce, cfg.MaxBodySize); ok {
+			decoded, ce = plain, ""
+		}
+		if js, ok := decodeProtobufBody(decoded, ct, cfg); ok {
+			decoded, ct = js, "application/json"
+		}
+		if ce == "" {
+			if text, charset, ok := transcodeToUTF8(decoded, ct); ok {
+				decoded, info.respCharset = text, charset
+			}
+		}
+		// Many responses omit Content-Type; sniff the decoded body so text
+		// still reaches the JSON/text path and non-text types are summarised.
+		// A declared Content-Type always takes precedence.
+		if ct == "" {
+			info.respBodyType = sniffBodyType(decoded)
+		}
+		if policyType == "" {
+			policyType = info.respBodyType
+		}
+		switch action := bodyPolicyAction(policyType, cfg.BodyLogPolicy); {
+		case action == bodyPolicyMeta:
+			info.respBody = bodyPolicyMetadata(policyType, info.respBodySize)
+		case action == bodyPolicyDrop:
+			info.respBody = ""
+		case info.respBodyType != "" && ce == "" && !strings.HasPrefix(info.respBodyType, "text/"):
+			info.respBody = binaryMarker(decoded, cfg.BinaryPreviewBytes)
+		default:
+			info.respBody, info.respSecret = sanitizeBody(decoded, ct, ce, false, cfg.BinaryPreviewBytes, cfg.DetectSecrets)
+		}
 	}
 
 	return info
 }
 
+// appendParseError adds "<section>: <reason>" for an encapsulated-header
+// parse failure to prev, separating entries with "; ".
+func appendParseError(prev, section string, err error) string {
+	msg := section + ": " + classifyParseError(err)
+	if prev == "" {
+		return msg
+	}
+	return prev + "; " + msg
+}
+
+// classifyParseError maps an error from http.ReadRequest or http.ReadResponse
+// to a short fixed reason. net/http quotes the offending input in its error
+// text, so the text itself is never logged — only the classification.
+func classifyParseError(err error) string {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "truncated headers"
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "malformed HTTP request"):
+		return "bad request line"
+	case strings.Contains(msg, "malformed HTTP response"):
+		return "bad status line"
+	case strings.Contains(msg, "malformed HTTP status code"):
+		return "bad status code"
+	case strings.Contains(msg, "malformed HTTP version"):
+		return "bad HTTP version"
+	case strings.Contains(msg, "invalid method"):
+		return "bad method"
+	case strings.Contains(msg, "MIME header"):
+		return "malformed header line"
+	case strings.Contains(msg, "too large"), strings.Contains(msg, "too long"):
+		return "header too large"
+	case strings.Contains(msg, "Host header"):
+		return "bad Host header"
+	case strings.Contains(msg, "parse "), strings.Contains(msg, "invalid URI"):
+		return "bad request URI"
+	case strings.Contains(msg, "Content-Length"), strings.Contains(msg, "Transfer-Encoding"):
+		return "bad framing header"
+	}
+	return "unparseable"
+}
+
+// mergeTrailers adds chunked-body trailer headers to the headers of the same
+// HTTP message so they are logged alongside them (e.g. X-Checksum). Values
+// are appended, never replacing a header field of the same name.
+func mergeTrailers(h, trailers http.Header) http.Header {
+	if len(trailers) == 0 {
+		return h
+	}
+	if h == nil {
+		h = make(http.Header, len(trailers))
+	}
+	for name, values := range trailers {
+		for _, v := range values {
+			h.Add(name, v)
+		}
+	}
+	return h
+}
+
+// dropUnexpectedBody enforces STRICT_BODY_SECTIONS: a REQMOD may only carry
+// req-body and a RESPMOD only res-body (RFC 3507 §4.4.1). The other body
+// section, if present, is removed from sections and a warning describing it
+// is returned; "" means nothing was dropped.
+func dropUnexpectedBody(sections map[string][]byte, icapMethod string) string {
+	var unexpected string
+	switch strings.ToUpper(icapMethod) {
+	case "REQMOD":
+		unexpected = "res-body"
+	case "RESPMOD":
+		unexpected = "req-body"
+	default:
+		return ""
+	}
+	body, ok := sections[unexpected]
+	if !ok {
+		return ""
+	}
+	delete(sections, unexpected)
+	return fmt.Sprintf("%s section not allowed in %s; %d bytes ignored",
+		unexpected, strings.ToUpper(icapMethod), len(body))
+}
+
+// checkContentMD5 verifies body against the Content-MD5 header in h (RFC 1864:
+// base64 of the MD5 of the entity body as transferred, i.e. before any
+// content-coding is undone). It returns prev unchanged when the header is
+// absent, so a message with no Content-MD5 leaves the result nil. When both
+// the request and the response carry the header the results are ANDed.
+// A malformed header value counts as a mismatch.
+func checkContentMD5(prev *bool, h http.Header, body string) *bool {
+	want := strings.TrimSpace(h.Get("Content-MD5"))
+	if want == "" {
+		return prev
+	}
+	valid := false
+	if sum, err := base64.StdEncoding.DecodeString(want); err == nil {
+		got := md5.Sum([]byte(body))
+		valid = bytes.Equal(sum, got[:])
+	}
+	if prev != nil {
+		valid = valid && *prev
+	}
+	return &valid
+}
+
 // splitEncapsulated parses the Encapsulated header value and uses byte offsets
 // to slice the data buffer into named sections per RFC 3507 §4.4.1.
 //
@@ -129,10 +327,16 @@ func parseICAP(raw []byte) icapInfo {
 //	"req-hdr=0, req-body=47"               → req-hdr[0:47], req-body[47:end]
 //	"res-hdr=0, res-body=38"               → res-hdr[0:38], res-body[38:end]
 //	"req-hdr=0, res-hdr=210, res-body=294" → three sections
-func splitEncapsulated(data []byte, encHeader string) map[string][]byte {
+//
+// Offsets must be strictly increasing and must not point past the end of
+// data. A section that breaks either rule is dropped and described in the
+// returned warnings rather than sliced — a decreasing offset would otherwise
+// produce overlapping or garbage sections. null-body is checked the same way
+// but, being a marker, never becomes a section.
+func splitEncapsulated(data []byte, encHeader string) (map[string][]byte, []string) {
 	sections := make(map[string][]byte)
 	if encHeader == "" || len(data) == 0 {
-		return sections
+		return sections, nil
 	}
 
 	type part struct {
@@ -141,6 +345,8 @@ func splitEncapsulated(data []byte, encHeader string) map[string][]byte {
 	}
 
 	var parts []part
+	var warnings []string
+	prev := part{offset: -1}
 	for _, token := range strings.Split(encHeader, ",") {
 		token = strings.TrimSpace(token)
 		kv := strings.SplitN(token, "=", 2)
@@ -148,12 +354,24 @@ func splitEncapsulated(data []byte, encHeader string) map[string][]byte {
 			continue
 		}
 		name := strings.TrimSpace(strings.ToLower(kv[0]))
-		// null-body is a marker only — no bytes to slice
-		if name == "null-body" {
+		offset, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || offset < 0 {
+			warnings = append(warnings, fmt.Sprintf("Encapsulated %s has invalid offset %q", name, strings.TrimSpace(kv[1])))
 			continue
 		}
-		offset, err := strconv.Atoi(strings.TrimSpace(kv[1]))
-		if err != nil {
+		if offset <= prev.offset {
+			warnings = append(warnings, fmt.Sprintf("Encapsulated %s=%d does not follow %s=%d; section ignored",
+				name, offset, prev.name, prev.offset))
+			continue
+		}
+		if offset > len(data) {
+			warnings = append(warnings, fmt.Sprintf("Encapsulated %s=%d is beyond the %d bytes of encapsulated data; section ignored",
+				name, offset, len(data)))
+			continue
+		}
+		prev = part{name, offset}
+		// null-body is a marker only — no bytes to slice
+		if name == "null-body" {
 			continue
 		}
 		parts = append(parts, part{name, offset})
@@ -175,14 +393,46 @@ func splitEncapsulated(data []byte, encHeader string) map[string][]byte {
 		sections[p.name] = data[start:end]
 	}
 
-	return sections
+	return sections, warnings
+}
+
+// applySchemeByPort rewrites the scheme of destURL according to the port of
+// its host, e.g. "http://host:443/" → "https://host:443/" with the default
+// map. An explicit X-Forwarded-Proto header always wins — parseICAP already
+// used it — so forwardedProto != "" leaves destURL untouched, as does a port
+// missing from schemes or an unparseable URL.
+func applySchemeByPort(destURL, forwardedProto string, schemes map[string]string) string {
+	if destURL == "" || forwardedProto != "" || len(schemes) == 0 {
+		return destURL
+	}
+	u, err := url.Parse(destURL)
+	if err != nil {
+		return destURL
+	}
+	scheme, ok := schemes[u.Port()]
+	if !ok || scheme == u.Scheme {
+		return destURL
+	}
+	u.Scheme = scheme
+	return u.String()
 }
 
 // headersToMap converts http.Header to a flat map[string]string.
 // Single-value headers (the common case) avoid the strings.Join allocation.
-func headersToMap(h http.Header) map[string]string {
+// Keys keep the canonical MIME form ("X-Client-Ip") unless keyCase is
+// "lower" (HEADER_KEY_CASE), which yields HTTP/2-style "x-client-ip".
+//
+// The map itself is the only allocation for a set of single-valued common
+// headers: lowercase keys come from lowerHeaderKeys and values are shared
+// with h. The map outlives the call (it is marshalled later, possibly after a
+// split), so it cannot come from a sync.Pool. See BenchmarkHeadersToMap.
+func headersToMap(h http.Header, keyCase string) map[string]string {
+	lower := strings.EqualFold(keyCase, "lower")
 	m := make(map[string]string, len(h))
 	for k, vs := range h {
+		if lower {
+			k = lowerHeaderKey(k)
+		}
 		if len(vs) == 1 {
 			m[k] = vs[0]
 		} else {
@@ -191,3 +441,69 @@ func headersToMap(h http.Header) map[string]string {
 	}
 	return m
 }
+
+// rawHeaderFields lists the header lines of an HTTP header section (request
+// or status line first, which is skipped) in wire order, keeping the name's
+// casing and every duplicate. Values are trimmed; obsolete line folding
+// (a line starting with a space or tab) is joined to the previous value with
+// a single space, as net/textproto does. Lines without a colon are dropped.
+func rawHeaderFields(section []byte) []headerField {
+	lines := strings.Split(string(section), "\n")
+	var fields []headerField
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if n := len(fields); n > 0 {
+				fields[n-1].Value = strings.TrimSpace(fields[n-1].Value + " " + strings.TrimSpace(line))
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			continue
+		}
+		fields = append(fields, headerField{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)})
+	}
+	return fields
+}
+
+// headerKey returns the map key headersToMap uses for the canonical header
+// name under keyCase.
+func headerKey(name, keyCase string) string {
+	if strings.EqualFold(keyCase, "lower") {
+		return lowerHeaderKey(name)
+	}
+	return name
+}
+
+// lowerHeaderKey lowercases a canonical header name, using a precomputed
+// string for common headers so the hot path does not allocate.
+func lowerHeaderKey(name string) string {
+	if l, ok := lowerHeaderKeys[name]; ok {
+		return l
+	}
+	return strings.ToLower(name)
+}
+
+// lowerHeaderKeys maps the canonical form of frequently seen HTTP and ICAP
+// headers to their lowercase form.
+var lowerHeaderKeys = func() map[string]string {
+	names := []string{
+		"Accept", "Accept-Encoding", "Accept-Language", "Allow", "Authorization",
+		"Cache-Control", "Connection", "Content-Encoding", "Content-Language",
+		"Content-Length", "Content-Type", "Cookie", "Date", "Encapsulated", "Etag",
+		"Expires", "Host", "Istag", "Keep-Alive", "Last-Modified", "Location",
+		"Origin", "Pragma", "Preview", "Proxy-Authorization", "Proxy-Connection",
+		"Referer", "Server", "Set-Cookie", "Transfer-Encoding", "Upgrade",
+		"User-Agent", "Vary", "Via", "X-Authenticated-User", "X-Client-Ip",
+		"X-Forwarded-For", "X-Forwarded-Proto", "X-Requested-With",
+	}
+	m := make(map[string]string, len(names))
+	for _, n := range names {
+		m[n] = strings.ToLower(n)
+	}
+	return m
+}()
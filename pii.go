@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// piiPattern is one SCRUB_PII rule. Every span find reports in s is replaced
+// with "[REDACTED:<label>]". The built-in rules use hand-written scanners;
+// PII_PATTERNS rules wrap a regexp.
+type piiPattern struct {
+	label string
+	find  func(s string) [][2]int // non-overlapping [start, end) spans in order
+}
+
+// defaultPIIPatterns are the built-in SCRUB_PII rules: Luhn-valid payment
+// card numbers (13–19 digits, optionally grouped with single spaces or
+// dashes), e-mail addresses, and US Social Security numbers in the
+// 123-45-6789 form. They are scanners rather than regular expressions because
+// Go's regexp engine made scrubbing a large body cost more than the rest of
+// the handler combined.
+func defaultPIIPatterns() []piiPattern {
+	return []piiPattern{
+		{label: "cc", find: findCardNumbers},
+		{label: "email", find: findEmails},
+		{label: "ssn", find: findSSNs},
+	}
+}
+
+// parsePIIPatterns parses PII_PATTERNS: semicolon-separated label=regex
+// pairs, e.g. `iban=\b[A-Z]{2}\d{2}[A-Z0-9]{11,30}\b;phone=\+\d{10,14}`.
+// Semicolons separate rules because regular expressions routinely contain
+// commas. An invalid pair or regex is an error.
+func parsePIIPatterns(spec string) ([]piiPattern, error) {
+	var patterns []piiPattern
+	for _, pair := range strings.Split(spec, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		label, expr, ok := strings.Cut(pair, "=")
+		label = strings.TrimSpace(label)
+		if !ok || label == "" || expr == "" {
+			return nil, fmt.Errorf("PII_PATTERNS entry %q is not label=regex", pair)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("PII_PATTERNS %s: %w", label, err)
+		}
+		patterns = append(patterns, piiPattern{label: label, find: func(s string) [][2]int {
+			var spans [][2]int
+			for _, m := range re.FindAllStringIndex(s, -1) {
+				spans = append(spans, [2]int{m[0], m[1]})
+			}
+			return spans
+		}})
+	}
+	return patterns, nil
+}
+
+// scrubPII replaces every PII span found by patterns in s with
+// "[REDACTED:<label>]". It runs on the already-sanitized body, so multipart
+// field summaries and JSON values are scrubbed too.
+func scrubPII(s string, patterns []piiPattern) string {
+	for _, p := range patterns {
+		if s == "" {
+			break
+		}
+		spans := p.find(s)
+		if len(spans) == 0 {
+			continue
+		}
+		marker := "[REDACTED:" + p.label + "]"
+		var b strings.Builder
+		b.Grow(len(s))
+		last := 0
+		for _, sp := range spans {
+			b.WriteString(s[last:sp[0]])
+			b.WriteString(marker)
+			last = sp[1]
+		}
+		b.WriteString(s[last:])
+		s = b.String()
+	}
+	return s
+}
+
+// isWordByte reports whether c is a regexp \w byte; PII must not be glued to
+// one on either side (so "ID12345678901234" is not a card number).
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// digitGroups scans the run of digit groups starting at s[i] — digits joined
+// by single spaces or dashes — and returns the end offset of each group.
+func digitGroups(s string, i int) []int {
+	var ends []int
+	for {
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		ends = append(ends, i)
+		if i+1 < len(s) && (s[i] == ' ' || s[i] == '-') && isDigit(s[i+1]) {
+			i++
+			continue
+		}
+		return ends
+	}
+}
+
+// findCardNumbers finds Luhn-valid card numbers. Within a run of digit groups
+// the longest prefix of whole groups with 13–19 digits that passes the Luhn
+// check is taken, so a trailing year or CVV in the same run is left alone.
+func findCardNumbers(s string) [][2]int {
+	var spans [][2]int
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) || (i > 0 && isWordByte(s[i-1])) {
+			continue
+		}
+		ends := digitGroups(s, i)
+		next := ends[len(ends)-1]
+		for k := len(ends) - 1; k >= 0; k-- {
+			end := ends[k]
+			if end < len(s) && isWordByte(s[end]) {
+				continue
+			}
+			if n := countDigits(s[i:end]); n >= 13 && n <= 19 && luhnValid(s[i:end]) {
+				spans = append(spans, [2]int{i, end})
+				break
+			}
+		}
+		i = next
+	}
+	return spans
+}
+
+func countDigits(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if isDigit(s[i]) {
+			n++
+		}
+	}
+	return n
+}
+
+// findSSNs finds ddd-dd-dddd not glued to other word characters, skipping
+// numbers the SSA never issues (see ssnValid).
+func findSSNs(s string) [][2]int {
+	var spans [][2]int
+	for i := 0; i+11 <= len(s); i++ {
+		if !isDigit(s[i]) || (i > 0 && isWordByte(s[i-1])) {
+			continue
+		}
+		c := s[i : i+11]
+		if c[3] == '-' && c[6] == '-' && allDigits(c[0:3]) && allDigits(c[4:6]) && allDigits(c[7:11]) &&
+			(i+11 == len(s) || !isWordByte(s[i+11])) && ssnValid(c) {
+			spans = append(spans, [2]int{i, i + 11})
+			i += 10
+		}
+	}
+	return spans
+}
+
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isEmailLocalByte(c byte) bool {
+	return isWordByte(c) || c == '.' || c == '%' || c == '+' || c == '-'
+}
+
+func isEmailDomainByte(c byte) bool {
+	return isWordByte(c) && c != '_' || c == '.' || c == '-'
+}
+
+// findEmails finds local@domain.tld addresses by expanding outwards from each
+// "@": the domain must contain a dot and end in a label of two or more
+// letters.
+func findEmails(s string) [][2]int {
+	var spans [][2]int
+	from := 0
+	for {
+		at := strings.IndexByte(s[from:], '@')
+		if at < 0 {
+			return spans
+		}
+		at += from
+		start := at
+		for start > from && isEmailLocalByte(s[start-1]) {
+			start--
+		}
+		end := at + 1
+		for end < len(s) && isEmailDomainByte(s[end]) {
+			end++
+		}
+		for end > at+1 && (s[end-1] == '.' || s[end-1] == '-') {
+			end-- // trailing sentence punctuation is not part of the domain
+		}
+		if start < at && validEmailDomain(s[at+1:end]) {
+			spans = append(spans, [2]int{start, end})
+			from = end
+		} else {
+			from = at + 1
+		}
+	}
+}
+
+// validEmailDomain reports whether d has at least two labels and a final
+// label of two or more ASCII letters.
+func validEmailDomain(d string) bool {
+	dot := strings.LastIndexByte(d, '.')
+	if dot <= 0 || len(d)-dot-1 < 2 {
+		return false
+	}
+	for i := dot + 1; i < len(d); i++ {
+		if c := d[i] | 0x20; c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// luhnValid reports whether the digits in s (separators ignored) pass the
+// Luhn checksum used by payment card numbers.
+func luhnValid(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if !isDigit(c) {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// ssnValid rejects SSN-shaped strings that the SSA never issues: area 000,
+// 666, or 900–999, group 00, or serial 0000.
+func ssnValid(s string) bool {
+	area, group, serial := s[0:3], s[4:6], s[7:11]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
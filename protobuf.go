@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Protobuf body decoding (PROTOBUF_DESCRIPTOR_SET + PROTOBUF_TYPES). The
+// descriptor set is the output of `protoc --descriptor_set_out`; it is itself
+// a protobuf message, so it is read with the same hand-written wire-format
+// decoder used for bodies — no protobuf library is needed. Bodies whose media
+// type is mapped to a message type are converted to proto3-style JSON (64-bit
+// integers as strings, bytes as base64, enums as numbers) and then sanitized
+// like any other JSON body.
+
+// Field types from google.protobuf.FieldDescriptorProto.Type.
+const (
+	protoDouble   = 1
+	protoFloat    = 2
+	protoInt64    = 3
+	protoUint64   = 4
+	protoInt32    = 5
+	protoFixed64  = 6
+	protoFixed32  = 7
+	protoBool     = 8
+	protoString   = 9
+	protoGroup    = 10
+	protoMessage  = 11
+	protoBytes    = 12
+	protoUint32   = 13
+	protoEnum     = 14
+	protoSfixed32 = 15
+	protoSfixed64 = 16
+	protoSint32   = 17
+	protoSint64   = 18
+)
+
+// protoMaxDepth bounds message nesting so a hostile body cannot recurse deeply.
+const protoMaxDepth = 32
+
+// protoRegistry maps fully-qualified message names ("acme.v1.Event") to their
+// descriptors.
+type protoRegistry map[string]*protoMessageDesc
+
+type protoMessageDesc struct {
+	fields map[uint64]protoFieldDesc
+}
+
+type protoFieldDesc struct {
+	name     string // json_name when present, else the field name
+	kind     uint64
+	repeated bool
+	typeName string // message type for protoMessage fields, without the leading "."
+}
+
+// loadProtoDescriptorSet reads and parses a FileDescriptorSet file.
+func loadProtoDescriptorSet(path string) (protoRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseProtoDescriptorSet(data)
+}
+
+// parseProtoDescriptorSet collects every message, nested ones included, from
+// a serialized FileDescriptorSet.
+func parseProtoDescriptorSet(data []byte) (protoRegistry, error) {
+	reg := protoRegistry{}
+	err := walkProto(data, func(num, wt uint64, v uint64, b []byte) error {
+		if num != 1 || wt != 2 { // FileDescriptorSet.file
+			return nil
+		}
+		var pkg string
+		var messages [][]byte
+		err := walkProto(b, func(num, wt uint64, _ uint64, b []byte) error {
+			switch {
+			case num == 2 && wt == 2: // package
+				pkg = string(b)
+			case num == 4 && wt == 2: // message_type
+				messages = append(messages, b)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, m := range messages {
+			if err := reg.addMessage(pkg, m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("parse descriptor set: %w", err)
+	}
+	if len(reg) == 0 {
+		return nil, errors.New("descriptor set contains no messages")
+	}
+	return reg, nil
+}
+
+// addMessage registers one DescriptorProto under scope and recurses into its
+// nested types.
+func (reg protoRegistry) addMessage(scope string, data []byte) error {
+	desc := &protoMessageDesc{fields: map[uint64]protoFieldDesc{}}
+	var name string
+	var nested [][]byte
+	err := walkProto(data, func(num, wt uint64, _ uint64, b []byte) error {
+		if wt != 2 {
+			return nil
+		}
+		switch num {
+		case 1: // name
+			name = string(b)
+		case 2: // field
+			number, f, err := parseProtoField(b)
+			if err != nil {
+				return err
+			}
+			desc.fields[number] = f
+		case 3: // nested_type
+			nested = append(nested, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	full := name
+	if scope != "" {
+		full = scope + "." + name
+	}
+	reg[full] = desc
+	for _, n := range nested {
+		if err := reg.addMessage(full, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseProtoField decodes one FieldDescriptorProto.
+func parseProtoField(data []byte) (uint64, protoFieldDesc, error) {
+	var number uint64
+	var f protoFieldDesc
+	var jsonName string
+	err := walkProto(data, func(num, wt uint64, v uint64, b []byte) error {
+		switch {
+		case num == 1 && wt == 2:
+			f.name = string(b)
+		case num == 3 && wt == 0:
+			number = v
+		case num == 4 && wt == 0:
+			f.repeated = v == 3 // LABEL_REPEATED
+		case num == 5 && wt == 0:
+			f.kind = v
+		case num == 6 && wt == 2:
+			f.typeName = strings.TrimPrefix(string(b), ".")
+		case num == 10 && wt == 2:
+			jsonName = string(b)
+		}
+		return nil
+	})
+	if jsonName != "" {
+		f.name = jsonName
+	}
+	return number, f, err
+}
+
+// walkProto calls fn for every field of a serialized message. For varint
+// fields v holds the value; for fixed32/fixed64 fields v holds the raw bits;
+// for length-delimited fields b holds the payload. Groups are rejected.
+func walkProto(data []byte, fn func(num, wt uint64, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("bad field key")
+		}
+		data = data[n:]
+		num, wt := key>>3, key&7
+		if num == 0 {
+			return errors.New("field number 0")
+		}
+		var v uint64
+		var b []byte
+		switch wt {
+		case 0:
+			v, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("bad varint")
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return errors.New("truncated fixed64")
+			}
+			v, data = binary.LittleEndian.Uint64(data), data[8:]
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return errors.New("bad length")
+			}
+			b, data = data[n:n+int(l)], data[n+int(l):]
+		case 5:
+			if len(data) < 4 {
+				return errors.New("truncated fixed32")
+			}
+			v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", wt)
+		}
+		if err := fn(num, wt, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeProtobufBody converts body to JSON when the media type of contentType
+// is mapped in PROTOBUF_TYPES and a descriptor set is loaded. ok is false —
+// and the body is handled as before, normally as a binary summary — when the
+// type is not mapped or the body does not decode as the mapped message
+// (unknown field numbers or mismatched wire types).
+func decodeProtobufBody(body, contentType string, cfg Config) (string, bool) {
+	if body == "" || len(cfg.ProtoRegistry) == 0 || contentType == "" {
+		return "", false
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	msgName := cfg.ProtoTypes[mt]
+	if msgName == "" {
+		return "", false
+	}
+	obj, err := decodeProtoMessage(cfg.ProtoRegistry, msgName, []byte(body), 0)
+	if err != nil {
+		return "", false
+	}
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return "", false
+	}
+	return string(out), true
+}
+
+// decodeProtoMessage decodes data as the message msgName into a JSON-ready map.
+func decodeProtoMessage(reg protoRegistry, msgName string, data []byte, depth int) (map[string]any, error) {
+	if depth > protoMaxDepth {
+		return nil, errors.New("message nesting too deep")
+	}
+	desc := reg[strings.TrimPrefix(msgName, ".")]
+	if desc == nil {
+		return nil, fmt.Errorf("unknown message type %q", msgName)
+	}
+	obj := map[string]any{}
+	err := walkProto(data, func(num, wt uint64, v uint64, b []byte) error {
+		f, ok := desc.fields[num]
+		if !ok {
+			return fmt.Errorf("unknown field %d in %s", num, msgName)
+		}
+		var values []any
+		if wt == 2 && f.repeated && protoPackable(f.kind) {
+			var err error
+			if values, err = decodePackedProto(f.kind, b); err != nil {
+				return err
+			}
+		} else {
+			val, err := decodeProtoValue(reg, f, wt, v, b, depth)
+			if err != nil {
+				return err
+			}
+			values = []any{val}
+		}
+		if !f.repeated {
+			obj[f.name] = values[len(values)-1]
+			return nil
+		}
+		list, _ := obj[f.name].([]any)
+		obj[f.name] = append(list, values...)
+		return nil
+	})
+	return obj, err
+}
+
+// protoPackable reports whether a repeated field of kind may use packed
+// encoding (every scalar numeric type).
+func protoPackable(kind uint64) bool {
+	switch kind {
+	case protoString, protoBytes, protoMessage, protoGroup:
+		return false
+	}
+	return true
+}
+
+// decodePackedProto decodes a packed repeated scalar field.
+func decodePackedProto(kind uint64, data []byte) ([]any, error) {
+	var wt uint64
+	switch kind {
+	case protoDouble, protoFixed64, protoSfixed64:
+		wt = 1
+	case protoFloat, protoFixed32, protoSfixed32:
+		wt = 5
+	}
+	var out []any
+	for len(data) > 0 {
+		var v uint64
+		switch wt {
+		case 0:
+			var n int
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return nil, errors.New("bad packed varint")
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return nil, errors.New("truncated packed fixed64")
+			}
+			v, data = binary.LittleEndian.Uint64(data), data[8:]
+		case 5:
+			if len(data) < 4 {
+				return nil, errors.New("truncated packed fixed32")
+			}
+			v, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		}
+		val, err := protoScalar(kind, wt, v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, val)
+	}
+	return out, nil
+}
+
+// decodeProtoValue decodes one non-packed field value.
+func decodeProtoValue(reg protoRegistry, f protoFieldDesc, wt, v uint64, b []byte, depth int) (any, error) {
+	switch f.kind {
+	case protoString:
+		if wt != 2 {
+			return nil, errors.New("string field with wrong wire type")
+		}
+		return string(b), nil
+	case protoBytes:
+		if wt != 2 {
+			return nil, errors.New("bytes field with wrong wire type")
+		}
+		return base64.StdEncoding.EncodeToString(b), nil
+	case protoMessage:
+		if wt != 2 {
+			return nil, errors.New("message field with wrong wire type")
+		}
+		return decodeProtoMessage(reg, f.typeName, b, depth+1)
+	}
+	return protoScalar(f.kind, wt, v)
+}
+
+// protoScalar converts a numeric or bool value to its proto3 JSON form,
+// checking that the wire type matches the declared kind.
+func protoScalar(kind, wt, v uint64) (any, error) {
+	want := uint64(0)
+	switch kind {
+	case protoDouble, protoFixed64, protoSfixed64:
+		want = 1
+	case protoFloat, protoFixed32, protoSfixed32:
+		want = 5
+	case protoGroup:
+		return nil, errors.New("groups are not supported")
+	}
+	if wt != want {
+		return nil, fmt.Errorf("field of type %d with wire type %d", kind, wt)
+	}
+	switch kind {
+	case protoDouble:
+		return protoJSONFloat(math.Float64frombits(v)), nil
+	case protoFloat:
+		return protoJSONFloat(float64(math.Float32frombits(uint32(v)))), nil
+	case protoInt64, protoSfixed64:
+		return strconv.FormatInt(int64(v), 10), nil
+	case protoUint64, protoFixed64:
+		return strconv.FormatUint(v, 10), nil
+	case protoSint64:
+		return strconv.FormatInt(int64(v>>1)^-int64(v&1), 10), nil
+	case protoInt32, protoSfixed32, protoEnum:
+		return int32(v), nil
+	case protoSint32:
+		return int32(v>>1) ^ -int32(v&1), nil
+	case protoUint32, protoFixed32:
+		return uint32(v), nil
+	case protoBool:
+		return v != 0, nil
+	}
+	return nil, fmt.Errorf("unknown field type %d", kind)
+}
+
+// protoJSONFloat maps NaN and infinities to the strings proto3 JSON uses,
+// since encoding/json cannot marshal them.
+func protoJSONFloat(f float64) any {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+	return f
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// recentBuffer keeps the last N log entries in memory for the /recent
+// endpoint on the health server (RECENT_BUFFER_SIZE). Entries are stored as
+// built — after body selection and every redaction step — so the endpoint
+// exposes nothing the log itself would not.
+type recentBuffer struct {
+	mu      sync.Mutex
+	entries []logEntry // ring; next is the slot written next
+	next    int
+	full    bool
+}
+
+// recentEntries is the process-wide buffer; main replaces it from the config.
+// The zero-size default records nothing.
+var recentEntries = newRecentBuffer(0)
+
+func newRecentBuffer(size int) *recentBuffer {
+	return &recentBuffer{entries: make([]logEntry, max(size, 0))}
+}
+
+// add records entry, overwriting the oldest one when the buffer is full.
+func (b *recentBuffer) add(entry logEntry) {
+	if len(b.entries) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries[b.next] = entry
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// snapshot returns the buffered entries, oldest first.
+func (b *recentBuffer) snapshot() []logEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		return append([]logEntry(nil), b.entries[:b.next]...)
+	}
+	out := make([]logEntry, 0, len(b.entries))
+	out = append(out, b.entries[b.next:]...)
+	return append(out, b.entries[:b.next]...)
+}
+
+// recentHandler serves the buffer as a JSON array, oldest entry first. When
+// LOG_KEY_ALLOWLIST is set each entry is filtered the same way as in the log.
+func recentHandler(buf *recentBuffer, allowKeys []string) http.HandlerFunc {
+	allow := make(map[string]bool, len(allowKeys))
+	for _, k := range allowKeys {
+		allow[k] = true
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var out bytes.Buffer
+		out.WriteByte('[')
+		for i, entry := range buf.snapshot() {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				continue
+			}
+			if len(allow) > 0 {
+				data, _ = filterEntryKeys(data, allow)
+			}
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			out.Write(data)
+		}
+		out.WriteString("]\n")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(out.Bytes())
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// replay feeds previously captured ICAP messages back through the parser
+// ("icap-logger replay <file>") and prints the log entries the live server
+// would have written, one per line, to out. It is the offline half of
+// DEBUG_RAW_CAPTURE: after fixing a parser bug, replaying the capture file
+// shows what the entries look like now.
+//
+// The input is either a capture file (JSON records as written by rawCapture,
+// recognised by a leading "{") or a plain stream of raw ICAP messages sent
+// back to back. A LOG_FORMAT=msgpack log file, recognised by the zero first
+// byte of its length prefix, is not replayed but decoded: its entries are
+// printed as JSON (see replayMsgpack). Each message goes through readICAPMessage, parseICAP,
+// buildLogEntry, the request hooks, and the encoder exactly as on a live
+// connection, only without a socket: no responses are written, and host
+// filters, sampling, and dedup are not applied. Configuration comes from the
+// environment as usual, so redaction and LOG_FORMAT match the server.
+//
+// Records that cannot be decoded are reported on errOut and skipped; the
+// returned error says how many there were.
+func replay(in io.Reader, out, errOut io.Writer, cfg Config) error {
+	r := bufio.NewReader(in)
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil // empty input
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		_, _ = r.ReadByte()
+	}
+	if strings.EqualFold(cfg.LogFormat, "msgpack") {
+		cfg.LogFormat = "json" // replay output is for reading
+	}
+	b, _ := r.Peek(1)
+	switch {
+	case b[0] == '{':
+		return replayCaptures(r, out, errOut, cfg)
+	case b[0] == 0:
+		return replayMsgpack(r, out)
+	}
+	return replayRawStream(r, out, errOut, cfg)
+}
+
+// replayMsgpack decodes a LOG_FORMAT=msgpack log file and prints each record
+// as a JSON line: entries as the JSON encoder writes them, and the
+// {"error": ...} records written in place of a lost entry as they are. It
+// stops at the first broken record, since the framing after it cannot be
+// trusted.
+func replayMsgpack(r *bufio.Reader, out io.Writer) error {
+	for n := 1; ; n++ {
+		rec, err := readMsgpackRecord(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+		var data []byte
+		if _, ok := rec["error"]; ok {
+			data, err = json.Marshal(rec)
+		} else {
+			var entry logEntry
+			if entry, err = msgpackRecordEntry(rec); err == nil {
+				data, err = json.Marshal(entry)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+		if _, err := out.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+}
+
+// replayCaptures replays a capture file, one rawCaptureRecord per line.
+// The entries keep the capture's timestamp and client address.
+func replayCaptures(r *bufio.Reader, out, errOut io.Writer, cfg Config) error {
+	failed := 0
+	for lineNo := 1; ; lineNo++ {
+		line, err := r.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if rerr := replayRecord(line, out, cfg); rerr != nil {
+				fmt.Fprintf(errOut, "replay: line %d: %v\n", lineNo, rerr)
+				failed++
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d record(s) could not be replayed", failed)
+	}
+	return nil
+}
+
+// replayRecord decodes one capture record and replays its raw message.
+func replayRecord(line []byte, out io.Writer, cfg Config) error {
+	var rec rawCaptureRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return fmt.Errorf("not a capture record: %w", err)
+	}
+	raw := []byte(rec.Raw)
+	if rec.RawBase64 != "" {
+		var err error
+		if raw, err = base64.StdEncoding.DecodeString(rec.RawBase64); err != nil {
+			return fmt.Errorf("raw_base64: %w", err)
+		}
+	}
+	if len(raw) == 0 {
+		return errors.New("record has no raw message")
+	}
+	buf, _, err := readICAPMessage(bufio.NewReader(bytes.NewReader(raw)), nil, cfg)
+	if len(buf) == 0 {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	// A truncated capture ends mid-message; the partial bytes are still
+	// parsed, as the live server would have after a short read.
+	entry := replayEntry(buf, cfg)
+	if rec.Timestamp != "" {
+		entry.Timestamp = rec.Timestamp
+	}
+	if rec.ClientAddr != "" {
+		entry.ClientAddr = rec.ClientAddr
+	}
+	return writeReplayEntry(entry, out, cfg)
+}
+
+// replayRawStream replays raw ICAP messages read back to back from r, as a
+// persistent connection would deliver them.
+func replayRawStream(r *bufio.Reader, out, errOut io.Writer, cfg Config) error {
+	for n := 1; ; n++ {
+		buf, _, err := readICAPMessage(r, nil, cfg)
+		if len(buf) > 0 {
+			if werr := writeReplayEntry(replayEntry(buf, cfg), out, cfg); werr != nil {
+				return werr
+			}
+		}
+		if errors.Is(err, errMessageTooLarge) {
+			fmt.Fprintf(errOut, "replay: message %d exceeds MAX_BODY_SIZE; stopping\n", n)
+			return err
+		}
+		if err != nil || len(buf) == 0 {
+			return nil
+		}
+		if _, perr := r.Peek(1); perr != nil {
+			return nil
+		}
+	}
+}
+
+// replayEntry turns one raw message into its log entry the way the log
+// goroutine in serveICAPMessage does.
+func replayEntry(buf []byte, cfg Config) logEntry {
+	info := parseICAP(buf, cfg)
+	entry := buildLogEntry(info, cfg)
+	runRequestHooks(info, &entry)
+	return entry
+}
+
+// writeReplayEntry encodes entry (split when SPLIT_ENTRIES is on) to out.
+func writeReplayEntry(entry logEntry, out io.Writer, cfg Config) error {
+	entries := []logEntry{entry}
+	if cfg.SplitEntries {
+		entries = splitLogEntry(entry)
+	}
+	for _, e := range entries {
+		data, err := encodeEntry(e, cfg)
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayCommand runs "replay [file]" from the command line. A missing file
+// argument or "-" reads stdin. It returns the process exit code.
+func replayCommand(args []string, cfg Config) int {
+	in := io.Reader(os.Stdin)
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: icap-logger replay [file|-]")
+		return 2
+	}
+	if len(args) == 1 && args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "replay:", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	out := bufio.NewWriter(os.Stdout)
+	err := replay(in, out, os.Stderr, cfg)
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 1
+	}
+	return 0
+}
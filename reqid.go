@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Request IDs (LOG_REQ_ID) tie together the entries of one HTTP transaction
+// as it passes through several ICAP stages — typically its REQMOD and its
+// RESPMOD. The ID is taken from the first of REQ_ID_HEADERS the ICAP client
+// sent (Squid can add one with adaptation_meta), so every stage sees the
+// same value; without such a header a random UUID is generated, which still
+// identifies the entry. The ID is logged as req_id and echoed to the client
+// as X-Log-Id on the ICAP response so it can be correlated upstream too.
+
+// maxReqIDLen caps a request ID taken from a header.
+const maxReqIDLen = 128
+
+// transactionID returns the value of the first header in names (in the
+// order given, matched case-insensitively) found in the ICAP header section
+// hdr, or "" when none is present or its value is unusable: empty, longer
+// than maxReqIDLen, or containing control characters.
+func transactionID(hdr []byte, names []string) string {
+	values := make(map[string]string, len(names))
+	for _, line := range bytes.Split(hdr, []byte("\n")) {
+		name, value, ok := strings.Cut(strings.TrimRight(string(line), "\r"), ":")
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, seen := values[name]; !seen {
+			values[name] = strings.TrimSpace(value)
+		}
+	}
+	for _, name := range names {
+		if v := values[strings.ToLower(strings.TrimSpace(name))]; validReqID(v) {
+			return v
+		}
+	}
+	return ""
+}
+
+// validReqID reports whether v is safe to log and to echo in a header.
+func validReqID(v string) bool {
+	if v == "" || len(v) > maxReqIDLen {
+		return false
+	}
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x20 || v[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// As in newCorrelationID: never expected, but keep IDs unique-ish.
+		return fmt.Sprintf("%032x", time.Now().UnixNano())
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// logIDLine returns the X-Log-Id header line (with CRLF) for a response to
+// the request described by meta, or "" when it has no request ID.
+func logIDLine(meta icapMeta) string {
+	if meta.reqID == "" {
+		return ""
+	}
+	return "X-Log-Id: " + meta.reqID + "\r\n"
+}
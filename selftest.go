@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Self-test ("icap-logger --selftest"). It acts as a minimal ICAP client
+// against the running server on the configured port: it sends an OPTIONS and
+// then a REQMOD carrying Allow: 204 — on the same connection, as Squid does,
+// unless the server closed it (KEEP_ALIVE=false) — and expects a valid
+// OPTIONS response and a 204. Each check is printed as PASS or FAIL and the
+// exit code is 0 only when both pass, so it can be used as a deployment
+// smoke test. The REQMOD is logged like any other; its
+// request carries the User-Agent "icap-logger-selftest".
+//
+// The first listener (ICAP_LISTENERS, else ICAP_PORT) is tested, using its
+// service, else the first ICAP_SERVICES entry offering REQMOD, else reqmod.
+// When TLS_CERT is set the connection uses TLS without verifying the
+// certificate; a listener requiring client certificates cannot be tested.
+
+// selftestTimeout bounds the whole self-test connection.
+const selftestTimeout = 10 * time.Second
+
+// buildICAP assembles a raw ICAP message from its request line, ICAP header
+// lines, and encapsulated section, adding the blank line that ends the ICAP
+// headers when icapHeaders lacks it.
+func buildICAP(requestLine, icapHeaders, encapsulated string) []byte {
+	msg := requestLine + "\r\n" + icapHeaders
+	if !strings.HasSuffix(icapHeaders, "\r\n\r\n") {
+		msg += "\r\n"
+	}
+	msg += encapsulated
+	return []byte(msg)
+}
+
+// selftestRequested reports whether --selftest is among the arguments.
+func selftestRequested(args []string) bool {
+	for _, arg := range args {
+		if arg == "--selftest" || arg == "-selftest" {
+			return true
+		}
+	}
+	return false
+}
+
+// selftestCommand runs the self-test against the configured listener and
+// returns the process exit code.
+func selftestCommand(cfg Config) int {
+	l := listenerConfigs(cfg)[0]
+	var tlsCfg *tls.Config
+	if cfg.TLSCert != "" && cfg.TLSKey != "" {
+		tlsCfg = &tls.Config{InsecureSkipVerify: true} // checks the ICAP exchange, not the certificate
+	}
+	if !selftest(selftestAddr(cfg.ICAPBindAddr, l.Port), selftestService(l, cfg), tlsCfg, os.Stdout) {
+		return 1
+	}
+	return 0
+}
+
+// selftestAddr is the address to dial for a listener bound to bind:
+// loopback when it listens on every interface.
+func selftestAddr(bind, port string) string {
+	switch strings.Trim(strings.TrimSpace(bind), "[]") {
+	case "", "0.0.0.0":
+		bind = "127.0.0.1"
+	case "::":
+		bind = "::1"
+	}
+	return listenAddr(bind, port)
+}
+
+// selftestService picks the service path the REQMOD is sent to.
+func selftestService(l ListenerConfig, cfg Config) string {
+	if l.Service != "" {
+		return l.Service
+	}
+	var names []string
+	for name, svc := range cfg.ICAPServices {
+		for _, m := range svc.Methods {
+			if m == "REQMOD" {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	if len(names) == 0 {
+		return "reqmod"
+	}
+	sort.Strings(names)
+	return names[0]
+}
+
+// selftest runs the OPTIONS and REQMOD checks against addr, printing one
+// PASS/FAIL line per check and a summary to out. tlsCfg, when non-nil, wraps
+// the connection in TLS. It reports whether every check passed.
+func selftest(addr, service string, tlsCfg *tls.Config, out io.Writer) bool {
+	url := "icap://" + addr + "/" + service
+	fail := func(check string, err error) bool {
+		fmt.Fprintf(out, "FAIL %s %s: %v\n", check, url, err)
+		fmt.Fprintln(out, "selftest failed")
+		return false
+	}
+	conn, err := selftestDial(addr, tlsCfg)
+	if err != nil {
+		return fail("connect", err)
+	}
+	defer func() { conn.Close() }()
+	r := bufio.NewReader(conn)
+
+	options := buildICAP("OPTIONS "+url+" ICAP/1.0",
+		"Host: "+addr+"\r\nEncapsulated: null-body=0\r\n", "")
+	status, hdr, err := selftestExchange(conn, r, options)
+	if err == nil {
+		err = checkOptionsResponse(status, hdr)
+	}
+	if err != nil {
+		return fail("OPTIONS", err)
+	}
+	fmt.Fprintf(out, "PASS OPTIONS %s: %s (Methods: %s)\n", url, status, hdr.Get("Methods"))
+	if strings.EqualFold(hdr.Get("Connection"), "close") { // KEEP_ALIVE=false
+		conn.Close()
+		if conn, err = selftestDial(addr, tlsCfg); err != nil {
+			return fail("connect", err)
+		}
+		r.Reset(conn)
+	}
+
+	httpReq := "GET http://selftest.invalid/ HTTP/1.1\r\n" +
+		"Host: selftest.invalid\r\nUser-Agent: icap-logger-selftest\r\n\r\n"
+	reqmod := buildICAP("REQMOD "+url+" ICAP/1.0",
+		"Host: "+addr+"\r\nAllow: 204\r\nEncapsulated: req-hdr=0, null-body="+
+			fmt.Sprint(len(httpReq))+"\r\n", httpReq)
+	status, _, err = selftestExchange(conn, r, reqmod)
+	if err == nil && !strings.HasPrefix(status, "204") {
+		err = fmt.Errorf("got ICAP %s, want 204", status)
+	}
+	if err != nil {
+		return fail("REQMOD", err)
+	}
+	fmt.Fprintf(out, "PASS REQMOD %s: %s\n", url, status)
+	fmt.Fprintln(out, "selftest passed")
+	return true
+}
+
+// selftestDial connects to addr, over TLS when tlsCfg is set, with the
+// connection deadline set to selftestTimeout.
+func selftestDial(addr string, tlsCfg *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: selftestTimeout}
+	var conn net.Conn
+	var err error
+	if tlsCfg != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsCfg)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(selftestTimeout))
+	return conn, nil
+}
+
+// selftestExchange writes msg and reads the response status line and
+// headers. It returns the status without the "ICAP/1.0 " prefix, e.g.
+// "204 No Modifications". Neither expected response has a body.
+func selftestExchange(conn net.Conn, r *bufio.Reader, msg []byte) (string, textproto.MIMEHeader, error) {
+	if _, err := conn.Write(msg); err != nil {
+		return "", nil, err
+	}
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return "", nil, fmt.Errorf("read status line: %w", err)
+	}
+	proto, status, ok := strings.Cut(line, " ")
+	if !ok || !strings.HasPrefix(proto, "ICAP/") {
+		return "", nil, fmt.Errorf("malformed status line %q", line)
+	}
+	hdr, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return "", nil, fmt.Errorf("read headers: %w", err)
+	}
+	return status, hdr, nil
+}
+
+// checkOptionsResponse checks an OPTIONS response is a 200 carrying the
+// headers Squid needs: Methods offering REQMOD, an ISTag, and Encapsulated.
+func checkOptionsResponse(status string, hdr textproto.MIMEHeader) error {
+	if !strings.HasPrefix(status, "200") {
+		return fmt.Errorf("got ICAP %s, want 200", status)
+	}
+	for _, name := range []string{"Methods", "ISTag", "Encapsulated"} {
+		if hdr.Get(name) == "" {
+			return fmt.Errorf("response has no %s header", name)
+		}
+	}
+	if !strings.Contains(hdr.Get("Methods"), "REQMOD") {
+		return fmt.Errorf("service offers %s, not REQMOD", hdr.Get("Methods"))
+	}
+	return nil
+}
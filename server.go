@@ -3,36 +3,170 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // icapOptionsResponse returns a valid ICAP OPTIONS response for the given
 // service URL. Squid reads this on startup to confirm the service is alive
 // and to learn its capabilities (methods, TTL, preview size, etc.).
-func icapOptionsResponse(serviceURL string) string {
-	method := "REQMOD"
-	if strings.Contains(strings.ToLower(serviceURL), "respmod") {
-		method = "RESPMOD"
+// The Preview header advertises cfg.PreviewSize and is omitted when negative.
+// With ICAP_SERVICES the methods and overrides come from the service's
+// registry entry, and an unlisted service gets ICAP 404.
+func icapOptionsResponse(serviceURL string, keepAlive bool, cfg Config) string {
+	svc, ok := lookupICAPService(serviceURL, cfg)
+	if !ok {
+		return icapServiceError(icapStatusNotFound, keepAlive, cfg)
 	}
-	return strings.Join([]string{
+	cfg = svc.serviceCfg(cfg)
+	lines := []string{
 		"ICAP/1.0 200 OK",
-		"Methods: " + method,
+		"Methods: " + strings.Join(svc.Methods, ", "),
 		"Service: icap-logger/1.0",
-		`ISTag: "icap-logger-1.0"`,
+		istagHeader(cfg.ISTag),
 		"Encapsulated: null-body=0",
-		"Max-Connections: 100",
-		"Options-TTL: 3600",
-		"Allow: 204",
-		"Connection: close",
-		"\r\n",
-	}, "\r\n")
+		"Max-Connections: " + strconv.Itoa(optionsMaxConnections(cfg)),
+		"Options-TTL: " + strconv.Itoa(optionsTTL(cfg)),
+		"Allow: " + optionsAllow(cfg),
+	}
+	if cfg.PreviewSize >= 0 {
+		lines = append(lines, "Preview: "+strconv.Itoa(cfg.PreviewSize))
+	}
+	if len(cfg.TransferIgnore) > 0 {
+		lines = append(lines, "Transfer-Ignore: "+strings.Join(cfg.TransferIgnore, ", "))
+	}
+	lines = append(lines, connectionHeader(keepAlive), "\r\n")
+	return strings.Join(lines, "\r\n")
+}
+
+// istagHeader formats the ISTag response header line.
+func istagHeader(tag string) string {
+	return `ISTag: "` + tag + `"`
+}
+
+// defaultISTag derives the ISTag used when ICAP_ISTAG is unset from the build
+// version, the short git commit when known, and a hash of the build metadata
+// and effective configuration, so Squid invalidates cached OPTIONS and
+// adaptation decisions when the binary or its settings change but not on a
+// plain restart. The result fits the 32-character limit of RFC 3507 §4.7.
+func defaultISTag(cfg Config) string {
+	cfg.ISTag = ""
+	cfg.PIIPatterns = nil   // compiled regexps would hash by address
+	cfg.ProtoRegistry = nil // likewise the descriptor pointers
+	sum := sha256.Sum256(fmt.Appendf(nil, "%s|%s|%s|%+v", version, commit, buildDate, cfg))
+	tag := version + "-"
+	if commit != "" && commit != "unknown" {
+		tag += commit[:min(len(commit), 7)] + "-"
+	}
+	tag += hex.EncodeToString(sum[:6])
+	if len(tag) > 32 {
+		tag = tag[len(tag)-32:]
+	}
+	return tag
+}
+
+// optionsMaxConnections is the Max-Connections value advertised in OPTIONS:
+// OPTIONS_MAX_CONNECTIONS when set, otherwise MAX_CONCURRENT_CONNS when that
+// caps connections, otherwise 100.
+func optionsMaxConnections(cfg Config) int {
+	switch {
+	case cfg.OptionsMaxConns > 0:
+		return cfg.OptionsMaxConns
+	case cfg.MaxConcurrentConns > 0:
+		return cfg.MaxConcurrentConns
+	default:
+		return 100
+	}
+}
+
+// optionsTTL is the Options-TTL value in seconds; non-positive means 3600.
+func optionsTTL(cfg Config) int {
+	if cfg.OptionsTTL <= 0 {
+		return 3600
+	}
+	return int(cfg.OptionsTTL / time.Second)
+}
+
+// optionsAllow is the Allow value advertised in OPTIONS: "204", plus "206"
+// when ALLOW_206 is enabled.
+func optionsAllow(cfg Config) string {
+	if cfg.Allow206 {
+		return "204, 206"
+	}
+	return "204"
+}
+
+// icapContinueResponse is sent after a preview that did not end in ieof to
+// ask the client for the rest of the body (RFC 3507 §4.5).
+const icapContinueResponse = "ICAP/1.0 100 Continue\r\n\r\n"
+
+// writeContinue sends icapContinueResponse on conn within WRITE_TIMEOUT_SEC.
+func writeContinue(conn net.Conn, cfg Config) error {
+	if cfg.WriteTimeout > 0 {
+		if err := conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout)); err != nil {
+			return err
+		}
+	}
+	_, err := conn.Write([]byte(icapContinueResponse))
+	return err
+}
+
+// errDuplicateEncapsulated is returned by readICAPMessage when the ICAP
+// headers contain more than one Encapsulated header.
+var errDuplicateEncapsulated = errors.New("multiple Encapsulated headers")
+
+// errMessageTooLarge is returned by readICAPMessage when a message exceeds
+// MAX_BODY_SIZE. With OVERSIZE_MODE=truncate an oversized body is cut short
+// instead and no error is returned; oversized headers always fail.
+var errMessageTooLarge = errors.New("ICAP message exceeds max size")
+
+// icapTooLargeResponse answers a message rejected with errMessageTooLarge.
+// The rest of the message is unread, so the connection is always closed.
+const icapTooLargeResponse = "ICAP/1.0 413 Request Entity Too Large\r\nConnection: close\r\nEncapsulated: null-body=0\r\n\r\n"
+
+// icapBadRequestResponse answers a message that is not ICAP at all or whose
+// framing cannot be trusted; the connection is closed after it.
+const icapBadRequestResponse = "ICAP/1.0 400 Bad Request\r\nConnection: close\r\nEncapsulated: null-body=0\r\n\r\n"
+
+// icapRequestTimeoutResponse is sent, with READ_TIMEOUT_RESPONSE, when the
+// read deadline expires mid-message; the connection is closed after it.
+const icapRequestTimeoutResponse = "ICAP/1.0 408 Request Timeout\r\nConnection: close\r\nEncapsulated: null-body=0\r\n\r\n"
+
+// validICAPRequestLine reports whether line looks like an ICAP request line:
+// OPTIONS, REQMOD, or RESPMOD, a URI, and an ICAP/ version. Anything else —
+// an HTTP health probe, a port scanner, a TLS handshake on the plaintext
+// port — is answered with 400 and never logged.
+func validICAPRequestLine(line string) bool {
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "ICAP/") {
+		return false
+	}
+	switch parts[0] {
+	case "OPTIONS", "REQMOD", "RESPMOD":
+		return true
+	}
+	return false
+}
+
+// connectionHeader returns the Connection header line for an ICAP response.
+func connectionHeader(keepAlive bool) string {
+	if keepAlive {
+		return "Connection: keep-alive"
+	}
+	return "Connection: close"
 }
 
 // readICAPMessage reads exactly one complete ICAP message from r without
@@ -46,14 +180,31 @@ func icapOptionsResponse(serviceURL string) string {
 //     This is done even when null-body is present — null-body only means there
 //     is no chunked body section, not that req-hdr is absent.
 //  3. Read chunked body (req-body / res-body) until "0\r\n\r\n".
-//     Skipped when null-body is present.
+//     Skipped when null-body is present. When the request carries a Preview
+//     header the body arrives in two phases: the preview ends with a zero
+//     chunk, and unless that chunk carries "ieof" a 100 Continue is written to
+//     conn and the remainder is read. The preview's zero chunk is dropped from
+//     the returned buffer so it holds one continuous chunked body.
+//     Without a preview, a REQMOD whose encapsulated HTTP request carries
+//     "Expect: 100-continue" is sent a 100 Continue first when
+//     EXPECT_CONTINUE is on and none of the body has arrived yet.
+//     A body some clients send unchunked, framed only by the Content-Length
+//     of its HTTP headers, is read by length instead and stored re-chunked
+//     (see bodyFraming.unchunked).
 //
 // It also fills an icapMeta so the caller can call allow204 and
 // buildICAPEchoResponse without re-scanning the returned buffer.
-func readICAPMessage(r *bufio.Reader, maxSize int64) ([]byte, icapMeta, error) {
+//
+// conn is the connection r reads from; it is used to tighten the read
+// deadline while the body is read (BODY_READ_DEADLINE_SEC) and to send
+// 100 Continue after a preview. It may be nil when reading from a fixed
+// buffer, in which case both are skipped.
+func readICAPMessage(r *bufio.Reader, conn net.Conn, cfg Config) ([]byte, icapMeta, error) {
 	var buf bytes.Buffer
 	var total int64
 	var meta icapMeta
+	maxSize := cfg.MaxBodySize
+	start := time.Now()
 
 	// ── Step 1: ICAP request line + ICAP headers ─────────────────────────────
 	encapsulatedVal := ""
@@ -62,7 +213,7 @@ func readICAPMessage(r *bufio.Reader, maxSize int64) ([]byte, icapMeta, error) {
 		line, err := r.ReadString('\n')
 		total += int64(len(line))
 		if total > maxSize {
-			return buf.Bytes(), meta, fmt.Errorf("ICAP message exceeds max size")
+			return buf.Bytes(), meta, errMessageTooLarge
 		}
 		buf.WriteString(line)
 		if err != nil {
@@ -79,17 +230,36 @@ func readICAPMessage(r *bufio.Reader, maxSize int64) ([]byte, icapMeta, error) {
 		}
 		lower := strings.ToLower(trimmed)
 		if strings.HasPrefix(lower, "encapsulated:") {
+			// RFC 3507 §4.4 allows exactly one Encapsulated header. Two copies
+			// let a client make the framing used here disagree with the one a
+			// later parser picks (request-smuggling-style desync), so reject.
+			if encapsulatedVal != "" {
+				return buf.Bytes(), meta, errDuplicateEncapsulated
+			}
 			encapsulatedVal = strings.TrimSpace(trimmed[len("encapsulated:"):])
 			meta.encapsulated = encapsulatedVal
 			// keep lower-cased copy for contains checks below
 			encapsulatedVal = strings.ToLower(encapsulatedVal)
+		} else if strings.HasPrefix(lower, "connection:") {
+			for _, token := range strings.Split(lower[len("connection:"):], ",") {
+				if strings.TrimSpace(token) == "close" {
+					meta.connClose = true
+				}
+			}
+		} else if strings.HasPrefix(lower, "preview:") {
+			if n, err := strconv.Atoi(strings.TrimSpace(trimmed[len("preview:"):])); err == nil && n >= 0 {
+				meta.hasPreview = true
+				meta.preview = n
+			}
 		} else if strings.HasPrefix(lower, "allow:") {
 			// Scan the Allow value for the "204" token inline — no second pass needed.
 			val := strings.TrimSpace(trimmed[len("allow:"):])
 			for _, token := range strings.Split(val, ",") {
-				if strings.TrimSpace(token) == "204" {
+				switch strings.TrimSpace(token) {
+				case "204":
 					meta.allow204 = true
-					break
+				case "206":
+					meta.allow206 = true
 				}
 			}
 		}
@@ -105,12 +275,13 @@ func readICAPMessage(r *bufio.Reader, maxSize int64) ([]byte, icapMeta, error) {
 	// ── Step 2: encapsulated HTTP request headers (req-hdr) ──────────────────
 	// Read these even when null-body is present; null-body only signals that
 	// there is no body section — the header section is still there.
+	reqFraming, resFraming := newBodyFraming(), newBodyFraming()
 	if strings.Contains(encapsulatedVal, "req-hdr") {
 		for {
 			line, err := r.ReadString('\n')
 			total += int64(len(line))
 			if total > maxSize {
-				return buf.Bytes(), meta, fmt.Errorf("ICAP message exceeds max size")
+				return buf.Bytes(), meta, errMessageTooLarge
 			}
 			buf.WriteString(line)
 			if err != nil {
@@ -119,6 +290,7 @@ func readICAPMessage(r *bufio.Reader, maxSize int64) ([]byte, icapMeta, error) {
 			if strings.TrimRight(line, "\r\n") == "" {
 				break // blank line = end of HTTP request headers
 			}
+			reqFraming.observe(line)
 		}
 	}
 
@@ -128,7 +300,7 @@ func readICAPMessage(r *bufio.Reader, maxSize int64) ([]byte, icapMeta, error) {
 			line, err := r.ReadString('\n')
 			total += int64(len(line))
 			if total > maxSize {
-				return buf.Bytes(), meta, fmt.Errorf("ICAP message exceeds max size")
+				return buf.Bytes(), meta, errMessageTooLarge
 			}
 			buf.WriteString(line)
 			if err != nil {
@@ -137,6 +309,7 @@ func readICAPMessage(r *bufio.Reader, maxSize int64) ([]byte, icapMeta, error) {
 			if strings.TrimRight(line, "\r\n") == "" {
 				break // blank line = end of HTTP response headers
 			}
+			resFraming.observe(line)
 		}
 	}
 
@@ -147,26 +320,118 @@ func readICAPMessage(r *bufio.Reader, maxSize int64) ([]byte, icapMeta, error) {
 	hasNullBody := strings.Contains(encapsulatedVal, "null-body")
 
 	if hasBody && !hasNullBody {
+		// Cap total body-read time with an absolute deadline set once here, so
+		// a client dripping one byte at a time cannot hold the connection for
+		// longer than BodyReadDeadline regardless of per-read progress. The
+		// overall cap is ReadTimeout, or MessageMaxDuration when the read is
+		// governed by ReadIdleTimeout instead.
+		if conn != nil && cfg.BodyReadDeadline > 0 {
+			deadline := time.Now().Add(cfg.BodyReadDeadline)
+			overallLimit := cfg.ReadTimeout
+			if cfg.ReadIdleTimeout > 0 {
+				overallLimit = cfg.MessageMaxDuration
+			}
+			if overallLimit > 0 {
+				if overall := start.Add(overallLimit); overall.Before(deadline) {
+					deadline = overall
+				}
+			}
+			if err := conn.SetReadDeadline(deadline); err != nil {
+				return buf.Bytes(), meta, err
+			}
+		}
+		framing := reqFraming
+		if strings.Contains(encapsulatedVal, "res-body") {
+			framing = resFraming
+		} else if cfg.ExpectContinue && reqFraming.expectContinue && !meta.hasPreview &&
+			conn != nil && r.Buffered() == 0 {
+			// The client holds the req-body back until it gets a 100 Continue
+			// (EXPECT_CONTINUE). Nothing already buffered means it is waiting.
+			if err := writeContinue(conn, cfg); err != nil {
+				return buf.Bytes(), meta, err
+			}
+		}
+		if !meta.hasPreview && framing.unchunked(r) {
+			err := readFixedLengthBody(r, &buf, framing.contentLength, total, maxSize, cfg)
+			return buf.Bytes(), meta, err
+		}
+		inPreview := meta.hasPreview
 		for {
 			sizeLine, err := r.ReadString('\n')
 			total += int64(len(sizeLine))
-			buf.WriteString(sizeLine)
 			if err != nil {
+				buf.WriteString(sizeLine)
 				return buf.Bytes(), meta, err
 			}
 			sizeStr := strings.TrimSpace(sizeLine)
 			// Strip chunk extensions: "5;ext=val" → "5"
+			ext := ""
 			if idx := strings.IndexByte(sizeStr, ';'); idx >= 0 {
-				sizeStr = sizeStr[:idx]
+				sizeStr, ext = sizeStr[:idx], sizeStr[idx+1:]
 			}
 			size, err := strconv.ParseInt(sizeStr, 16, 64)
-			if err != nil || size == 0 {
-				// Terminating chunk — consume trailing \r\n
+			if err == nil && size == 0 && inPreview && hasIEOF(ext) {
+				// "0; ieof": the whole body fit in the preview, so nothing
+				// follows and no 100 Continue is owed. Fall through to the
+				// normal terminator handling below.
+				meta.ieof = true
+			} else if err == nil && size == 0 && inPreview {
+				// End of preview with more body to follow. Drop the preview
+				// terminator, ask for the remainder, and keep reading chunks.
+				trail, err := r.ReadString('\n')
+				total += int64(len(trail))
+				if err != nil {
+					return buf.Bytes(), meta, err
+				}
+				inPreview = false
+				if conn != nil {
+					if err := writeContinue(conn, cfg); err != nil {
+						return buf.Bytes(), meta, err
+					}
+				}
+				continue
+			}
+			buf.WriteString(sizeLine)
+			if err != nil {
+				// Unparseable size line — consume one more line and stop.
 				trail, _ := r.ReadString('\n')
 				buf.WriteString(trail)
 				break
 			}
+			if size == 0 {
+				// Terminating chunk: consume any trailer headers up to and
+				// including the blank line, so none are left behind to be
+				// misread as the next message on a keep-alive connection.
+				for {
+					trail, err := r.ReadString('\n')
+					total += int64(len(trail))
+					buf.WriteString(trail)
+					if err != nil || strings.TrimRight(trail, "\r\n") == "" {
+						break
+					}
+					if total > maxSize {
+						return buf.Bytes(), meta, errMessageTooLarge
+					}
+				}
+				break
+			}
 			if total+size > maxSize {
+				if !strings.EqualFold(cfg.OversizeMode, "truncate") {
+					return buf.Bytes(), meta, errMessageTooLarge
+				}
+				// Drop this chunk's size line and end the body here, but
+				// read the rest of it so a keep-alive connection stays in
+				// step; one that sends too much more is closed instead.
+				buf.Truncate(buf.Len() - len(sizeLine))
+				buf.WriteString("0\r\n\r\n")
+				done, err := discardChunks(r, size, maxSize)
+				if !done {
+					meta.connClose = true
+				}
+				var ne net.Error
+				if errors.As(err, &ne) && ne.Timeout() {
+					return buf.Bytes(), meta, err
+				}
 				break
 			}
 			// Read chunk data + trailing \r\n
@@ -175,6 +440,12 @@ func readICAPMessage(r *bufio.Reader, maxSize int64) ([]byte, icapMeta, error) {
 			total += int64(n)
 			buf.Write(chunk[:n])
 			if readErr != nil {
+				// A deadline expiring mid-chunk must end the message rather
+				// than hand a partial body on as if it were complete.
+				var ne net.Error
+				if errors.As(readErr, &ne) && ne.Timeout() {
+					return buf.Bytes(), meta, readErr
+				}
 				break
 			}
 		}
@@ -183,11 +454,249 @@ func readICAPMessage(r *bufio.Reader, maxSize int64) ([]byte, icapMeta, error) {
 	return buf.Bytes(), meta, nil
 }
 
+// bodyFraming records the framing headers of an encapsulated HTTP header
+// section, used to recognize a body sent without ICAP chunking.
+type bodyFraming struct {
+	contentLength  int64 // -1 when absent or unparseable
+	chunked        bool  // Transfer-Encoding includes "chunked"
+	expectContinue bool  // Expect: 100-continue
+}
+
+func newBodyFraming() bodyFraming { return bodyFraming{contentLength: -1} }
+
+// observe records Content-Length, Transfer-Encoding, and Expect from one
+// header line.
+func (f *bodyFraming) observe(line string) {
+	name, value, ok := strings.Cut(line, ":")
+	if !ok {
+		return
+	}
+	value = strings.TrimSpace(value)
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "content-length":
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil && n >= 0 {
+			f.contentLength = n
+		}
+	case "transfer-encoding":
+		f.chunked = f.chunked || strings.Contains(strings.ToLower(value), "chunked")
+	case "expect":
+		f.expectContinue = f.expectContinue || strings.EqualFold(value, "100-continue")
+	}
+}
+
+// unchunked reports whether the body about to be read from r is sent raw,
+// as Content-Length bytes, rather than in ICAP chunks. RFC 3507 requires
+// chunking, and compliant clients send a Content-Length in the HTTP headers
+// too, so the header alone proves nothing: the body is taken as raw only
+// when the headers carry a Content-Length and no chunked Transfer-Encoding
+// and the body does not start with a chunk-size line. A chunk of a body of
+// N bytes has at most len(hex(N)) size digits, so peeking one byte more than
+// that (never more than N, which could block on a raw body) settles it; an
+// empty body is judged only from bytes already buffered.
+func (f bodyFraming) unchunked(r *bufio.Reader) bool {
+	if f.contentLength < 0 || f.chunked {
+		return false
+	}
+	if f.contentLength == 0 {
+		// An empty raw body sends nothing, so peeking could block; only
+		// bytes already buffered (the next message) can tell.
+		if r.Buffered() == 0 {
+			return false
+		}
+		peek, _ := r.Peek(1)
+		return !isHexDigit(peek[0])
+	}
+	maxDigits := len(strconv.FormatInt(f.contentLength, 16))
+	limit := min(f.contentLength, int64(maxDigits)+1)
+	for i := 0; int64(i) < limit; i++ {
+		peek, err := r.Peek(i + 1)
+		if err != nil {
+			return false // let the chunked reader report the short read
+		}
+		switch c := peek[i]; {
+		case isHexDigit(c):
+			continue
+		case i > 0 && (c == '\r' || c == '\n' || c == ';' || c == ' ' || c == '\t'):
+			return false // a chunk-size line
+		default:
+			return true
+		}
+	}
+	// Every peeked byte is a hex digit: more digits than any chunk size
+	// could have means raw data; a body too short to tell is left to the
+	// chunked reader, the RFC's framing.
+	return limit > int64(maxDigits)
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// readFixedLengthBody reads a body of n raw bytes (see bodyFraming.unchunked)
+// and appends it to buf re-framed as a single ICAP chunk, so parsing and
+// echo responses handle it like any chunked body. total is the message size
+// read so far; a body that would take it past maxSize is rejected, or with
+// OVERSIZE_MODE=truncate cut short with the rest read and discarded so that
+// a keep-alive connection stays in step.
+func readFixedLengthBody(r *bufio.Reader, buf *bytes.Buffer, n, total, maxSize int64, cfg Config) error {
+	keep := n
+	if total+n > maxSize {
+		if !strings.EqualFold(cfg.OversizeMode, "truncate") {
+			return errMessageTooLarge
+		}
+		keep = max(maxSize-total, 0)
+	}
+	body := make([]byte, keep)
+	read, err := io.ReadFull(r, body)
+	if err == nil && keep < n {
+		_, err = io.CopyN(io.Discard, r, n-keep)
+	}
+	if read > 0 {
+		fmt.Fprintf(buf, "%x\r\n", read)
+		buf.Write(body[:read])
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("0\r\n\r\n")
+	// As with chunked bodies, only a deadline ends the message with an
+	// error; a client that closes early leaves what it sent.
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return err
+	}
+	return nil
+}
+
+// discardChunks reads and discards the rest of a chunked body whose next
+// chunk, of size bytes, has had its size line read: that chunk, the chunks
+// after it, and the terminating zero chunk with any trailers. It gives up
+// after limit bytes. done reports whether the terminator was reached, i.e.
+// whether r is left at the start of the next message.
+func discardChunks(r *bufio.Reader, size, limit int64) (done bool, err error) {
+	for {
+		if size+2 > limit {
+			return false, nil
+		}
+		if _, err := io.CopyN(io.Discard, r, size+2); err != nil {
+			return false, err
+		}
+		limit -= size + 2
+		line, err := r.ReadString('\n')
+		limit -= int64(len(line))
+		if err != nil {
+			return false, err
+		}
+		sizeStr, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		if size, err = strconv.ParseInt(sizeStr, 16, 64); err != nil || size < 0 {
+			return false, nil
+		}
+		if size == 0 {
+			for limit > 0 {
+				trail, err := r.ReadString('\n')
+				limit -= int64(len(trail))
+				if err != nil {
+					return false, err
+				}
+				if strings.TrimRight(trail, "\r\n") == "" {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+	}
+}
+
+// hasIEOF reports whether a chunk-extension list (the text after the first
+// ';' of a chunk-size line) contains the ICAP "ieof" extension. Extensions are
+// matched case-insensitively and may be mixed with others, e.g. "x=1; ieof".
+func hasIEOF(ext string) bool {
+	for _, e := range strings.Split(ext, ";") {
+		name, _, _ := strings.Cut(e, "=")
+		if strings.EqualFold(strings.TrimSpace(name), "ieof") {
+			return true
+		}
+	}
+	return false
+}
+
 // allow204 reports whether the ICAP request permits a "204 No Modifications"
-// response per RFC 3507 §4.6.  The result is pre-computed during
-// readICAPMessage so this is now a zero-allocation O(1) lookup.
+// response per RFC 3507 §4.6: the request carried "Allow: 204", or the
+// response answers a preview (§4.5) — a preview that ended in "0; ieof", so
+// no 100 Continue was sent and the reply is the reply to the preview. Once a
+// 100 Continue has asked for the rest of the body, only Allow: 204 permits a
+// 204. The flags are pre-computed during readICAPMessage so this is a
+// zero-allocation O(1) lookup.
 func allow204(meta icapMeta) bool {
-	return meta.allow204
+	return meta.allow204 || (meta.hasPreview && meta.ieof)
+}
+
+// buildICAPResponse picks the unmodified-content response the client has
+// negotiated through its Allow header:
+//
+//	Allow contains 204, or preview with ieof → 204 No Modifications
+//	Allow contains 206, ALLOW_206, has body  → 206 Partial Content, use-original-body=0
+//	otherwise (or 206 without a body)        → 200 OK echo
+//
+// 204 wins when both are allowed because it is the cheapest for the client.
+func buildICAPResponse(buf []byte, meta icapMeta, cfg Config) []byte {
+	if allow204(meta) {
+		return []byte("ICAP/1.0 204 No Modifications\r\n" + istagLine(meta) + logIDLine(meta) +
+			connectionHeader(meta.keepAlive) + "\r\n\r\n")
+	}
+	if cfg.Allow206 && meta.allow206 {
+		if resp, ok := buildICAPPartialResponse(buf, meta); ok {
+			return resp
+		}
+	}
+	return buildICAPEchoResponse(buf, meta)
+}
+
+// istagLine returns the ISTag header line (with CRLF) for a response to the
+// request described by meta, or "" when no tag was set on meta.
+func istagLine(meta icapMeta) string {
+	if meta.istag == "" {
+		return ""
+	}
+	return istagHeader(meta.istag) + "\r\n"
+}
+
+// buildICAPPartialResponse constructs an ICAP/1.0 206 Partial Content
+// response (ICAP Partial Content extension) that echoes the encapsulated
+// HTTP headers and replaces the body with a zero chunk carrying
+// use-original-body=0, telling the client to reuse its own copy of the body
+// from the first byte. This spares the client re-receiving a body the logger
+// never changes. ok is false when the message has no body section to reuse.
+func buildICAPPartialResponse(buf []byte, meta icapMeta) (resp []byte, ok bool) {
+	if meta.icapHdrLen <= 0 || meta.icapHdrLen > len(buf) {
+		return nil, false
+	}
+	encapsulatedVal, section := meta.encapsulated, buf[meta.icapHdrLen:]
+	if meta.isRespMod {
+		encapsulatedVal, section = trimReqHdrSection(encapsulatedVal, section)
+	}
+	bodyOff := int64(-1)
+	for _, part := range strings.Split(encapsulatedVal, ",") {
+		name, val, found := strings.Cut(strings.TrimSpace(part), "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "req-body", "res-body":
+			if n, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64); found && err == nil {
+				bodyOff = n
+			}
+		}
+	}
+	if bodyOff < 0 || bodyOff > int64(len(section)) {
+		return nil, false
+	}
+
+	var b bytes.Buffer
+	b.WriteString("ICAP/1.0 206 Partial Content\r\n")
+	b.WriteString(istagLine(meta))
+	b.WriteString(logIDLine(meta))
+	b.WriteString(connectionHeader(meta.keepAlive) + "\r\n")
+	b.WriteString("Encapsulated: " + encapsulatedVal + "\r\n")
+	b.WriteString("\r\n")
+	b.Write(section[:bodyOff])
+	b.WriteString("0; use-original-body=0\r\n\r\n")
+	return b.Bytes(), true
 }
 
 // buildICAPEchoResponse constructs an ICAP/1.0 200 OK response that echoes
@@ -225,7 +734,9 @@ func buildICAPEchoResponse(buf []byte, meta icapMeta) []byte {
 
 	var resp bytes.Buffer
 	resp.WriteString("ICAP/1.0 200 OK\r\n")
-	resp.WriteString("Connection: close\r\n")
+	resp.WriteString(istagLine(meta))
+	resp.WriteString(logIDLine(meta))
+	resp.WriteString(connectionHeader(meta.keepAlive) + "\r\n")
 	resp.WriteString("Encapsulated: " + encapsulatedVal + "\r\n")
 	resp.WriteString("\r\n")
 	resp.Write(encapsulatedSection)
@@ -235,7 +746,12 @@ func buildICAPEchoResponse(buf []byte, meta icapMeta) []byte {
 // trimReqHdrSection strips the req-hdr bytes from the encapsulated section and
 // adjusts the Encapsulated header value for a RESPMOD 200 OK echo response.
 // RFC 3507 §4.9.2 allows only res-hdr and res-body/null-body in the response.
+//
+// RFC 3507 also requires req-hdr to precede res-hdr, but a nonconforming
+// client may declare them the other way round ("res-hdr=0, req-hdr=N, ...").
+// The req-hdr bytes then sit between res-hdr and the body and are cut out.
 func trimReqHdrSection(encVal string, section []byte) (newEncVal string, newSection []byte) {
+	reqHdrOffset := int64(-1)
 	resHdrOffset := int64(-1)
 	resBodyOffset := int64(-1)
 	hasNullBody := false
@@ -251,6 +767,8 @@ func trimReqHdrSection(encVal string, section []byte) (newEncVal string, newSect
 			continue
 		}
 		switch strings.ToLower(key) {
+		case "req-hdr":
+			reqHdrOffset = val
 		case "res-hdr":
 			resHdrOffset = val
 		case "res-body":
@@ -267,6 +785,15 @@ func trimReqHdrSection(encVal string, section []byte) (newEncVal string, newSect
 	}
 
 	newSection = section[resHdrOffset:]
+	if resBodyOffset >= 0 && reqHdrOffset > resHdrOffset && reqHdrOffset < resBodyOffset &&
+		resBodyOffset <= int64(len(section)) {
+		// res-hdr, req-hdr, body: keep res-hdr, drop req-hdr, keep the body.
+		trimmed := make([]byte, 0, int64(len(section))-resHdrOffset-(resBodyOffset-reqHdrOffset))
+		trimmed = append(trimmed, section[resHdrOffset:reqHdrOffset]...)
+		trimmed = append(trimmed, section[resBodyOffset:]...)
+		newSection = trimmed
+		resBodyOffset = reqHdrOffset // the body now starts where req-hdr did
+	}
 	if resBodyOffset >= 0 {
 		bodyOff := resBodyOffset - resHdrOffset
 		if hasNullBody {
@@ -278,24 +805,266 @@ func trimReqHdrSection(encVal string, section []byte) (newEncVal string, newSect
 	return encVal, section
 }
 
-// handleConn reads one complete ICAP request, parses it, writes a structured
-// JSON log entry, and responds appropriately.
+// activeHandlers counts running handleConn calls and the asynchronous log
+// goroutines they start. main adds each accepted connection before spawning
+// its handler and waits on it during shutdown (bounded by DRAIN_TIMEOUT_SEC),
+// so in-flight clients get their response and the last entries reach the log
+// channel before it is closed. serveICAPMessage adds its log goroutine while
+// its own connection is still counted, which keeps Add-before-Wait ordering.
+var activeHandlers sync.WaitGroup
+
+// icapBusyResponse is sent to connections turned away by the
+// MAX_CONCURRENT_CONNS limit when CONN_LIMIT_MODE=reject.
+const icapBusyResponse = "ICAP/1.0 503 Service Unavailable\r\nConnection: close\r\nEncapsulated: null-body=0\r\n\r\n"
+
+// serveListener accepts ICAP connections from ln and serves each in its own
+// goroutine (tracked by activeHandlers) until ctx is cancelled or ln closed.
+// With cfg.WorkerCount > 0 the connections are handed to a connPool instead.
+//
+// With cfg.MaxConcurrentConns > 0 a semaphore bounds the number of running
+// handlers. At the limit the accept loop either waits for a slot
+// (CONN_LIMIT_MODE=block, the default) or answers the new connection with
+// ICAP 503 and closes it (reject). Each time the limit is hit the
+// icap_conn_limit_hits_total counter is incremented and a warning logged.
+func serveListener(ctx context.Context, ln net.Listener, logCh chan<- []byte, cfg Config) {
+	var sem chan struct{}
+	if cfg.MaxConcurrentConns > 0 {
+		sem = make(chan struct{}, cfg.MaxConcurrentConns)
+	}
+	reject := strings.EqualFold(cfg.ConnLimitMode, "reject")
+	pool := newConnPool(cfg.WorkerCount, cfg.WorkerQueueSize, cfg.WorkerQueueMode, cfg)
+	if pool != nil {
+		defer pool.close()
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Warn("accept error", "err", err)
+			continue
+		}
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			default:
+				connLimitHits.Add(1)
+				if reject {
+					slog.Warn("connection limit reached, rejecting with 503",
+						"limit", cfg.MaxConcurrentConns, "remote", conn.RemoteAddr().String())
+					go rejectBusy(conn, cfg)
+					continue
+				}
+				slog.Warn("connection limit reached, waiting for a free slot",
+					"limit", cfg.MaxConcurrentConns)
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					conn.Close()
+					return
+				}
+			}
+		}
+		connsAccepted.Add(1)
+		activeHandlers.Add(1)
+		done := func() {
+			if sem != nil {
+				<-sem
+			}
+			activeHandlers.Done()
+		}
+		if pool != nil {
+			serve := func(reader *bufio.Reader) {
+				defer done()
+				serveConn(conn, reader, logCh, cfg)
+			}
+			if !pool.submit(ctx, conn, serve) {
+				done()
+			}
+			continue
+		}
+		go func() {
+			defer done()
+			handleConn(conn, logCh, cfg)
+		}()
+	}
+}
+
+// rejectBusy answers conn with ICAP 503 and closes it without reading the
+// request.
+func rejectBusy(conn net.Conn, cfg Config) {
+	defer conn.Close()
+	if err := conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout)); err != nil {
+		return
+	}
+	_, _ = conn.Write([]byte(icapBusyResponse))
+}
+
+// handleConn serves one ICAP connection. Without KEEP_ALIVE it reads a single
+// request, responds, and closes. With KEEP_ALIVE it keeps serving requests on
+// the same socket (e.g. Squid's OPTIONS followed by REQMODs) until the client
+// closes, sends Connection: close, or the read timeout fires between requests.
 // OPTIONS requests are handled immediately and never logged.
 func handleConn(conn net.Conn, logCh chan<- []byte, cfg Config) {
+	serveConn(conn, nil, logCh, cfg)
+}
+
+// serveConn is handleConn reading through reader, a connPool worker's
+// buffer that is reset to conn for the connection's lifetime; a nil reader
+// allocates a fresh one.
+func serveConn(conn net.Conn, reader *bufio.Reader, logCh chan<- []byte, cfg Config) {
 	defer conn.Close()
 
+	// Gauges are decremented in defers so every exit path — early return or
+	// recovered panic — leaves them balanced.
+	activeConns.Add(1)
+	defer activeConns.Add(-1)
+	var stats connStats
+	start := time.Now()
+	defer func() { stats.closed(conn, time.Since(start), cfg) }()
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("panic in ICAP handler", "remote", conn.RemoteAddr().String(), "panic", r)
+		}
+	}()
+
+	if cfg.ReadIdleTimeout > 0 {
+		conn = &idleConn{Conn: conn, idle: cfg.ReadIdleTimeout}
+	}
+	if reader == nil {
+		reader = bufio.NewReaderSize(conn, 64*1024)
+	} else {
+		reader.Reset(conn)
+		defer reader.Reset(nil)
+	}
+	for serveICAPMessage(conn, reader, logCh, cfg, &stats) {
+	}
+}
+
+// connStats accumulates what one connection served, for the keep-alive reuse
+// summary emitted when it closes.
+type connStats struct {
+	messages int   // complete ICAP messages read, OPTIONS included
+	bytes    int64 // bytes of those messages
+}
+
+// closed records a finished connection in the reuse metrics and, when
+// LOG_CONN_SUMMARY is enabled, logs its summary.
+func (s *connStats) closed(conn net.Conn, d time.Duration, cfg Config) {
+	connsClosed.Add(1)
+	connMessages.Add(int64(s.messages))
+	connDurationMs.Add(d.Milliseconds())
+	if cfg.LogConnSummary {
+		slog.Info("ICAP connection closed",
+			"remote", conn.RemoteAddr().String(),
+			"messages", s.messages,
+			"bytes", s.bytes,
+			"duration_ms", d.Milliseconds())
+	}
+}
+
+// serveICAPMessage reads one complete ICAP request from reader, parses it,
+// writes a structured JSON log entry, and responds. It reports whether the
+// connection should stay open for another request. Each message read is
+// counted in stats.
+func serveICAPMessage(conn net.Conn, reader *bufio.Reader, logCh chan<- []byte, cfg Config, stats *connStats) (keepAlive bool) {
+	// The read deadline is reset per message so an idle keep-alive connection
+	// is closed after ReadTimeout without a new request.
 	if err := conn.SetReadDeadline(time.Now().Add(cfg.ReadTimeout)); err != nil {
-		return
+		return false
 	}
 
-	reader := bufio.NewReaderSize(conn, 64*1024)
-	buf, meta, err := readICAPMessage(reader, cfg.MaxBodySize)
+	// processing_ms starts at the message's first byte, so time a keep-alive
+	// connection spends idle between messages is not counted. A Peek error
+	// is left for readICAPMessage to report.
+	_, _ = reader.Peek(1)
+	start := time.Now()
+	// With READ_IDLE_TIMEOUT_SEC the message read is bounded by progress
+	// (and MESSAGE_MAX_DURATION_SEC) instead of by READ_TIMEOUT_SEC.
+	ic, idle := conn.(*idleConn)
+	if idle {
+		var hard time.Time
+		if cfg.MessageMaxDuration > 0 {
+			hard = start.Add(cfg.MessageMaxDuration)
+		}
+		ic.begin(hard)
+	}
+	buf, meta, err := readICAPMessage(reader, conn, cfg)
+	if idle {
+		ic.end()
+	}
+	// buf stays in flight until the asynchronous log goroutine, when one is
+	// started, has finished with it.
+	held := int64(len(buf))
+	inflightBytes.Add(held)
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			inflightBytes.Add(-held)
+		}
+	}()
+	if errors.Is(err, errDuplicateEncapsulated) {
+		slog.Warn("rejecting ICAP request with multiple Encapsulated headers",
+			"remote", conn.RemoteAddr().String())
+		if err := conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout)); err == nil {
+			_, _ = conn.Write([]byte(icapBadRequestResponse))
+		}
+		return false
+	}
+	if errors.Is(err, errMessageTooLarge) {
+		oversizeRejected.Add(1)
+		slog.Warn("rejecting oversized ICAP message with 413",
+			"limit", cfg.MaxBodySize, "bytes_read", len(buf), "remote", conn.RemoteAddr().String())
+		if err := conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout)); err == nil {
+			_, _ = conn.Write([]byte(icapTooLargeResponse))
+		}
+		return false
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() && len(buf) > 0 {
+		// A deadline expiring between messages is the normal end of an
+		// idle keep-alive connection; one expiring after part of a message
+		// arrived is a stalled or too slow client, worth telling apart
+		// from a clean disconnect.
+		readTimeouts.Add(1)
+		slog.Warn("read timeout mid-message", "event", "read_timeout",
+			"bytes_read", len(buf), "elapsed_ms", time.Since(start).Milliseconds(),
+			"remote", conn.RemoteAddr().String())
+		if cfg.ReadTimeoutResponse {
+			if err := conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout)); err == nil {
+				_, _ = conn.Write([]byte(icapRequestTimeoutResponse))
+			}
+		}
+		return false
+	}
 	if err != nil || len(buf) == 0 {
-		return
+		return false
+	}
+	stats.messages++
+	stats.bytes += held
+	countRequest(buf)
+	meta.keepAlive = cfg.KeepAlive && !meta.connClose
+	meta.istag = cfg.ISTag
+
+	firstLine, _, _ := strings.Cut(string(buf), "\n")
+	firstLine = strings.TrimRight(firstLine, "\r")
+	if !validICAPRequestLine(firstLine) {
+		invalidRequests.Add(1)
+		slog.Warn("rejecting non-ICAP request with 400",
+			"remote", conn.RemoteAddr().String(), "request_line", firstLine[:min(len(firstLine), 64)])
+		if err := conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout)); err == nil {
+			_, _ = conn.Write([]byte(icapBadRequestResponse))
+		}
+		return false
 	}
 
 	// Detect OPTIONS — respond immediately without logging
-	firstLine := strings.SplitN(string(buf), "\r\n", 2)[0]
 	if strings.HasPrefix(strings.TrimSpace(firstLine), "OPTIONS ") {
 		parts := strings.Fields(firstLine)
 		serviceURL := ""
@@ -304,10 +1073,27 @@ func handleConn(conn net.Conn, logCh chan<- []byte, cfg Config) {
 		}
 		slog.Debug("ICAP OPTIONS received", "url", serviceURL)
 		if err := conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout)); err != nil {
-			return
+			return false
+		}
+		if _, err := conn.Write([]byte(icapOptionsResponse(serviceURL, meta.keepAlive, cfg))); err != nil {
+			return false
+		}
+		return meta.keepAlive
+	}
+
+	// ── ICAP_SERVICES: unknown service → 404, unsupported method → 405 ───────
+	if len(cfg.ICAPServices) > 0 {
+		if status := serviceRejection(firstLine, cfg); status != "" {
+			slog.Warn("rejecting ICAP request for service", "status", status,
+				"request", firstLine, "remote", conn.RemoteAddr().String())
+			if err := conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout)); err != nil {
+				return false
+			}
+			if _, err := conn.Write([]byte(icapServiceError(status, meta.keepAlive, cfg))); err != nil {
+				return false
+			}
+			return meta.keepAlive
 		}
-		_, _ = conn.Write([]byte(icapOptionsResponse(serviceURL)))
-		return
 	}
 
 	// ── Respond: 204 if the client permits it; 200 OK echo otherwise ───────────
@@ -317,68 +1103,337 @@ func handleConn(conn net.Conn, logCh chan<- []byte, cfg Config) {
 	// that subsequent chain members must echo the content rather than
 	// short-circuit.  Sending 204 without Allow: 204 causes Squid to return
 	// ERR_ICAP_FAILURE (Cache-Status: detail=mismatch) to the client.
+	if cfg.LogReqID {
+		hdr := buf
+		if meta.icapHdrLen > 0 && meta.icapHdrLen <= len(buf) {
+			hdr = buf[:meta.icapHdrLen]
+		}
+		if meta.reqID = transactionID(hdr, cfg.ReqIDHeaders); meta.reqID == "" {
+			meta.reqID = newUUID()
+		}
+	}
 	if err := conn.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout)); err != nil {
 		slog.Warn("failed to set write deadline", "err", err)
-		return
-	}
-	var icapResp []byte
-	if allow204(meta) {
-		icapResp = []byte("ICAP/1.0 204 No Modifications\r\nConnection: close\r\n\r\n")
-	} else {
-		icapResp = buildICAPEchoResponse(buf, meta)
+		return false
 	}
+	icapResp := buildICAPResponse(buf, meta, cfg)
 	if _, err := conn.Write(icapResp); err != nil {
-		logCh <- []byte(`{"error":"failed to write ICAP response"}`)
-		return
+		logCh <- encodeErrorRecord("failed to write ICAP response", cfg)
+		return false
 	}
+	processing := time.Since(start)
 
 	// ── Log asynchronously so we never block the ICAP response path ──────────
+	if !logWorkers.acquire() {
+		return meta.keepAlive
+	}
+	activeHandlers.Add(1)
+	handedOff = true
 	go func() {
-		info := parseICAP(buf)
-		reqBody, respBody := selectBodies(info, cfg)
-		const tsFormat = "2006-01-02T15:04:05.000Z07:00"
-		entry := logEntry{
-			Timestamp:      time.Now().Format(tsFormat),
-			ICAPMethod:     info.icapMethod,
-			ICAPURL:        info.icapURL,
-			ReqMethod:      info.reqMethod,
-			ReqPath:        info.reqPath,
-			DestinationURL: info.destinationURL,
-			Tunneled:       info.reqMethod == "CONNECT",
-			ReqBody:        reqBody,
-			RespStatus:     info.respStatus,
-			RespBody:       respBody,
-		}
-
-		if len(info.icapHeaders) > 0 {
-			entry.ICAPHeaders = headersToMap(info.icapHeaders)
-			// "Date" in icap_headers duplicates the top-level "timestamp" field.
-			// Drop it to keep the log compact and unambiguous.
-			delete(entry.ICAPHeaders, "Date")
-		}
-		if len(info.reqHeaders) > 0 {
-			entry.ReqHeaders = headersToMap(info.reqHeaders)
-			if cfg.RedactAuthHeader {
-				redactAuthHeaders(entry.ReqHeaders)
-			}
+		defer activeHandlers.Done()
+		defer logWorkers.release()
+		defer inflightBytes.Add(-held)
+		info := parseICAP(buf, cfg)
+		// Captured before the host filters: a message that failed to parse
+		// may not even yield the right destination host.
+		rawCaptures.capture(buf, info, conn.RemoteAddr())
+		mismatch := methodURLMismatch(info.icapMethod, info.icapURL)
+		if mismatch {
+			slog.Warn("ICAP method does not match the service URL",
+				"icap_method", info.icapMethod, "icap_url", info.icapURL,
+				"remote", conn.RemoteAddr().String())
 		}
-		if len(info.respHeaders) > 0 {
-			entry.RespHeaders = headersToMap(info.respHeaders)
-			if cfg.RedactAuthHeader {
-				redactAuthHeaders(entry.RespHeaders)
-			}
+		if (len(cfg.LogIncludeHosts) > 0 || len(cfg.LogExcludeHosts) > 0) &&
+			!hostAllowed(entryHost(info), cfg.LogIncludeHosts, cfg.LogExcludeHosts) {
+			hostFiltered.Add(1)
+			return
+		}
+		if hostRedactionProfile(entryHost(info), cfg.HostRedaction) == "full" {
+			hostRedactionDropped.Add(1)
+			return
+		}
+		alert := isAlertStatus(info.respStatus, cfg.AlertStatusCodes)
+		if alert {
+			slog.Warn("alert status code", "resp_status", info.respStatus,
+				"destination_url", info.destinationURL, "remote", conn.RemoteAddr().String())
+		}
+		// Transactions with parse warnings or errors or an alert status are
+		// always logged: they are the ones worth investigating.
+		if !alert && len(info.parseWarnings) == 0 && info.parseError == "" &&
+			!logSampler.keep(cfg.LogSampleRate) {
+			sampledOut.Add(1)
+			return
 		}
+		entry := buildLogEntry(info, cfg)
+		entry.ClientAddr, entry.ClientPort = clientAddr(conn.RemoteAddr())
+		entry.ProcessingMs = processing.Milliseconds()
+		entry.ReqID = meta.reqID
+		entry.MethodURLMismatch = mismatch
+		runRequestHooks(info, &entry)
+		if !logDeduper.offer(entry, logCh) {
+			emitLogEntry(entry, cfg, logCh)
+		}
+	}()
+	return meta.keepAlive
+}
 
-		data, err := json.Marshal(entry)
+// emitLogEntry splits entry when SPLIT_ENTRIES is on, records it for /recent,
+// encodes it, and queues it on logCh.
+func emitLogEntry(entry logEntry, cfg Config, logCh chan<- []byte) {
+	entries := []logEntry{entry}
+	if cfg.SplitEntries {
+		entries = splitLogEntry(entries[0])
+	}
+	for _, entry := range entries {
+		recentEntries.add(entry)
+		data, err := encodeEntry(entry, cfg)
 		if err != nil {
-			errEntry, _ := json.Marshal(map[string]string{
-				"error": fmt.Sprintf("failed to marshal log entry: %v", err),
-			})
-			logCh <- errEntry
+			logCh <- encodeErrorRecord(fmt.Sprintf("failed to marshal log entry: %v", err), cfg)
 		} else {
 			logCh <- data
 		}
-	}()
+	}
+}
+
+// buildLogEntry assembles the log entry for a parsed ICAP request, applying
+// the body, redaction, and enrichment settings from cfg.
+func buildLogEntry(info icapInfo, cfg Config) logEntry {
+	info.destinationURL = applySchemeByPort(info.destinationURL,
+		info.reqHeaders.Get("X-Forwarded-Proto"), cfg.SchemeByPort)
+	service := selectService(info, cfg)
+	cfg = applyServicePolicy(cfg, service)
+	hostProfile := hostRedactionProfile(entryHost(info), cfg.HostRedaction)
+	cfg = applyHostRedaction(cfg, hostProfile)
+	bodies := selectLoggedBodies(info, cfg)
+	reqBody, respBody := bodies.req, bodies.resp
+	now := time.Now()
+	entry := logEntry{
+		Timestamp:       formatTimestamp(now, cfg.TimestampFormat, cfg.Timezone),
+		at:              now,
+		ICAPMethod:      info.icapMethod,
+		ICAPURL:         info.icapURL,
+		ReqMethod:       info.reqMethod,
+		ReqPath:         info.reqPath,
+		DestinationURL:  info.destinationURL,
+		Tunneled:        info.reqMethod == "CONNECT",
+		TLSServerName:   info.tlsServerName,
+		ReqBody:         reqBody,
+		ReqBodyRef:      bodies.reqRef,
+		ReqBodyBytes:    info.reqBodySize,
+		RespStatus:      info.respStatus,
+		RespBody:        respBody,
+		RespBodyRef:     bodies.respRef,
+		RespBodyBytes:   info.respBodySize,
+		RespBodyType:    info.respBodyType,
+		ReqCharset:      info.reqCharset,
+		RespCharset:     info.respCharset,
+		ContentMD5Valid: info.contentMD5Valid,
+		ParseWarnings:   info.parseWarnings,
+		ParseError:      info.parseError,
+	}
+	if cfg.LogMessageBytes {
+		entry.MessageBytes = info.messageBytes
+	}
+	id := extractICAPIdentity(info.icapHeaders, cfg.IdentityHeaders)
+	entry.ClientIP, entry.AuthUser, entry.SubscriberID = id.clientIP, id.authUser, id.subscriberID
+	if cfg.LogRoundTrip {
+		entry.RoundTripMs = roundTripMs(info.reqHeaders, info.respHeaders)
+	}
+	entry.Alert = isAlertStatus(info.respStatus, cfg.AlertStatusCodes)
+	if cfg.ServiceHeader != "" {
+		entry.Service = service
+	}
+	if cfg.HumanSizes {
+		if info.reqBodySize > 0 {
+			entry.ReqBodyHuman = humanSize(info.reqBodySize)
+		}
+		if info.respBodySize > 0 {
+			entry.RespBodyHuman = humanSize(info.respBodySize)
+		}
+	}
+
+	// Embed a JSON request body as a nested object when enabled; the plain
+	// req_body string is kept whenever the body does not qualify.
+	if cfg.ReqBodyJSON {
+		if js, ok := structuredJSONBody(reqBody, info.reqHeaders.Get("Content-Type"),
+			cfg.JSONBodyMaxBytes, cfg.JSONBodyMaxDepth); ok {
+			entry.ReqBodyJSON = js
+			entry.ReqBody = ""
+		}
+	}
+
+	// Secret detection ran in parseICAP on the decoded bodies, so it is set
+	// even when body logging is disabled — the flag is for alerting, the body
+	// itself stays out.
+	entry.SecretSuspected = info.reqSecret || info.respSecret
+	if cfg.DetectBase64Body {
+		if ok, typ := bodyLooksBase64(info.reqBody); ok {
+			entry.LooksBase64, entry.Base64DecodedType = true, typ
+		} else if ok, typ := bodyLooksBase64(info.respBody); ok {
+			entry.LooksBase64, entry.Base64DecodedType = true, typ
+		}
+	}
+
+	if len(info.icapHeaders) > 0 {
+		entry.ICAPHeaders = headersToMap(info.icapHeaders, cfg.HeaderKeyCase)
+		// "Date" in icap_headers duplicates the top-level "timestamp" field.
+		// Drop it to keep the log compact and unambiguous.
+		delete(entry.ICAPHeaders, headerKey("Date", cfg.HeaderKeyCase))
+	}
+	if len(info.reqHeaders) > 0 {
+		entry.ReqHeaders = headersToMap(info.reqHeaders, cfg.HeaderKeyCase)
+		if cfg.RedactAuthHeader {
+			redactAuthHeaders(entry.ReqHeaders)
+		}
+		if cookies := info.reqHeaders.Values("Cookie"); len(cookies) > 0 {
+			if len(cfg.RedactCookies) > 0 {
+				redacted := make([]string, len(cookies))
+				for i, c := range cookies {
+					redacted[i] = redactCookieHeader(c, cfg.RedactCookies)
+				}
+				entry.ReqHeaders[headerKey("Cookie", cfg.HeaderKeyCase)] = strings.Join(redacted, ", ")
+			}
+			if cfg.LogReqCookies {
+				entry.ReqCookies = parseRequestCookies(cookies, cfg.RedactCookies, cfg.LogCookieValues)
+			}
+		}
+	}
+	if len(info.reqHeadersRaw) > 0 {
+		entry.ReqHeadersRaw = redactRawHeaders(info.reqHeadersRaw, cfg)
+	}
+	if len(info.respHeaders) > 0 {
+		entry.RespHeaders = headersToMap(info.respHeaders, cfg.HeaderKeyCase)
+		if cfg.RedactAuthHeader {
+			redactAuthHeaders(entry.RespHeaders)
+		}
+		if cookies := info.respHeaders.Values("Set-Cookie"); len(cookies) > 0 {
+			if len(cfg.RedactCookies) > 0 {
+				redacted := make([]string, len(cookies))
+				for i, c := range cookies {
+					redacted[i] = redactSetCookieHeader(c, cfg.RedactCookies)
+				}
+				entry.RespHeaders[headerKey("Set-Cookie", cfg.HeaderKeyCase)] = strings.Join(redacted, ", ")
+			}
+			if cfg.LogRespCookies {
+				entry.RespCookies = parseResponseCookies(cookies, cfg.RedactCookies, cfg.LogCookieValues)
+			}
+		}
+	}
+	redactEntryForHost(&entry, hostProfile)
+	return entry
+}
+
+// splitLogEntry turns a combined entry that carries both an HTTP request and
+// an HTTP response (typically RESPMOD) into two linked records for schemas
+// that want them separately (SPLIT_ENTRIES):
+//   - section "req" — request line, request headers, request body
+//   - section "res" — response status, response headers, response body
+//
+// Both records share the timestamp, ICAP fields, destination_url, and a
+// freshly generated correlation_id. An entry with only one side (e.g. a
+// REQMOD) is returned unchanged as a single-element slice.
+func splitLogEntry(entry logEntry) []logEntry {
+	hasReq := entry.ReqMethod != "" || len(entry.ReqHeaders) > 0
+	hasRes := entry.RespStatus != "" || len(entry.RespHeaders) > 0
+	if !hasReq || !hasRes {
+		return []logEntry{entry}
+	}
+
+	id := newCorrelationID()
+	common := logEntry{
+		Timestamp:         entry.Timestamp,
+		at:                entry.at,
+		ReqID:             entry.ReqID,
+		ClientAddr:        entry.ClientAddr,
+		ClientPort:        entry.ClientPort,
+		ClientIP:          entry.ClientIP,
+		AuthUser:          entry.AuthUser,
+		SubscriberID:      entry.SubscriberID,
+		Service:           entry.Service,
+		ICAPMethod:        entry.ICAPMethod,
+		ICAPURL:           entry.ICAPURL,
+		ICAPHeaders:       entry.ICAPHeaders,
+		DestinationURL:    entry.DestinationURL,
+		SecretSuspected:   entry.SecretSuspected,
+		Alert:             entry.Alert,
+		LooksBase64:       entry.LooksBase64,
+		Base64DecodedType: entry.Base64DecodedType,
+		ContentMD5Valid:   entry.ContentMD5Valid,
+		ParseWarnings:     entry.ParseWarnings,
+		ParseError:        entry.ParseError,
+		MessageBytes:      entry.MessageBytes,
+		ProcessingMs:      entry.ProcessingMs,
+		Extra:             entry.Extra,
+		ClientGeo:         entry.ClientGeo,
+		DestGeo:           entry.DestGeo,
+		RepeatCount:       entry.RepeatCount,
+		MethodURLMismatch: entry.MethodURLMismatch,
+		CorrelationID:     id,
+	}
+
+	req := common
+	req.Section = "req"
+	req.ReqMethod = entry.ReqMethod
+	req.ReqPath = entry.ReqPath
+	req.Tunneled = entry.Tunneled
+	req.TLSServerName = entry.TLSServerName
+	req.ReqHeaders = entry.ReqHeaders
+	req.ReqHeadersRaw = entry.ReqHeadersRaw
+	req.ReqCookies = entry.ReqCookies
+	req.ReqBody = entry.ReqBody
+	req.ReqBodyJSON = entry.ReqBodyJSON
+	req.ReqBodyRef = entry.ReqBodyRef
+	req.ReqBodyBytes = entry.ReqBodyBytes
+	req.ReqBodyHuman = entry.ReqBodyHuman
+	req.ReqCharset = entry.ReqCharset
+
+	res := common
+	res.Section = "res"
+	res.RespStatus = entry.RespStatus
+	res.RespHeaders = entry.RespHeaders
+	res.RespCookies = entry.RespCookies
+	res.RespBody = entry.RespBody
+	res.RespBodyRef = entry.RespBodyRef
+	res.RespBodyBytes = entry.RespBodyBytes
+	res.RespBodyHuman = entry.RespBodyHuman
+	res.RespBodyType = entry.RespBodyType
+	res.RespCharset = entry.RespCharset
+	res.RoundTripMs = entry.RoundTripMs
+
+	return []logEntry{req, res}
+}
+
+// clientAddr splits a connection's remote address into the client_addr and
+// client_port log fields. TCP peers yield their IP and port; a Unix-socket
+// peer yields its socket path (usually empty) and no port. A nil address
+// yields nothing.
+func clientAddr(addr net.Addr) (string, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String(), a.Port
+	case *net.UnixAddr:
+		return a.Name, 0
+	case nil:
+		return "", 0
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), 0
+	}
+	n, _ := strconv.Atoi(port)
+	return host, n
+}
+
+// newCorrelationID returns a random 16-hex-character identifier used to link
+// log records that describe the same ICAP transaction.
+func newCorrelationID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// crypto/rand never fails on supported platforms; fall back to the
+		// clock so records still carry a (probably) unique ID.
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b[:])
 }
 
 // selectBodies returns the req and resp body strings that should appear in the
@@ -389,17 +1444,149 @@ func handleConn(conn net.Conn, logCh chan<- []byte, cfg Config) {
 //   - cfg.LogRespBody=false (default) → respBody is always ""
 //   - CONNECT (HTTPS tunnel) requests receive the standard tunneled marker
 //     only when LogReqBody is true and the parsed body is empty.
+//   - cfg.BodyOnErrorOnly=true → non-empty bodies of a successful exchange
+//     (response status < 400) are replaced with "[body omitted: success]".
+//     REQMOD entries carry no response and are always logged in full.
+//   - cfg.ScrubPII=true → card numbers, e-mails, SSNs, and PII_PATTERNS
+//     matches in logged bodies are replaced with "[REDACTED:<label>]".
+//   - cfg.BodySpillDir set → bodies over BodySpillThreshold bytes are written
+//     to a side file by spillBody (see selectLoggedBodies) and logged as a
+//     reference; selectBodies then returns "" for that side.
+//   - cfg.MaxLogBodyBytes>0 → longer bodies are cut to that many bytes on a
+//     rune boundary and end with "…[truncated, N total bytes]". Truncation
+//     runs after token redaction and PII scrubbing so both see the full body,
+//     and after spilling so side files hold the whole body.
+//   - cfg.MarkDisabledBodies=true → a non-empty body on a side whose logging
+//     is disabled is replaced with "[body logging disabled]" instead of "",
+//     so readers can tell a dropped body from an absent one. The *_bytes
+//     fields are unaffected either way.
 func selectBodies(info icapInfo, cfg Config) (reqBody, respBody string) {
+	b := selectLoggedBodies(info, cfg)
+	return b.req, b.resp
+}
+
+// loggedBodies is what selectLoggedBodies decides to log for each side: the
+// inline body, or the path of the side file it was spilled to.
+type loggedBodies struct {
+	req, resp       string
+	reqRef, respRef string
+}
+
+// selectLoggedBodies implements selectBodies and also reports the side files
+// of spilled bodies.
+func selectLoggedBodies(info icapInfo, cfg Config) (b loggedBodies) {
+	omit := cfg.BodyOnErrorOnly && isSuccessStatus(info.respStatus)
+	if !cfg.LogReqBody && cfg.MarkDisabledBodies && info.reqBody != "" {
+		b.req = bodyLoggingDisabled
+	}
+	if !cfg.LogRespBody && cfg.MarkDisabledBodies && info.respBody != "" {
+		b.resp = bodyLoggingDisabled
+	}
 	if cfg.LogReqBody {
-		reqBody = sanitizeBody(info.reqBody, "", "", cfg.RedactTokens)
-		if info.reqMethod == "CONNECT" && reqBody == "" {
-			reqBody = "[tunneled: HTTPS traffic, body not inspectable]"
+		b.req, _ = sanitizeBody(info.reqBody, "", "", cfg.RedactTokens, 0, false)
+		if cfg.ScrubPII {
+			b.req = scrubPII(b.req, cfg.PIIPatterns)
+		}
+		if info.reqMethod == "CONNECT" && b.req == "" {
+			b.req = "[tunneled: HTTPS traffic, body not inspectable]"
+		} else if omit && b.req != "" {
+			b.req = bodyOmittedSuccess
+		} else if b.reqRef = spillBody(b.req, "req", cfg); b.reqRef != "" {
+			b.req = ""
+		} else {
+			b.req = truncateLogBody(b.req, cfg.MaxLogBodyBytes)
 		}
 	}
 	if cfg.LogRespBody {
-		respBody = sanitizeBody(info.respBody, "", "", cfg.RedactTokens)
+		b.resp, _ = sanitizeBody(info.respBody, "", "", cfg.RedactTokens, 0, false)
+		if cfg.ScrubPII {
+			b.resp = scrubPII(b.resp, cfg.PIIPatterns)
+		}
+		if omit && b.resp != "" {
+			b.resp = bodyOmittedSuccess
+		} else if b.respRef = spillBody(b.resp, "resp", cfg); b.respRef != "" {
+			b.resp = ""
+		} else {
+			b.resp = truncateLogBody(b.resp, cfg.MaxLogBodyBytes)
+		}
+	}
+	return b
+}
+
+// bodyLoggingDisabled replaces a body whose side is not logged when
+// MARK_DISABLED_BODIES is enabled.
+const bodyLoggingDisabled = "[body logging disabled]"
+
+// bodyOmittedSuccess replaces bodies of successful exchanges when
+// BODY_ON_ERROR_ONLY is enabled.
+const bodyOmittedSuccess = "[body omitted: success]"
+
+// isSuccessStatus reports whether an HTTP status line such as "200 OK" carries
+// a status code below 400. An empty or unparseable status (e.g. REQMOD, which
+// has no response yet) is not a success, so its bodies are kept.
+func isSuccessStatus(status string) bool {
+	code, _, _ := strings.Cut(strings.TrimSpace(status), " ")
+	n, err := strconv.Atoi(code)
+	return err == nil && n > 0 && n < 400
+}
+
+// roundTripMs returns the response Date minus the request Date in
+// milliseconds, or nil when either header is absent or unparseable or the
+// difference is negative (clock skew between client and origin).
+func roundTripMs(req, resp http.Header) *int64 {
+	if req == nil || resp == nil {
+		return nil
+	}
+	sent, err := http.ParseTime(req.Get("Date"))
+	if err != nil {
+		return nil
+	}
+	answered, err := http.ParseTime(resp.Get("Date"))
+	if err != nil {
+		return nil
+	}
+	ms := answered.Sub(sent).Milliseconds()
+	if ms < 0 {
+		return nil
+	}
+	return &ms
+}
+
+// isAlertStatus reports whether an HTTP status line such as "407 Proxy
+// Authentication Required" matches ALERT_STATUS_CODES. Entries are exact codes
+// ("407") or classes ("3xx").
+func isAlertStatus(status string, codes []string) bool {
+	if len(codes) == 0 {
+		return false
+	}
+	code, _, _ := strings.Cut(strings.TrimSpace(status), " ")
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range codes {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c == code || len(c) == 3 && strings.HasSuffix(c, "xx") && c[0] == code[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// redactRawHeaders applies the req_headers redaction (REDACT_AUTH_HEADER,
+// REDACT_COOKIES) to a copy of fields.
+func redactRawHeaders(fields []headerField, cfg Config) []headerField {
+	out := slices.Clone(fields)
+	for i, f := range out {
+		switch strings.ToLower(f.Name) {
+		case "authorization", "proxy-authorization":
+			if cfg.RedactAuthHeader {
+				out[i].Value = "[redacted]"
+			}
+		case "cookie":
+			out[i].Value = redactCookieHeader(f.Value, cfg.RedactCookies)
+		}
 	}
-	return
+	return out
 }
 
 // redactAuthHeaders replaces the value of any Authorization or
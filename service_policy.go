@@ -0,0 +1,52 @@
+package main
+
+import "strings"
+
+// Service profiles let one ICAP endpoint host several logging policies. The
+// profile of a request is the value of the ICAP header named by
+// SERVICE_SELECTOR_HEADER (e.g. X-ICAP-Profile) when present, and otherwise
+// the service path of the ICAP URL ("icap://proxy/reqmod-av" → "reqmod-av").
+// SERVICE_BODY_POLICY then maps profiles to the bodies they log, overriding
+// LOG_REQ_BODY / LOG_RESP_BODY for that profile:
+//
+//	SERVICE_BODY_POLICY=audit=both,av=req,metadata=none
+//
+// Policies are none, req, resp, or both. Profiles without a policy use the
+// global settings.
+
+// selectService returns the service profile for a parsed request, or "" when
+// neither the selector header nor the URL path names one.
+func selectService(info icapInfo, cfg Config) string {
+	if cfg.ServiceHeader != "" {
+		if v := sanitizeServiceKey(info.icapHeaders.Get(cfg.ServiceHeader)); v != "" {
+			return v
+		}
+	}
+	return serviceKey(info.icapURL)
+}
+
+// applyServicePolicy returns cfg with LogReqBody and LogRespBody replaced by
+// the SERVICE_BODY_POLICY entry for service, if there is one. Profile names
+// match case-insensitively; an unknown policy value leaves cfg unchanged.
+func applyServicePolicy(cfg Config, service string) Config {
+	if service == "" || len(cfg.ServiceBodyPolicy) == 0 {
+		return cfg
+	}
+	for profile, policy := range cfg.ServiceBodyPolicy {
+		if !strings.EqualFold(profile, service) {
+			continue
+		}
+		switch strings.ToLower(policy) {
+		case "none":
+			cfg.LogReqBody, cfg.LogRespBody = false, false
+		case "req":
+			cfg.LogReqBody, cfg.LogRespBody = true, false
+		case "resp":
+			cfg.LogReqBody, cfg.LogRespBody = false, true
+		case "both":
+			cfg.LogReqBody, cfg.LogRespBody = true, true
+		}
+		break
+	}
+	return cfg
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// serviceSink writes each entry to a rotating file chosen by the ICAP
+// service path of the entry (LOG_SPLIT_BY=service), e.g. entries for
+// icap://proxy/reqmod-av land in icap_logger.reqmod-av.log next to LOG_FILE.
+// Entries without an icap_url (internal error records) go to LOG_FILE itself.
+//
+// At most maxOpen files are kept open; opening one more closes the least
+// recently written one, so a site with many rarely used services does not
+// exhaust file descriptors. A closed file is simply reopened in append mode
+// the next time its service logs.
+type serviceSink struct {
+	cfg     Config
+	maxOpen int
+
+	mu    sync.Mutex
+	lru   *list.List               // front = most recently written; values are *serviceFile
+	files map[string]*list.Element // file name → element in lru
+}
+
+type serviceFile struct {
+	name string
+	w    *rotatingWriter
+}
+
+func newServiceSink(cfg Config) *serviceSink {
+	maxOpen := cfg.LogSplitMaxOpen
+	if maxOpen <= 0 {
+		maxOpen = 1
+	}
+	return &serviceSink{
+		cfg:     cfg,
+		maxOpen: maxOpen,
+		lru:     list.New(),
+		files:   make(map[string]*list.Element),
+	}
+}
+
+// Write routes one serialized entry to its service file. The entry's
+// "service" field (set when SERVICE_SELECTOR_HEADER is configured) takes
+// precedence over the service path of its icap_url.
+func (s *serviceSink) Write(p []byte) (int, error) {
+	var probe struct {
+		Service string `json:"service"`
+		ICAPURL string `json:"icap_url"`
+	}
+	_ = json.Unmarshal(p, &probe) // unparseable entries fall back to LOG_FILE
+	key := sanitizeServiceKey(probe.Service)
+	if key == "" {
+		key = serviceKey(probe.ICAPURL)
+	}
+	name := serviceLogFile(s.cfg.LogFile, key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		return 0, errors.New("service sink closed")
+	}
+	w, err := s.writerLocked(name)
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(p)
+}
+
+// writerLocked returns the open writer for name, opening it (and evicting the
+// least recently used writer when at capacity) if needed. s.mu must be held.
+func (s *serviceSink) writerLocked(name string) (*rotatingWriter, error) {
+	if el, ok := s.files[name]; ok {
+		s.lru.MoveToFront(el)
+		return el.Value.(*serviceFile).w, nil
+	}
+	for s.lru.Len() >= s.maxOpen {
+		oldest := s.lru.Back()
+		sf := oldest.Value.(*serviceFile)
+		s.lru.Remove(oldest)
+		delete(s.files, sf.name)
+		if err := sf.w.Close(); err != nil {
+			slog.Warn("service sink: closing idle log file failed", "file", sf.name, "err", err)
+		}
+	}
+	w, err := newRotatingWriter(name, s.cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.files[name] = s.lru.PushFront(&serviceFile{name: name, w: w})
+	return w, nil
+}
+
+// Close closes every open service file. Subsequent writes fail.
+func (s *serviceSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for el := s.lru.Front(); el != nil; el = el.Next() {
+		errs = append(errs, el.Value.(*serviceFile).w.Close())
+	}
+	s.lru.Init()
+	s.files = nil
+	return errors.Join(errs...)
+}
+
+// Reopen closes every open service file; each is reopened by path on its
+// next write, which picks up files renamed by an external logrotate.
+func (s *serviceSink) Reopen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		return errors.New("service sink closed")
+	}
+	var errs []error
+	for el := s.lru.Front(); el != nil; el = el.Next() {
+		errs = append(errs, el.Value.(*serviceFile).w.Close())
+	}
+	s.lru.Init()
+	clear(s.files)
+	slog.Info("service log files closed for reopen")
+	return errors.Join(errs...)
+}
+
+// serviceKey turns an ICAP URL such as "icap://proxy:1344/reqmod-av" into a
+// file-name-safe service key ("reqmod-av") using sanitizeServiceKey.
+// Returns "" when the URL has no usable path.
+func serviceKey(icapURL string) string {
+	if icapURL == "" {
+		return ""
+	}
+	path := icapURL
+	if u, err := url.Parse(icapURL); err == nil {
+		path = u.Path
+	}
+	return sanitizeServiceKey(path)
+}
+
+// sanitizeServiceKey makes a service name safe for use in a file name. Leading
+// and trailing slashes are trimmed; path separators and any byte outside
+// [A-Za-z0-9._-] become "_" (a leading "." too), and the key is capped at 64
+// bytes. Returns "" when nothing is left.
+func sanitizeServiceKey(name string) string {
+	name = strings.Trim(strings.TrimSpace(name), "/")
+	if name == "" {
+		return ""
+	}
+	key := []byte(name)
+	for i, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		case c == '.' && i > 0:
+		default:
+			key[i] = '_'
+		}
+	}
+	if len(key) > 64 {
+		key = key[:64]
+	}
+	return string(key)
+}
+
+// serviceLogFile inserts key before the extension of base:
+// "/var/log/icap/icap_logger.log" + "reqmod-av" →
+// "/var/log/icap/icap_logger.reqmod-av.log". An empty key returns base.
+func serviceLogFile(base, key string) string {
+	if key == "" {
+		return base
+	}
+	ext := filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "." + key + ext
+}
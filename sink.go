@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// logSink is the destination for serialized log entries. Each Write call
+// carries exactly one entry; Close flushes and releases the sink on shutdown.
+// rotatingWriter is the default (file) implementation.
+type logSink interface {
+	io.Writer
+	Close() error
+}
+
+// openLogSink constructs the sink selected by cfg.LogSink:
+//   - "file"    — rotatingWriter on cfg.LogFile (default), or a serviceSink
+//     with one file per ICAP service path when cfg.LogSplitBy is "service"
+//   - "syslog"  — the local syslog daemon via log/syslog
+//   - "webhook" — batched HTTP POSTs to cfg.WebhookURL
+//   - "gcp"     — Google Cloud Logging entries:write into cfg.GCPLogName
+//
+// An unknown sink name or a sink that cannot be opened (e.g. syslog on a
+// platform without it) is returned as an error so startup fails loudly rather
+// than silently discarding entries.
+//
+// When cfg.LogSinks lists sink names, every one is opened and entries are
+// fanned out to all of them through a multiSink; LOG_SINK is then ignored.
+//
+// When cfg.FallbackStderr is set the sink is wrapped in a fallbackSink that
+// copies entries the sink fails to write to stderr, and when cfg.LogStdout is
+// set every entry is also echoed, pretty-printed, to stdout. A
+// LOG_KEY_ALLOWLIST filter wraps them all, so every destination sees the same
+// filtered entry.
+func openLogSink(cfg Config) (logSink, error) {
+	var sink logSink
+	var err error
+	if len(cfg.LogSinks) > 0 {
+		sink, err = openMultiSink(cfg)
+	} else {
+		sink, err = openPrimarySink(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.FallbackStderr {
+		sink = newFallbackSink(sink, os.Stderr, cfg.FallbackStderrRate)
+	}
+	if cfg.LogStdout {
+		sink = newStdoutMirrorSink(sink, stdout)
+	}
+	if len(cfg.LogKeyAllowlist) > 0 {
+		sink = newKeyFilterSink(sink, cfg.LogKeyAllowlist)
+	}
+	return sink, nil
+}
+
+// openPrimarySink constructs the sink named by cfg.LogSink without any wrapper.
+func openPrimarySink(cfg Config) (logSink, error) {
+	switch strings.ToLower(strings.TrimSpace(cfg.LogSink)) {
+	case "", "file":
+		switch strings.ToLower(strings.TrimSpace(cfg.LogSplitBy)) {
+		case "":
+			return newRotatingWriter(cfg.LogFile, cfg)
+		case "service":
+			return newServiceSink(cfg), nil
+		default:
+			return nil, fmt.Errorf("unknown LOG_SPLIT_BY %q (want service)", cfg.LogSplitBy)
+		}
+	case "syslog":
+		return newSyslogSink(cfg.SyslogFacility, cfg.SyslogTag)
+	case "webhook":
+		return newWebhookSink(cfg)
+	case "gcp":
+		return newCloudLoggingSink(cfg)
+	default:
+		return nil, fmt.Errorf("unknown LOG_SINK %q (want file, syslog, webhook, or gcp)", cfg.LogSink)
+	}
+}
+
+// primaryLogFile returns the rotating file the chain built by openLogSink
+// writes to — the first one among multiSink members — or nil when there is
+// none (syslog, webhook, gcp, or one file per service).
+func primaryLogFile(sink logSink) *rotatingWriter {
+	switch s := sink.(type) {
+	case *rotatingWriter:
+		return s
+	case *keyFilterSink:
+		return primaryLogFile(s.logSink)
+	case *stdoutMirrorSink:
+		return primaryLogFile(s.logSink)
+	case *fallbackSink:
+		return primaryLogFile(s.logSink)
+	case *multiSink:
+		for _, m := range s.members {
+			if w := primaryLogFile(m.sink); w != nil {
+				return w
+			}
+		}
+	}
+	return nil
+}
+
+// reopener is implemented by sinks that write to files by name and can reopen
+// them after an external logrotate renamed them (rotatingWriter, serviceSink).
+type reopener interface {
+	Reopen() error
+}
+
+// reopenSink reopens every file-backed sink in the chain built by openLogSink,
+// looking through the wrapper sinks and the members of a multiSink. Sinks
+// without files (syslog, webhook, gcp) are left alone.
+func reopenSink(sink logSink) error {
+	switch s := sink.(type) {
+	case *keyFilterSink:
+		return reopenSink(s.logSink)
+	case *stdoutMirrorSink:
+		return reopenSink(s.logSink)
+	case *fallbackSink:
+		return reopenSink(s.logSink)
+	case *multiSink:
+		var errs []error
+		for _, mm := range s.members {
+			errs = append(errs, reopenSink(mm.sink))
+		}
+		return errors.Join(errs...)
+	case reopener:
+		return s.Reopen()
+	}
+	return nil
+}
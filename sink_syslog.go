@@ -0,0 +1,44 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+)
+
+// syslogFacilities maps SYSLOG_FACILITY names to log/syslog priorities.
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// parseSyslogFacility returns the syslog facility for a name such as "local0".
+func parseSyslogFacility(name string) (syslog.Priority, error) {
+	f, ok := syslogFacilities[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return 0, fmt.Errorf("unknown SYSLOG_FACILITY %q", name)
+	}
+	return f, nil
+}
+
+// newSyslogSink connects to the local syslog daemon. Every entry is sent at
+// LOG_INFO severity under the given facility and tag. *syslog.Writer already
+// satisfies logSink and reconnects on its own after a write failure.
+func newSyslogSink(facility, tag string) (logSink, error) {
+	f, err := parseSyslogFacility(facility)
+	if err != nil {
+		return nil, err
+	}
+	w, err := syslog.New(f|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, fmt.Errorf("connect to syslog: %w", err)
+	}
+	return w, nil
+}
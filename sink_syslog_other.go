@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// newSyslogSink always fails on platforms without log/syslog support.
+func newSyslogSink(facility, tag string) (logSink, error) {
+	return nil, fmt.Errorf("LOG_SINK=syslog is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,149 @@
+package main
+
+// TLS ClientHello parsing for SNI extraction.
+//
+// In some Squid setups the first bytes a client sends through a CONNECT
+// tunnel — the TLS ClientHello — are forwarded to ICAP as the req-body.
+// The ClientHello is sent in clear text and carries the server_name (SNI)
+// extension, which is the only visibility into an otherwise opaque tunnel.
+
+const (
+	tlsRecordHandshake     = 0x16
+	tlsHandshakeClientHelo = 0x01
+	tlsExtServerName       = 0x0000
+	tlsSNIHostName         = 0x00
+)
+
+// extractSNI returns the server_name from a TLS ClientHello at the start of
+// data. It parses only as far as the bytes available, so a handshake that was
+// truncated after the SNI extension still succeeds. ok is false for anything
+// that is not a well-formed ClientHello carrying a host_name entry — the
+// parser never panics on malformed or partial input.
+func extractSNI(data []byte) (name string, ok bool) {
+	// TLS record header: type(1) version(2) length(2).
+	if len(data) < 5 || data[0] != tlsRecordHandshake || data[1] != 0x03 {
+		return "", false
+	}
+	p := tlsParser{buf: data[5:]}
+
+	// Handshake header: type(1) length(3).
+	if t, ok := p.u8(); !ok || t != tlsHandshakeClientHelo {
+		return "", false
+	}
+	if !p.skip(3) {
+		return "", false
+	}
+	// client_version(2) random(32)
+	if !p.skip(2 + 32) {
+		return "", false
+	}
+	// session_id<0..32>
+	if n, ok := p.u8(); !ok || !p.skip(int(n)) {
+		return "", false
+	}
+	// cipher_suites<2..2^16-2>
+	if n, ok := p.u16(); !ok || !p.skip(int(n)) {
+		return "", false
+	}
+	// compression_methods<1..2^8-1>
+	if n, ok := p.u8(); !ok || !p.skip(int(n)) {
+		return "", false
+	}
+	// extensions<0..2^16-1> — the declared length is not enforced so that a
+	// truncated record still yields the SNI when it arrived in full.
+	if _, ok := p.u16(); !ok {
+		return "", false
+	}
+	for {
+		extType, ok1 := p.u16()
+		extLen, ok2 := p.u16()
+		if !ok1 || !ok2 {
+			return "", false
+		}
+		ext, ok := p.bytes(int(extLen))
+		if !ok {
+			return "", false
+		}
+		if extType != tlsExtServerName {
+			continue
+		}
+		return parseServerNameExt(ext)
+	}
+}
+
+// parseServerNameExt returns the first host_name entry of a server_name
+// extension body (RFC 6066 §3).
+func parseServerNameExt(ext []byte) (string, bool) {
+	p := tlsParser{buf: ext}
+	listLen, ok := p.u16()
+	if !ok {
+		return "", false
+	}
+	list, ok := p.bytes(int(listLen))
+	if !ok {
+		return "", false
+	}
+	p = tlsParser{buf: list}
+	for {
+		nameType, ok1 := p.u8()
+		nameLen, ok2 := p.u16()
+		if !ok1 || !ok2 {
+			return "", false
+		}
+		name, ok := p.bytes(int(nameLen))
+		if !ok {
+			return "", false
+		}
+		if nameType == tlsSNIHostName && len(name) > 0 && isPrintableASCII(name) {
+			return string(name), true
+		}
+	}
+}
+
+// isPrintableASCII reports whether b contains only printable ASCII, which a
+// valid DNS host name always does.
+func isPrintableASCII(b []byte) bool {
+	for _, c := range b {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// tlsParser is a bounds-checked cursor over a byte slice.
+type tlsParser struct {
+	buf []byte
+}
+
+func (p *tlsParser) u8() (uint8, bool) {
+	if len(p.buf) < 1 {
+		return 0, false
+	}
+	v := p.buf[0]
+	p.buf = p.buf[1:]
+	return v, true
+}
+
+func (p *tlsParser) u16() (uint16, bool) {
+	if len(p.buf) < 2 {
+		return 0, false
+	}
+	v := uint16(p.buf[0])<<8 | uint16(p.buf[1])
+	p.buf = p.buf[2:]
+	return v, true
+}
+
+func (p *tlsParser) bytes(n int) ([]byte, bool) {
+	if n < 0 || len(p.buf) < n {
+		return nil, false
+	}
+	v := p.buf[:n]
+	p.buf = p.buf[n:]
+	return v, true
+}
+
+func (p *tlsParser) skip(n int) bool {
+	_, ok := p.bytes(n)
+	return ok
+}
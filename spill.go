@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// spillBody writes a logged body larger than BODY_SPILL_THRESHOLD to its own
+// file under BODY_SPILL_DIR and returns the file's path, so the entry can
+// carry req_body_ref / resp_body_ref instead of the inline body. side is
+// "req" or "resp" and becomes part of the file name:
+//
+//	<dir>/20260311-165838.123-<16 hex>.resp.body
+//
+// body is the text that would have been logged inline — already sanitized,
+// token-redacted, and PII-scrubbed — so binary and multipart bodies, which
+// are reduced to short summaries, are never spilled. Files are created with
+// LOG_FILE_MODE and never pruned by the logger.
+//
+// It returns "" when spilling is disabled, the body is at or below the
+// threshold, or the file cannot be written; in the last case the failure is
+// logged and counted in bodySpillErrors and the body stays inline.
+func spillBody(body, side string, cfg Config) string {
+	if cfg.BodySpillDir == "" || cfg.BodySpillThreshold <= 0 || len(body) <= cfg.BodySpillThreshold {
+		return ""
+	}
+	path, err := writeSpillFile(cfg, side, body)
+	if err != nil {
+		bodySpillErrors.Add(1)
+		slog.Warn("body spill failed, logging body inline", "dir", cfg.BodySpillDir, "err", err)
+		return ""
+	}
+	bodiesSpilled.Add(1)
+	return path
+}
+
+// writeSpillFile creates a new, uniquely named spill file holding body.
+func writeSpillFile(cfg Config, side, body string) (string, error) {
+	fileMode, err := parseFileMode("LOG_FILE_MODE", cfg.LogFileMode, 0644)
+	if err != nil {
+		fileMode = 0644
+	}
+	dirMode, err := parseFileMode("LOG_DIR_MODE", cfg.LogDirMode, 0755)
+	if err != nil {
+		dirMode = 0755
+	}
+	if err := os.MkdirAll(cfg.BodySpillDir, dirMode); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s-%s.%s.body",
+		time.Now().Format("20060102-150405.000"), newCorrelationID(), side)
+	path := filepath.Join(cfg.BodySpillDir, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fileMode)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(body); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// stdout is the process's shared stdout writer. The slog server-event handler
+// and the LOG_STDOUT mirror both write through it so that a pretty-printed
+// entry spanning many lines is never interleaved with an event line.
+var stdout = &syncWriter{w: os.Stdout}
+
+// syncWriter serializes Write calls to w.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// stdoutMirrorSink wraps the primary sink (LOG_STDOUT=true / --stdout) and
+// echoes every entry to out as indented JSON, for watching what the server
+// logs during local development without tailing a file. Entries that are not
+// valid JSON are echoed as-is. A failed echo is ignored; the primary's result
+// is what Write returns.
+type stdoutMirrorSink struct {
+	logSink
+	out io.Writer
+}
+
+func newStdoutMirrorSink(primary logSink, out io.Writer) *stdoutMirrorSink {
+	return &stdoutMirrorSink{logSink: primary, out: out}
+}
+
+// Write writes p to the primary sink and then echoes it to out in a single
+// Write call.
+func (s *stdoutMirrorSink) Write(p []byte) (int, error) {
+	n, err := s.logSink.Write(p)
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, bytes.TrimSuffix(p, []byte("\n")), "", "  ") != nil {
+		pretty.Reset()
+		pretty.Write(bytes.TrimSuffix(p, []byte("\n")))
+	}
+	pretty.WriteByte('\n')
+	_, _ = s.out.Write(pretty.Bytes())
+	return n, err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultTimestampLayout is the "rfc3339" TIMESTAMP_FORMAT: RFC 3339 with
+// milliseconds and the zone offset, e.g. 2026-05-01T10:00:00.000+02:00.
+const defaultTimestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// formatTimestamp renders an entry timestamp per TIMESTAMP_FORMAT in the
+// TIMEZONE zone:
+//
+//	rfc3339      2026-05-01T10:00:00.000+02:00 (the default)
+//	rfc3339nano  2026-05-01T10:00:00.123456789+02:00
+//	epoch        1777622400 (seconds; the zone does not apply)
+//	epochms      1777622400000
+//	anything else is used as a Go time layout, e.g. "02/Jan/2006:15:04:05 -0700"
+func formatTimestamp(t time.Time, format, zone string) string {
+	t = t.In(timestampLocation(zone))
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", "rfc3339":
+		return t.Format(defaultTimestampLayout)
+	case "rfc3339nano":
+		return t.Format(time.RFC3339Nano)
+	case "epoch":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "epochms":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	default:
+		return t.Format(format)
+	}
+}
+
+// parseTimezone resolves TIMEZONE: "local" (or empty) for the host zone,
+// "utc", or an IANA name such as "Europe/Berlin".
+func parseTimezone(zone string) (*time.Location, error) {
+	switch strings.ToLower(strings.TrimSpace(zone)) {
+	case "", "local":
+		return time.Local, nil
+	case "utc":
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(strings.TrimSpace(zone))
+	if err != nil {
+		return nil, fmt.Errorf("unknown TIMEZONE %q: %w", zone, err)
+	}
+	return loc, nil
+}
+
+// timezones caches parsed TIMEZONE values so the zone database is read once,
+// not per entry.
+var timezones sync.Map // zone string → *time.Location
+
+// timestampLocation returns the location for zone, falling back to local
+// time for a zone that does not parse (validateConfig rejects those at
+// startup).
+func timestampLocation(zone string) *time.Location {
+	if loc, ok := timezones.Load(zone); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := parseTimezone(zone)
+	if err != nil {
+		loc = time.Local
+	}
+	timezones.Store(zone, loc)
+	return loc
+}
+
+// validTimestampFormat reports whether format is one of the named formats or
+// a Go layout with at least one time field.
+func validTimestampFormat(format string) bool {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", "rfc3339", "rfc3339nano", "epoch", "epochms":
+		return true
+	}
+	return time.Unix(0, 0).UTC().Format(format) != format
+}
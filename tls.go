@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// icapTLSConfig builds the TLS configuration for the ICAP listener (ICAPS).
+// It returns nil, nil when neither TLS_CERT nor TLS_KEY is set — plaintext is
+// the default. Setting only one of the pair, an unreadable keypair, an
+// unknown TLS_MIN_VERSION, or an unusable TLS_CLIENT_CA is an error so that
+// startup fails instead of silently serving plaintext.
+//
+// When TLS_CLIENT_CA is set, clients must present a certificate signed by one
+// of the CAs in that PEM bundle (mTLS).
+func icapTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.TLSCert == "" && cfg.TLSKey == "" {
+		return nil, nil
+	}
+	if cfg.TLSCert == "" || cfg.TLSKey == "" {
+		return nil, errors.New("TLS_CERT and TLS_KEY must be set together")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS keypair: %w", err)
+	}
+	minVersion, err := parseTLSVersion(cfg.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+	}
+	if cfg.TLSClientCA != "" {
+		pem, err := os.ReadFile(cfg.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("read TLS_CLIENT_CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS_CLIENT_CA %s contains no PEM certificates", cfg.TLSClientCA)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
+
+// parseTLSVersion maps "1.0" … "1.3" (an optional "TLS" prefix is accepted)
+// to the crypto/tls constant. An empty string means TLS 1.2.
+func parseTLSVersion(raw string) (uint16, error) {
+	v := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(raw)), "TLS")
+	switch strings.TrimSpace(v) {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown TLS_MIN_VERSION %q (want 1.0, 1.1, 1.2, or 1.3)", raw)
+	}
+}
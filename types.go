@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
 	"time"
 )
@@ -12,6 +13,10 @@ import (
 type icapMeta struct {
 	// allow204 is true when the ICAP request's Allow header contains the "204" token.
 	allow204 bool
+	// allow206 is true when the Allow header contains the "206" token, i.e.
+	// the client accepts a 206 Partial Content response that tells it to
+	// reuse the original body (use-original-body).
+	allow206 bool
 	// isRespMod is true when the ICAP method is RESPMOD.
 	isRespMod bool
 	// encapsulated is the verbatim value of the Encapsulated header (e.g.
@@ -21,23 +26,367 @@ type icapMeta struct {
 	// trailing \r\n\r\n. Used by buildICAPEchoResponse to locate the encapsulated
 	// section without a second bytes.Index scan.
 	icapHdrLen int
+	// connClose is true when the client sent "Connection: close", or when
+	// readICAPMessage gave up on a truncated body before its end, leaving
+	// bytes that would be misread as the next message.
+	connClose bool
+	// hasPreview is true when the request carried a Preview header; preview
+	// is its value. The body then arrives in two phases (RFC 3507 §4.5).
+	hasPreview bool
+	preview    int
+	// ieof is true when the preview's zero chunk carried the "ieof" extension,
+	// i.e. the whole body fit in the preview and no 100 Continue was sent.
+	ieof bool
+	// keepAlive is decided by handleConn (KEEP_ALIVE enabled and no
+	// Connection: close from the client) and selects the Connection header
+	// written by the response builders.
+	keepAlive bool
+	// istag is the service's ISTag, copied from Config by handleConn so the
+	// response builders emit the same tag as OPTIONS. Empty omits the header.
+	istag string
+	// reqID is the request ID logged as req_id and sent back as X-Log-Id
+	// (LOG_REQ_ID); empty when disabled.
+	reqID string
 }
 
 // Config holds all runtime configuration loaded from environment variables,
 // with optional CLI flag overrides (--port=, --log=, --log-rotate-size=).
 type Config struct {
-	Port             string
-	LogFile          string
+	Port string
+	// ICAPS: the listener is wrapped in TLS when TLSCert and TLSKey are set.
+	TLSCert       string // TLS_CERT env var — PEM certificate (chain) file
+	TLSKey        string // TLS_KEY env var — PEM private key file
+	TLSMinVersion string // TLS_MIN_VERSION env var — default "1.2"
+	TLSClientCA   string // TLS_CLIENT_CA env var — PEM CA bundle; enables mTLS
+	LogFile       string
+	LogSink       string // LOG_SINK env var — "file" (default), "syslog", or "webhook"
+	LogFormat     string // LOG_FORMAT env var — "json" (default), "cef", "access", or "msgpack"
+	// LogSinks names several sinks to write every entry to, e.g.
+	// "file,webhook" (LOG_SINKS env var — default empty, LOG_SINK alone).
+	LogSinks []string
+	// LogSplitBy = "service" gives each ICAP service path its own log file
+	// (LOG_SPLIT_BY env var — default "", one file). At most LogSplitMaxOpen
+	// files stay open (LOG_SPLIT_MAX_OPEN env var — default 32).
+	LogSplitBy      string
+	LogSplitMaxOpen int
+	SyslogFacility  string // SYSLOG_FACILITY env var — default "local0"
+	SyslogTag       string // SYSLOG_TAG env var — default "icap-logger"
+	// Webhook sink settings (LOG_SINK=webhook).
+	WebhookURL           string        // WEBHOOK_URL env var — required for the webhook sink
+	WebhookBatchSize     int           // WEBHOOK_BATCH_SIZE env var — default 100
+	WebhookFlushInterval time.Duration // WEBHOOK_FLUSH_INTERVAL env var — default 2s
+	WebhookBufferSize    int           // WEBHOOK_BUFFER_SIZE env var — default 10000
+	WebhookMaxRetries    int           // WEBHOOK_MAX_RETRIES env var — default 3
+	WebhookTimeout       time.Duration // WEBHOOK_TIMEOUT env var — default 10s
+	// Google Cloud Logging sink settings (LOG_SINK=gcp).
+	GCPLogName       string            // GCP_LOG_NAME env var — required; setting it alone selects the gcp sink
+	GCPProjectID     string            // GCP_PROJECT_ID env var — default: metadata server
+	GCPResourceType  string            // GCP_RESOURCE_TYPE env var — default "global"
+	GCPLabels        map[string]string // GCP_LABELS env var — "k=v,..." added to every entry
+	GCPBatchSize     int               // GCP_BATCH_SIZE env var — default 100
+	GCPFlushInterval time.Duration     // GCP_FLUSH_INTERVAL env var — default 5s
+	GCPBufferSize    int               // GCP_BUFFER_SIZE env var — default 10000
 	LogRotateSizeMB  int64
-	MaxFileRetention int    // LOG_FILE_RETENTION env var — default 60
-	MaxBodySize      int64
-	ReadTimeout      time.Duration
-	WriteTimeout     time.Duration
-	HealthPort       string
-	RedactAuthHeader bool // REDACT_AUTH_HEADER env var — default true
-	RedactTokens     bool // REDACT_TOKENS env var — default true
-	LogReqBody       bool // LOG_REQ_BODY env var — default false
-	LogRespBody      bool // LOG_RESP_BODY env var — default false
+	// LogRotateInterval rotates the active file once it has been open this
+	// long, even below the size threshold (LOG_ROTATE_INTERVAL env var, e.g.
+	// "24h" — default 0, size-only rotation).
+	LogRotateInterval time.Duration
+	// CompressQueueSize bounds how many rotated files may wait for the
+	// background gzip worker (COMPRESS_QUEUE_SIZE env var — default 16).
+	CompressQueueSize int
+	MaxFileRetention  int           // LOG_RETENTION_COUNT (or legacy LOG_FILE_RETENTION) env var — default 60
+	LogMaxAge         time.Duration // LOG_MAX_AGE_DAYS env var — default 0 (no age limit)
+	MaxBodySize       int64
+	MaxLogBodyBytes   int // MAX_LOG_BODY_BYTES env var — default 0 (logged bodies not truncated)
+	ReadTimeout       time.Duration
+	BodyReadDeadline  time.Duration // BODY_READ_DEADLINE_SEC env var — default 0 (disabled)
+	PreviewSize       int           // PREVIEW_SIZE env var — default -1 (Preview not advertised)
+	WriteTimeout      time.Duration
+	DrainTimeout      time.Duration // DRAIN_TIMEOUT_SEC env var — default 15
+	// MaxConcurrentConns caps concurrently served connections
+	// (MAX_CONCURRENT_CONNS env var — default 0, unlimited). ConnLimitMode
+	// picks what happens at the cap: "block" (default) or "reject" (ICAP 503).
+	MaxConcurrentConns int
+	ConnLimitMode      string
+	HealthPort         string
+	RedactAuthHeader   bool // REDACT_AUTH_HEADER env var — default true
+	RedactTokens       bool // REDACT_TOKENS env var — default true
+	LogReqBody         bool // LOG_REQ_BODY env var — default false
+	LogRespBody        bool // LOG_RESP_BODY env var — default false
+	// LogReqCookies adds the request Cookie header as a structured
+	// req_cookies map (LOG_REQ_COOKIES env var — default false), and
+	// LogRespCookies the response Set-Cookie headers as resp_cookies with
+	// their attributes (LOG_RESP_COOKIES — default false). Only the names
+	// are logged, with "[redacted]" values, unless LogCookieValues
+	// (LOG_COOKIE_VALUES — default false) is set. Values of cookies named in
+	// RedactCookies (REDACT_COOKIES, comma-separated, case-insensitive) are
+	// always replaced with "[redacted]", in the maps and in
+	// req_headers/resp_headers.
+	LogReqCookies   bool
+	LogRespCookies  bool
+	LogCookieValues bool
+	RedactCookies   []string
+	// VerifyContentMD5 checks Content-MD5 headers against the de-chunked
+	// bodies and records the outcome as content_md5_valid (VERIFY_CONTENT_MD5
+	// env var — default false).
+	VerifyContentMD5 bool
+	LogMessageBytes  bool // LOG_MESSAGE_BYTES env var — default false
+	LogRoundTrip     bool // LOG_ROUND_TRIP env var — default false
+	// StrictBodySections drops a body section that does not match the ICAP
+	// method (res-body in REQMOD, req-body in RESPMOD) and records a parse
+	// warning (STRICT_BODY_SECTIONS env var — default false).
+	StrictBodySections bool
+	// FallbackStderr copies entries the sink fails to write to stderr, at
+	// most FallbackStderrRate per second (FALLBACK_STDERR / FALLBACK_STDERR_RATE
+	// env vars — defaults false / 10).
+	FallbackStderr     bool
+	FallbackStderrRate int
+	// LogStdout echoes every entry to stdout as indented JSON in addition to
+	// the sink (LOG_STDOUT env var or --stdout flag — default false).
+	LogStdout bool
+	// HeaderKeyCase selects the key form of icap_headers, req_headers, and
+	// resp_headers: "canonical" (X-Client-Ip) or "lower" (x-client-ip)
+	// (HEADER_KEY_CASE env var — default canonical).
+	HeaderKeyCase string
+	// MarkDisabledBodies logs "[body logging disabled]" in place of a
+	// non-empty body whose side (LOG_REQ_BODY / LOG_RESP_BODY) is off
+	// (MARK_DISABLED_BODIES env var — default false).
+	MarkDisabledBodies bool
+	// Allow206 advertises "Allow: 204, 206" in OPTIONS and answers clients
+	// that send Allow: 206 (but not 204) with 206 Partial Content and
+	// use-original-body=0 instead of a full 200 echo (ALLOW_206 env var —
+	// default false).
+	Allow206 bool
+	// ISTag is sent on OPTIONS and every REQMOD/RESPMOD response
+	// (ICAP_ISTAG env var — default derived from the version and a hash of
+	// the configuration; see defaultISTag).
+	ISTag string
+	// LogStartupBanner writes an "event":"startup" line at the top of every
+	// fresh log file, including after rotation (LOG_STARTUP_BANNER env var —
+	// default false).
+	LogStartupBanner bool
+	// ServiceHeader names an ICAP request header (e.g. X-ICAP-Profile)
+	// whose value selects the service profile instead of the URL path
+	// (SERVICE_SELECTOR_HEADER env var — default empty, path only).
+	ServiceHeader string
+	// ServiceBodyPolicy maps service profiles to none/req/resp/both,
+	// overriding LOG_REQ_BODY / LOG_RESP_BODY per profile
+	// (SERVICE_BODY_POLICY env var — default none).
+	ServiceBodyPolicy map[string]string
+	// OPTIONS capabilities. OptionsMaxConns is the advertised
+	// Max-Connections (OPTIONS_MAX_CONNECTIONS env var — default 0, meaning
+	// MAX_CONCURRENT_CONNS if set, else 100); OptionsTTL is Options-TTL
+	// (OPTIONS_TTL_SEC env var — default 3600); TransferIgnore lists file
+	// extensions advertised in Transfer-Ignore (TRANSFER_IGNORE env var —
+	// default empty, header omitted).
+	OptionsMaxConns int
+	OptionsTTL      time.Duration
+	TransferIgnore  []string
+	// ScrubPII masks PII in logged bodies using PIIPatterns: the built-in
+	// card/e-mail/SSN rules plus any PII_PATTERNS (SCRUB_PII env var —
+	// default false).
+	ScrubPII    bool
+	PIIPatterns []piiPattern
+	// LogKeyAllowlist, when non-empty, is the complete set of top-level keys
+	// an entry may carry; any other key is removed just before writing
+	// (LOG_KEY_ALLOWLIST env var — default empty, no filtering).
+	LogKeyAllowlist []string
+	// LogIncludeHosts / LogExcludeHosts restrict which destination hosts are
+	// logged; patterns may use wildcards such as *.internal. The ICAP response
+	// is unaffected (LOG_INCLUDE_HOSTS / LOG_EXCLUDE_HOSTS env vars — default
+	// empty, log everything).
+	LogIncludeHosts []string
+	LogExcludeHosts []string
+	// LogSampleRate is the fraction of transactions logged; values outside
+	// (0, 1) log everything. The ICAP response is unaffected
+	// (LOG_SAMPLE_RATE env var — default 1).
+	// LogSampleSeed seeds the sampler for reproducible runs (LOG_SAMPLE_SEED
+	// env var — default 0, seeded from the clock).
+	LogSampleRate float64
+	LogSampleSeed uint64
+	// LogConnSummary logs messages served, bytes, and lifetime when each ICAP
+	// connection closes (LOG_CONN_SUMMARY env var — default false).
+	LogConnSummary bool
+	// AlertStatusCodes lists response status codes ("407") or classes ("3xx")
+	// that set alert on the entry, log a warning, and bypass sampling
+	// (ALERT_STATUS_CODES env var — default empty).
+	AlertStatusCodes []string
+	// HostRedaction maps destination host patterns to redaction profiles
+	// (none, headers, body, full), e.g. "*.bank.example.com=full"
+	// (HOST_REDACTION env var — default empty).
+	HostRedaction map[string]string
+	// ICAPServices is the service registry: path → methods and OPTIONS
+	// overrides (ICAP_SERVICES env var — default empty, any path accepted).
+	ICAPServices map[string]icapService
+	// LogWorkers caps concurrent asynchronous log goroutines (LOG_WORKERS env
+	// var — default 0, unlimited); LogWorkerMode is "block" (default) or
+	// "drop" at the cap (LOG_WORKER_MODE env var).
+	LogWorkers    int
+	LogWorkerMode string
+	// OversizeMode picks what happens to a message over MAX_BODY_SIZE:
+	// "reject" answers ICAP 413 and closes the connection; "truncate" cuts
+	// the body short and carries on (OVERSIZE_MODE env var — default
+	// "reject").
+	OversizeMode string
+	// LogFileMode and LogDirMode are octal permissions for log files and for
+	// a log directory that has to be created (LOG_FILE_MODE env var — default
+	// "0644"; LOG_DIR_MODE env var — default "0755").
+	LogFileMode string
+	LogDirMode  string
+	// LogRotateMode is "rename" (default; new inode per file) or
+	// "copytruncate" (active file kept and truncated after copying)
+	// (LOG_ROTATE_MODE env var).
+	LogRotateMode string
+	// ICAPBindAddr and HealthBindAddr restrict the ICAP and health listeners
+	// to one local address, IPv4 or IPv6 (ICAP_BIND_ADDR / HEALTH_BIND_ADDR
+	// env vars — default empty, all interfaces).
+	ICAPBindAddr   string
+	HealthBindAddr string
+	// BodySpillDir receives logged bodies larger than BodySpillThreshold
+	// bytes as one file each (BODY_SPILL_DIR env var — default empty,
+	// disabled; BODY_SPILL_THRESHOLD env var — default 65536).
+	BodySpillDir       string
+	BodySpillThreshold int
+	// BodyLogPolicy maps media ranges ("text/*", "image/png", "*/*") to
+	// full, meta, or drop (BODY_LOG_POLICY env var, e.g.
+	// "text/*:full,image/*:meta" — default empty, built-in handling).
+	BodyLogPolicy map[string]string
+	// IdentityHeaders lists the ICAP headers promoted to client_ip,
+	// auth_user, and subscriber_id (ICAP_IDENTITY_HEADERS env var — default
+	// "X-Client-IP,X-Authenticated-User,X-Subscriber-ID"; "none" disables).
+	IdentityHeaders []string
+	// DebugRawCapture writes raw ICAP messages that failed to parse cleanly,
+	// plus a DebugCaptureRate sample of the rest, to DebugCaptureFile, each
+	// cut at DebugCaptureMaxBytes and base64-encoded unless
+	// DebugCaptureBase64 is off (DEBUG_RAW_CAPTURE — default false;
+	// DEBUG_CAPTURE_FILE — default /var/log/icap/icap_debug.log;
+	// DEBUG_CAPTURE_SAMPLE_RATE — default 0; DEBUG_CAPTURE_MAX_BYTES —
+	// default 65536; DEBUG_CAPTURE_BASE64 — default true).
+	DebugRawCapture      bool
+	DebugCaptureFile     string
+	DebugCaptureRate     float64
+	DebugCaptureMaxBytes int
+	DebugCaptureBase64   bool
+	// ReadIdleTimeout, when set, replaces ReadTimeout as the limit on reading
+	// a message: the read deadline moves forward on every read that makes
+	// progress, and MessageMaxDuration (0 = none) caps the message as a whole
+	// (READ_IDLE_TIMEOUT_SEC / MESSAGE_MAX_DURATION_SEC env vars — default
+	// 0). ReadTimeout still limits the wait for the next keep-alive message.
+	ReadIdleTimeout    time.Duration
+	MessageMaxDuration time.Duration
+	// GeoIPDBs lists MaxMind .mmdb files (e.g. a City and an ASN database)
+	// used to add client_geo and dest_geo to entries; empty disables GeoIP
+	// enrichment. Destination host names are resolved through a cache of
+	// GeoIPDNSCacheSize names kept for GeoIPDNSCacheTTL (GEOIP_DB —
+	// comma-separated, default empty; GEOIP_DNS_CACHE_TTL_SEC — default 300;
+	// GEOIP_DNS_CACHE_SIZE — default 10000).
+	GeoIPDBs          []string
+	GeoIPDNSCacheTTL  time.Duration
+	GeoIPDNSCacheSize int
+	// LogDedupWindow collapses identical consecutive entries logged within
+	// this window into one entry with a repeat_count (LOG_DEDUP_WINDOW env
+	// var, a Go duration such as "5s" — default 0, off).
+	LogDedupWindow time.Duration
+	// StatsEnabled serves cumulative request, connection, and log file
+	// counters as JSON on /stats of the health server (STATS_ENABLED env var
+	// — default true).
+	StatsEnabled bool
+	// ExpectContinue sends an ICAP 100 Continue before reading the req-body
+	// of a non-preview REQMOD whose encapsulated HTTP request carries
+	// "Expect: 100-continue" and whose body has not started to arrive, for
+	// clients that wait for it. Off by default: RFC 3507 only defines 100
+	// Continue after a preview, and a compliant client that sends the body
+	// anyway could take an unexpected 100 for the final response
+	// (EXPECT_CONTINUE env var — default false).
+	ExpectContinue bool
+	// LogRawHeaders adds req_headers_raw: the encapsulated request headers
+	// in wire order and casing, duplicates kept, as parsed from the req-hdr
+	// section rather than from http.Header (LOG_RAW_HEADERS env var —
+	// default false; it roughly doubles the size of the header fields).
+	LogRawHeaders bool
+	// ReadTimeoutResponse answers a message whose read deadline expired
+	// mid-message with "ICAP/1.0 408 Request Timeout" before closing, instead
+	// of closing silently; the read_timeout event is logged either way
+	// (READ_TIMEOUT_RESPONSE env var — default false).
+	ReadTimeoutResponse bool
+	// TimestampFormat selects how entry timestamps are written: rfc3339
+	// (milliseconds, the default), rfc3339nano, epoch, epochms, or a Go time
+	// layout (TIMESTAMP_FORMAT env var — default "rfc3339").
+	TimestampFormat string
+	// Timezone is the zone entry timestamps are written in: local, utc, or
+	// an IANA name (TIMEZONE env var — default "local").
+	Timezone string
+	// LogReqID adds a req_id to every entry and an X-Log-Id header to every
+	// REQMOD/RESPMOD response (LOG_REQ_ID env var — default false).
+	LogReqID bool
+	// ReqIDHeaders are the ICAP headers the request ID is taken from, first
+	// present wins; without one a UUID is generated (REQ_ID_HEADERS env var —
+	// default "X-Transaction-ID,X-Request-Id").
+	ReqIDHeaders []string
+	// BinaryPreviewBytes adds a hexdump -C style preview of the first N
+	// bytes to [binary: N bytes] body markers, capped at
+	// maxBinaryPreviewBytes (BINARY_PREVIEW_BYTES env var — default 0, off).
+	BinaryPreviewBytes int
+	// WorkerCount serves connections on a fixed pool of goroutines
+	// (WORKER_COUNT env var — default 0, one goroutine per connection).
+	// WorkerQueueSize is the accept queue in front of the pool
+	// (WORKER_QUEUE_SIZE — default 0, one slot per worker) and
+	// WorkerQueueMode picks what happens when it is full: "block" (default)
+	// or "reject" (ICAP 503).
+	WorkerCount     int
+	WorkerQueueSize int
+	WorkerQueueMode string
+	// AccessLogFields lists, in order, the entry fields written on each
+	// LOG_FORMAT=access line (ACCESS_LOG_FIELDS env var — default
+	// "timestamp,client_addr,icap_method,req_method,destination_url,resp_status").
+	AccessLogFields []string
+	// LogBufferBytes buffers log file writes in memory, batching many
+	// entries per write syscall (LOG_BUFFER_BYTES env var — default 0,
+	// unbuffered). LogFlushInterval is how often the buffer is flushed
+	// (LOG_FLUSH_INTERVAL — default 1s; 0 flushes only when full, on
+	// rotation, and on shutdown).
+	LogBufferBytes   int
+	LogFlushInterval time.Duration
+	// Listeners are the ICAP ports served by this process, each optionally
+	// limited to one service and logging to a file of its own
+	// (ICAP_LISTENERS env var — default empty, one listener on ICAP_PORT).
+	Listeners []ListenerConfig
+	// ProtoDescriptorSet is a FileDescriptorSet file (protoc
+	// --descriptor_set_out) used to decode protobuf bodies
+	// (PROTOBUF_DESCRIPTOR_SET env var — default empty, disabled).
+	ProtoDescriptorSet string
+	// ProtoTypes maps a body media type to the fully-qualified message it
+	// carries, e.g. "application/x-protobuf=acme.v1.Event"
+	// (PROTOBUF_TYPES env var — default empty).
+	ProtoTypes map[string]string
+	// ProtoRegistry holds the messages loaded from ProtoDescriptorSet.
+	ProtoRegistry protoRegistry
+	// ReqBodyJSON logs JSON request bodies as a nested req_body_json object
+	// instead of the req_body string (LOG_REQ_BODY_JSON env var — default
+	// false). JSONBodyMaxBytes / JSONBodyMaxDepth bound what is embedded;
+	// larger or deeper bodies stay in req_body.
+	ReqBodyJSON      bool
+	JSONBodyMaxBytes int  // JSON_BODY_MAX_BYTES env var — default 65536
+	JSONBodyMaxDepth int  // JSON_BODY_MAX_DEPTH env var — default 32
+	BodyOnErrorOnly  bool // BODY_ON_ERROR_ONLY env var — default false
+	ExtractSNI       bool // EXTRACT_SNI env var — default false
+	SplitEntries     bool // SPLIT_ENTRIES env var — default false
+	HumanSizes       bool // HUMAN_SIZES env var — default false
+	KeepAlive        bool // KEEP_ALIVE env var — default false
+	DetectSecrets    bool // DETECT_SECRETS env var — default false
+	DetectBase64Body bool // DETECT_BASE64_BODY env var — default false
+	MetricsEnabled   bool // METRICS_ENABLED env var — default false
+	RecentBufferSize int  // RECENT_BUFFER_SIZE env var — default 100; 0 disables /recent
+	// SchemeByPort maps a destination port to the scheme logged in
+	// destination_url when X-Forwarded-Proto is absent (SCHEME_PORT_MAP env var
+	// — default "443=https,80=http").
+	SchemeByPort map[string]string
+}
+
+// headerField is one header line as sent on the wire (req_headers_raw).
+type headerField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
 }
 
 // icapInfo holds parsed information from an ICAP request.
@@ -49,15 +398,67 @@ type icapInfo struct {
 	reqPath        string
 	destinationURL string
 	reqHeaders     http.Header
+	reqHeadersRaw  []headerField // wire order and casing (LOG_RAW_HEADERS)
 	reqBody        string
 	respStatus     string
 	respHeaders    http.Header
 	respBody       string
+	tlsServerName  string // SNI from a CONNECT req-body ClientHello (EXTRACT_SNI)
+	reqBodySize    int64  // de-chunked req-body length in bytes, before sanitizing
+	respBodySize   int64  // de-chunked res-body length in bytes, before sanitizing
+	// contentMD5Valid is nil unless VERIFY_CONTENT_MD5 is on and a section
+	// carried a Content-MD5 header; see checkContentMD5.
+	contentMD5Valid *bool
+	// parseWarnings describes recoverable framing problems, e.g. Encapsulated
+	// offsets that are out of order or out of bounds.
+	parseWarnings []string
+	// respBodyType is the sniffed media type of a res-body sent without a
+	// Content-Type header; empty when the header was present.
+	respBodyType string
+	// reqCharset and respCharset are the declared charsets of bodies that
+	// were transcoded to UTF-8; empty when no transcoding happened.
+	reqCharset  string
+	respCharset string
+	// reqSecret and respSecret are set by sanitizeBody when DETECT_SECRETS
+	// is on and the decoded body likely carries a credential.
+	reqSecret  bool
+	respSecret bool
+	// parseError classifies why an encapsulated HTTP header section could not
+	// be parsed, e.g. "req-hdr: bad request line"; empty when both parsed.
+	parseError string
+	// messageBytes is the size of the raw ICAP message as read off the wire
+	// (after any MaxBodySize truncation).
+	messageBytes int
 }
 
 // logEntry is the JSON structure written to the log file.
 type logEntry struct {
-	Timestamp      string            `json:"timestamp"`
+	Timestamp string `json:"timestamp"`
+	// at is when the entry was built; Timestamp is it formatted per
+	// TIMESTAMP_FORMAT, which may not be parseable back.
+	at time.Time
+	// ReqID identifies the HTTP transaction across ICAP stages (LOG_REQ_ID):
+	// from a REQ_ID_HEADERS header, else a generated UUID.
+	ReqID string `json:"req_id,omitempty"`
+	// CorrelationID and Section link the req/res records produced from one
+	// ICAP transaction when SPLIT_ENTRIES is enabled.
+	CorrelationID string `json:"correlation_id,omitempty"`
+	Section       string `json:"section,omitempty"`
+	// ClientAddr and ClientPort identify the ICAP client (normally a Squid
+	// instance) that sent the request. Unix-socket peers have no port and are
+	// usually unnamed, in which case both are omitted.
+	ClientAddr string `json:"client_addr,omitempty"`
+	ClientPort int    `json:"client_port,omitempty"`
+	// ClientIP, AuthUser, and SubscriberID are the end user's address, user
+	// name, and subscriber ID from Squid's X-Client-IP, X-Authenticated-User
+	// (base64 decoded), and X-Subscriber-ID ICAP headers
+	// (ICAP_IDENTITY_HEADERS).
+	ClientIP     string `json:"client_ip,omitempty"`
+	AuthUser     string `json:"auth_user,omitempty"`
+	SubscriberID string `json:"subscriber_id,omitempty"`
+	// Service is the service profile the entry was logged under, set when
+	// SERVICE_SELECTOR_HEADER is configured (header value, else URL path).
+	Service        string            `json:"service,omitempty"`
 	ICAPMethod     string            `json:"icap_method,omitempty"`
 	ICAPURL        string            `json:"icap_url,omitempty"`
 	ICAPHeaders    map[string]string `json:"icap_headers,omitempty"`
@@ -66,8 +467,85 @@ type logEntry struct {
 	DestinationURL string            `json:"destination_url,omitempty"`
 	Tunneled       bool              `json:"tunneled,omitempty"`
 	ReqHeaders     map[string]string `json:"req_headers,omitempty"`
+	ReqHeadersRaw  []headerField     `json:"req_headers_raw,omitempty"`
+	ReqCookies     map[string]string `json:"req_cookies,omitempty"`
 	ReqBody        string            `json:"req_body,omitempty"`
+	ReqBodyJSON    json.RawMessage   `json:"req_body_json,omitempty"`
+	ReqBodyBytes   int64             `json:"req_body_bytes,omitempty"`
+	ReqBodyHuman   string            `json:"req_body_human,omitempty"`
 	RespStatus     string            `json:"resp_status,omitempty"`
 	RespHeaders    map[string]string `json:"resp_headers,omitempty"`
 	RespBody       string            `json:"resp_body,omitempty"`
+	RespBodyBytes  int64             `json:"resp_body_bytes,omitempty"`
+	RespBodyHuman  string            `json:"resp_body_human,omitempty"`
+	// RespBodyType is the media type sniffed from a response body that had
+	// no Content-Type header (e.g. "text/html", "image/png").
+	RespBodyType string `json:"resp_body_type,omitempty"`
+	// ReqBodyRef and RespBodyRef are the paths of side files holding bodies
+	// over BODY_SPILL_THRESHOLD; the inline req_body / resp_body is then
+	// omitted.
+	ReqBodyRef  string `json:"req_body_ref,omitempty"`
+	RespBodyRef string `json:"resp_body_ref,omitempty"`
+	// ReqCharset and RespCharset record the original charset of a text body
+	// that was transcoded to UTF-8 before logging (e.g. "windows-1252").
+	ReqCharset  string `json:"req_charset,omitempty"`
+	RespCharset string `json:"resp_charset,omitempty"`
+	// SecretSuspected is set when DETECT_SECRETS is enabled and either body
+	// looks like it carries a private key, JWT, or high-entropy credential.
+	SecretSuspected bool `json:"secret_suspected,omitempty"`
+	// Alert is set when the response status matches ALERT_STATUS_CODES.
+	// Alerted transactions bypass LOG_SAMPLE_RATE.
+	Alert bool `json:"alert,omitempty"`
+	// LooksBase64 is set when DETECT_BASE64_BODY is enabled and a body is
+	// predominantly a long Base64 payload; Base64DecodedType is the media type
+	// sniffed from its decoded start (request body checked first).
+	LooksBase64       bool   `json:"looks_base64,omitempty"`
+	Base64DecodedType string `json:"base64_decoded_type,omitempty"`
+	// ContentMD5Valid reports whether the body matched its Content-MD5 header
+	// (VERIFY_CONTENT_MD5). Omitted when no section carried the header.
+	ContentMD5Valid *bool `json:"content_md5_valid,omitempty"`
+	// ParseWarnings lists framing problems found while parsing, such as
+	// Encapsulated offsets that are out of order or point past the data.
+	// The affected sections are left out of the entry.
+	ParseWarnings []string `json:"parse_warnings,omitempty"`
+	// ParseError classifies why an encapsulated HTTP header section could not
+	// be parsed ("req-hdr: bad request line", "res-hdr: truncated headers").
+	// The ICAP-level fields are still logged; the raw bytes never are.
+	ParseError string `json:"parse_error,omitempty"`
+	// MessageBytes is the on-the-wire size of the ICAP message, headers and
+	// chunk framing included (LOG_MESSAGE_BYTES). A value at MAX_BODY_SIZE
+	// means the message was truncated.
+	MessageBytes int `json:"message_bytes,omitempty"`
+	// RoundTripMs is the response Date minus the request Date in a RESPMOD
+	// (LOG_ROUND_TRIP). Date has one-second resolution, so 0 is common and
+	// is still logged; the field is omitted when either Date is missing or
+	// unparseable, or the response predates the request.
+	RoundTripMs *int64 `json:"round_trip_ms,omitempty"`
+	// ProcessingMs is how long this server took from the first byte of the
+	// ICAP message to the response being written: reading the message
+	// (including a slow client or body), framing, and the reply. It is
+	// server-side handling only, not upstream or origin latency, and is
+	// omitted when under a millisecond.
+	ProcessingMs int64 `json:"processing_ms,omitempty"`
+	// Extra carries fields added by request hooks (see requestHook), logged
+	// as a nested "extra" object. Split entries share it.
+	Extra map[string]any `json:"extra,omitempty"`
+	// ClientGeo and DestGeo are the country, city, and ASN of the end user
+	// (client_ip, else client_addr) and of the destination host's address,
+	// from GEOIP_DB. Omitted when enrichment is off or nothing is known.
+	ClientGeo *geoInfo `json:"client_geo,omitempty"`
+	DestGeo   *geoInfo `json:"dest_geo,omitempty"`
+	// RepeatCount is set on an entry that stands for that many identical
+	// repeats of the entry logged before it (LOG_DEDUP_WINDOW).
+	RepeatCount int `json:"repeat_count,omitempty"`
+	// TLSServerName is the SNI host name from a TLS ClientHello forwarded as
+	// the req-body of a CONNECT request (EXTRACT_SNI).
+	TLSServerName string `json:"tls_server_name,omitempty"`
+	// RespCookies are the response's Set-Cookie headers by cookie name, with
+	// their attributes (LOG_RESP_COOKIES).
+	RespCookies map[string]responseCookie `json:"resp_cookies,omitempty"`
+	// MethodURLMismatch is set when the ICAP method disagrees with the
+	// service URL, e.g. a REQMOD sent to icap://host/respmod — usually a
+	// swapped icap_service line in squid.conf (see methodURLMismatch).
+	MethodURLMismatch bool `json:"method_url_mismatch,omitempty"`
 }
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxLogRotateSizeMB is the largest LOG_ROTATE_SIZE_MB accepted; anything
+// bigger is almost certainly a unit mistake (bytes or KB given as MB).
+const maxLogRotateSizeMB = 100 * 1024
+
+// validateConfig checks cfg for values that would otherwise only show up as
+// odd runtime behavior — a zero MAX_BODY_SIZE failing every read, a port out
+// of range, an unwritable log directory — and returns every problem found,
+// joined, or nil. main refuses to start on error.
+func validateConfig(cfg Config) error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	for _, p := range []struct{ name, value string }{
+		{"ICAP_PORT", cfg.Port},
+		{"HEALTH_PORT", cfg.HealthPort},
+	} {
+		if n, err := strconv.Atoi(p.value); err != nil || n < 1 || n > 65535 {
+			fail("%s %q is not a port number (1-65535)", p.name, p.value)
+		}
+	}
+
+	ports := map[string]bool{}
+	for _, l := range cfg.Listeners {
+		if n, err := strconv.Atoi(l.Port); err != nil || n < 1 || n > 65535 {
+			fail("ICAP_LISTENERS port %q is not a port number (1-65535)", l.Port)
+		} else if ports[l.Port] {
+			fail("ICAP_LISTENERS lists port %s more than once", l.Port)
+		}
+		ports[l.Port] = true
+		if _, ok := lookupICAPService("/"+l.Service, cfg); l.Service != "" && !ok {
+			fail("ICAP_LISTENERS service %q on port %s is not in ICAP_SERVICES", l.Service, l.Port)
+		}
+		if l.LogFile != "" {
+			if err := checkDirWritable(filepath.Dir(l.LogFile)); err != nil {
+				fail("log directory for ICAP_LISTENERS port %s (%s) is not writable: %w", l.Port, l.LogFile, err)
+			}
+		}
+	}
+
+	if cfg.MaxBodySize <= 0 {
+		fail("MAX_BODY_SIZE must be positive, got %d", cfg.MaxBodySize)
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"READ_TIMEOUT_SEC", cfg.ReadTimeout},
+		{"WRITE_TIMEOUT_SEC", cfg.WriteTimeout},
+	} {
+		if d.value <= 0 {
+			fail("%s must be positive, got %s", d.name, d.value)
+		}
+	}
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"DRAIN_TIMEOUT_SEC", cfg.DrainTimeout},
+		{"BODY_READ_DEADLINE_SEC", cfg.BodyReadDeadline},
+		{"READ_IDLE_TIMEOUT_SEC", cfg.ReadIdleTimeout},
+		{"MESSAGE_MAX_DURATION_SEC", cfg.MessageMaxDuration},
+		{"OPTIONS_TTL_SEC", cfg.OptionsTTL},
+		{"LOG_MAX_AGE_DAYS", cfg.LogMaxAge},
+	} {
+		if d.value < 0 {
+			fail("%s must not be negative, got %s", d.name, d.value)
+		}
+	}
+	for _, n := range []struct {
+		name  string
+		value int
+	}{
+		{"MAX_LOG_BODY_BYTES", cfg.MaxLogBodyBytes},
+		{"MAX_CONCURRENT_CONNS", cfg.MaxConcurrentConns},
+		{"WORKER_COUNT", cfg.WorkerCount},
+		{"LOG_BUFFER_BYTES", cfg.LogBufferBytes},
+		{"WORKER_QUEUE_SIZE", cfg.WorkerQueueSize},
+		{"LOG_WORKERS", cfg.LogWorkers},
+		{"LOG_RETENTION_COUNT", cfg.MaxFileRetention},
+		{"BODY_SPILL_THRESHOLD", cfg.BodySpillThreshold},
+		{"DEBUG_CAPTURE_MAX_BYTES", cfg.DebugCaptureMaxBytes},
+		{"BINARY_PREVIEW_BYTES", cfg.BinaryPreviewBytes},
+	} {
+		if n.value < 0 {
+			fail("%s must not be negative, got %d", n.name, n.value)
+		}
+	}
+
+	if cfg.LogRotateSizeMB < 1 || cfg.LogRotateSizeMB > maxLogRotateSizeMB {
+		fail("LOG_ROTATE_SIZE_MB must be between 1 and %d, got %d", maxLogRotateSizeMB, cfg.LogRotateSizeMB)
+	}
+	if _, err := parseRotateMode(cfg.LogRotateMode); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseFileMode("LOG_FILE_MODE", cfg.LogFileMode, 0o644); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseFileMode("LOG_DIR_MODE", cfg.LogDirMode, 0o755); err != nil {
+		errs = append(errs, err)
+	}
+	for _, f := range cfg.AccessLogFields {
+		if _, ok := accessLogFields[strings.ToLower(f)]; !ok {
+			fail("ACCESS_LOG_FIELDS has unknown field %q", f)
+		}
+	}
+	// Features that parse entries back as JSON; see encodeEntry.
+	if format := strings.ToLower(cfg.LogFormat); format == "cef" || format == "access" || format == "msgpack" {
+		for _, f := range []struct {
+			name string
+			on   bool
+		}{
+			{"LOG_KEY_ALLOWLIST", len(cfg.LogKeyAllowlist) > 0},
+			{"LOG_SPLIT_BY=service", strings.EqualFold(strings.TrimSpace(cfg.LogSplitBy), "service")},
+			{"the webhook sink", usesSink(cfg, "webhook")},
+			{"the gcp sink", usesSink(cfg, "gcp")},
+		} {
+			if f.on {
+				fail("%s requires LOG_FORMAT=json, got %q", f.name, cfg.LogFormat)
+			}
+		}
+	}
+	// FALLBACK_STDERR only sees errors returned by Write. The fan-out and
+	// batching sinks queue entries and always report success, dropping or
+	// failing them later, so the fallback could never fire.
+	if cfg.FallbackStderr {
+		switch {
+		case len(cfg.LogSinks) > 1:
+			fail("FALLBACK_STDERR cannot be used with more than one LOG_SINKS entry")
+		case usesSink(cfg, "webhook"), usesSink(cfg, "gcp"):
+			fail("FALLBACK_STDERR cannot be used with the webhook or gcp sink")
+		}
+	}
+	if strings.EqualFold(cfg.LogFormat, "msgpack") && cfg.LogStartupBanner {
+		fail("LOG_STARTUP_BANNER writes a JSON line and cannot be used with LOG_FORMAT=msgpack")
+	}
+	if _, err := parseTimezone(cfg.Timezone); err != nil {
+		errs = append(errs, err)
+	}
+	if !validTimestampFormat(cfg.TimestampFormat) {
+		fail("TIMESTAMP_FORMAT %q is not rfc3339, rfc3339nano, epoch, epochms, or a Go time layout", cfg.TimestampFormat)
+	}
+
+	for _, e := range []struct {
+		name, value string
+		allowed     []string
+	}{
+		{"OVERSIZE_MODE", cfg.OversizeMode, []string{"reject", "truncate"}},
+		{"CONN_LIMIT_MODE", cfg.ConnLimitMode, []string{"block", "reject"}},
+		{"WORKER_QUEUE_MODE", cfg.WorkerQueueMode, []string{"block", "reject"}},
+		{"LOG_WORKER_MODE", cfg.LogWorkerMode, []string{"block", "drop"}},
+		{"HEADER_KEY_CASE", cfg.HeaderKeyCase, []string{"canonical", "lower"}},
+	} {
+		if e.value != "" && !slices.Contains(e.allowed, strings.ToLower(e.value)) {
+			fail("invalid %s %q (want %s)", e.name, e.value, strings.Join(e.allowed, " or "))
+		}
+	}
+
+	if usesLogFile(cfg) {
+		if err := checkDirWritable(filepath.Dir(cfg.LogFile)); err != nil {
+			fail("log directory for LOG_FILE %s is not writable: %w", cfg.LogFile, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// usesLogFile reports whether the configured sinks write to LOG_FILE.
+func usesLogFile(cfg Config) bool {
+	return usesSink(cfg, "file")
+}
+
+// usesSink reports whether name is among the configured sinks (LOG_SINKS,
+// else LOG_SINK). An empty sink name means "file".
+func usesSink(cfg Config, name string) bool {
+	sinks := cfg.LogSinks
+	if len(sinks) == 0 {
+		sinks = []string{cfg.LogSink}
+	}
+	for _, s := range sinks {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "" {
+			s = "file"
+		}
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDirWritable reports whether a file can be created in dir. A directory
+// that does not exist yet is judged by its nearest existing ancestor, in which
+// the rotating writer would create it.
+func checkDirWritable(dir string) error {
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+	f, err := os.CreateTemp(dir, ".icap-logger-probe-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// effectiveConfig flattens cfg into field name → value for the startup log
+// line, so operators can see what is actually in effect. Durations are
+// rendered as strings, compiled PII patterns and protobuf descriptors as
+// counts, and WEBHOOK_URL with any credentials and query string redacted.
+// Fields are discovered by reflection so new settings show up without
+// touching this function.
+func effectiveConfig(cfg Config) map[string]any {
+	out := make(map[string]any)
+	v := reflect.ValueOf(cfg)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		switch f := v.Field(i).Interface().(type) {
+		case time.Duration:
+			out[name] = f.String()
+		case []piiPattern:
+			out[name] = len(f)
+		case protoRegistry:
+			out[name] = len(f)
+		default:
+			out[name] = f
+		}
+	}
+	out["WebhookURL"] = redactURLCredentials(cfg.WebhookURL)
+	return out
+}
+
+// redactURLCredentials replaces the password and the query string of a URL,
+// where webhook tokens usually live, with "REDACTED". Values that do not
+// parse as a URL are redacted entirely.
+func redactURLCredentials(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "REDACTED"
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "REDACTED"
+	}
+	return u.String()
+}
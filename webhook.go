@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// webhookSink is a logSink that POSTs log entries to an HTTP collector.
+//
+// Queueing and batching are handled by the embedded batchQueue: each batch is
+// sent as a JSON array of up to batchSize entries. A failed POST (transport
+// error or 5xx) is retried up to maxRetries times with exponential backoff;
+// 4xx responses are not retried. Entries that cannot be queued or delivered
+// are dropped, counted in webhookDropped, and logged.
+type webhookSink struct {
+	*batchQueue
+	url        string
+	client     *http.Client
+	maxRetries int
+	backoff    time.Duration
+}
+
+// newWebhookSink validates cfg.WebhookURL and starts the batching goroutine.
+func newWebhookSink(cfg Config) (*webhookSink, error) {
+	u, err := url.Parse(cfg.WebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid WEBHOOK_URL %q", cfg.WebhookURL)
+	}
+	s := &webhookSink{
+		url:        cfg.WebhookURL,
+		client:     &http.Client{Timeout: cfg.WebhookTimeout},
+		maxRetries: max(cfg.WebhookMaxRetries, 0),
+		backoff:    500 * time.Millisecond,
+	}
+	s.batchQueue = newBatchQueue("webhook", cfg.WebhookBatchSize, cfg.WebhookBufferSize,
+		cfg.WebhookFlushInterval, &webhookDropped, s.flush)
+	return s, nil
+}
+
+// flush POSTs batch as a JSON array, retrying transport errors and 5xx
+// responses with exponential backoff.
+func (s *webhookSink) flush(batch [][]byte) {
+	body := make([]byte, 0, 2+len(batch)*256)
+	body = append(body, '[')
+	for i, entry := range batch {
+		if i > 0 {
+			body = append(body, ',')
+		}
+		body = append(body, entry...)
+	}
+	body = append(body, ']')
+
+	delay := s.backoff
+	for attempt := 0; ; attempt++ {
+		status, err := s.post(body)
+		if err == nil && status < 500 {
+			if status >= 400 {
+				webhookDropped.Add(int64(len(batch)))
+				slog.Error("webhook sink: collector rejected batch",
+					"status", status, "entries", len(batch))
+			}
+			return
+		}
+		if attempt >= s.maxRetries {
+			webhookDropped.Add(int64(len(batch)))
+			slog.Error("webhook sink: giving up on batch",
+				"attempts", attempt+1, "entries", len(batch), "status", status, "err", err)
+			return
+		}
+		slog.Warn("webhook sink: POST failed, retrying",
+			"attempt", attempt+1, "status", status, "err", err, "backoff", delay.String())
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post sends one request and returns the response status code.
+func (s *webhookSink) post(body []byte) (int, error) {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// connPool serves accepted connections on a fixed set of WORKER_COUNT
+// goroutines instead of one goroutine per connection. The accept loop queues
+// each connection on a channel of WORKER_QUEUE_SIZE slots that the workers
+// drain, so the goroutine count stays constant under sustained load and each
+// worker reuses one 64 KiB read buffer for every connection it serves.
+//
+// When the queue is full, WORKER_QUEUE_MODE=block (the default) stops
+// accepting until a worker frees a slot, while reject answers the connection
+// with ICAP 503 and closes it. Each time the queue is found full
+// icap_worker_queue_full_total is incremented and a warning logged.
+type connPool struct {
+	queue  chan connJob
+	reject bool
+	cfg    Config
+}
+
+// connJob is one queued connection and the function that serves it with the
+// worker's reader.
+type connJob struct {
+	conn  net.Conn
+	serve func(reader *bufio.Reader)
+}
+
+// newConnPool starts workers goroutines draining a queue of queueSize
+// connections (queueSize <= 0 means one slot per worker). It returns nil when
+// workers <= 0, which keeps goroutine-per-connection.
+func newConnPool(workers, queueSize int, mode string, cfg Config) *connPool {
+	if workers <= 0 {
+		return nil
+	}
+	if queueSize <= 0 {
+		queueSize = workers
+	}
+	p := &connPool{
+		queue:  make(chan connJob, queueSize),
+		reject: strings.EqualFold(mode, "reject"),
+		cfg:    cfg,
+	}
+	for range workers {
+		go p.work()
+	}
+	return p
+}
+
+// work serves queued connections until the queue is closed and drained.
+func (p *connPool) work() {
+	reader := bufio.NewReaderSize(nil, 64*1024)
+	for job := range p.queue {
+		job.serve(reader)
+	}
+}
+
+// submit queues conn to be served by job. It returns false when conn was not
+// queued — rejected with 503 in reject mode, or closed because ctx was
+// cancelled while blocked on a full queue — and the caller must release
+// whatever it reserved for the connection.
+func (p *connPool) submit(ctx context.Context, conn net.Conn, serve func(reader *bufio.Reader)) bool {
+	job := connJob{conn: conn, serve: serve}
+	select {
+	case p.queue <- job:
+		return true
+	default:
+	}
+	workerQueueFull.Add(1)
+	if p.reject {
+		slog.Warn("worker queue full, rejecting with 503",
+			"queue", cap(p.queue), "remote", conn.RemoteAddr().String())
+		go rejectBusy(conn, p.cfg)
+		return false
+	}
+	slog.Warn("worker queue full, waiting for a free worker", "queue", cap(p.queue))
+	select {
+	case p.queue <- job:
+		return true
+	case <-ctx.Done():
+		conn.Close()
+		return false
+	}
+}
+
+// close stops accepting work. Connections already queued are still served;
+// the workers exit once the queue is empty. Only the accept loop submits, so
+// it must call close after its last submit.
+func (p *connPool) close() {
+	close(p.queue)
+}